@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffFormat string
+	diffSort   string
+)
+
+// diffCmd compares two facet documents.
+var diffCmd = &cobra.Command{
+	Use:   "diff BEFORE AFTER",
+	Short: "Compare facet counts of two documents",
+	Long: `Compare facet counts of two documents (json, yaml, toml, csv or tsv,
+detected by file extension) and print per facet change as tree or json.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runDiff,
+}
+
+// mediaTypes maps file extensions to input media types.
+var mediaTypes = map[string]string{
+	".json": "application/json",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".toml": "application/toml",
+	".csv":  "text/csv",
+	".tsv":  "text/tab-separated-values",
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	switch diffSort {
+	case api.SortName, api.SortNatural, api.SortCountDesc, api.SortCountAsc, api.SortDocument, api.SortTree:
+	default:
+		return errors.Errorf("unknown sort %q", diffSort)
+	}
+
+	before, err := parseFile(args[0])
+	if err != nil {
+		return err
+	}
+	after, err := parseFile(args[1])
+	if err != nil {
+		return err
+	}
+
+	diff := api.Diff(before, after, diffSort)
+	switch diffFormat {
+	case "tree":
+		return api.WriteDiffTree(os.Stdout, diff)
+	case "json":
+		enc := jsoniter.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	return errors.Errorf("unknown format %q, use tree or json", diffFormat)
+}
+
+// parseFile parses facet tree from file, the format is detected by extension.
+func parseFile(path string) (*api.Node, error) {
+	mediaType, ok := mediaTypes[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return nil, errors.Errorf("unknown file type of %s", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to close", path, err)
+		}
+	}()
+
+	node, err := api.BufferedMediaTypes.ParseTree(f, mediaType, nil)
+	return node, errors.Wrapf(err, "unable to parse %s", path)
+}
+
+func init() {
+	diffCmd.Flags().StringVarP(&diffFormat, "format", "f", "tree", "output format (tree or json)")
+	diffCmd.Flags().StringVarP(&diffSort, "sort", "s", api.SortName, "order of siblings (name, natural, count_desc, count_asc, document or tree)")
+	RootCmd.AddCommand(diffCmd)
+}
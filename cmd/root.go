@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	"refactored-octo-giggle/pkg/api"
@@ -32,12 +33,22 @@ var RootCmd = &cobra.Command{
 
 func runAPI(cmd *cobra.Command, args []string) {
 	log.Info("API Running", "addr", config.API.Addr())
+	if config.API.GRPCPort != 0 {
+		log.Info("gRPC Running", "addr", config.API.GRPCAddr())
+	}
 	err := api.RunServer(config.API)
 	if err != nil {
 		log.Error("Unable to start server", "err", err)
 	}
 }
 
+// closer closes c and logs the error, as closer of the api package does.
+func closer(c io.Closer) {
+	if err := c.Close(); err != nil {
+		log.Error("Unable to close io.Closer", "err", err)
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	snapshotServer string
+	snapshotToken  string
+)
+
+// snapshotCmd downloads the snapshot of the keyed trees of running server.
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot [FILE]",
+	Short: "Write snapshot of the keyed trees of running server",
+	Long: `Download point-in-time snapshot of the trees stored with ?key= from running
+server and write it to FILE (snapshot_path of the config by default). The
+server restores the trees from snapshot_path at startup. The request is
+authorized by admin_token of the config, or --token.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runSnapshot,
+}
+
+func runSnapshot(cmd *cobra.Command, args []string) error {
+	path := config.API.SnapshotPath
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		return errors.New("snapshot file is not set, pass FILE or set snapshot_path")
+	}
+	server := snapshotServer
+	if server == "" {
+		server = fmt.Sprintf("http://localhost:%d", config.API.Port)
+	}
+
+	token := snapshotToken
+	if token == "" {
+		token = config.API.AdminToken
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(server, "/")+"/api/v1/admin/snapshot", nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to download snapshot")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "unable to download snapshot")
+	}
+	defer closer(resp.Body)
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "unable to download snapshot")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unable to download snapshot: %s %s", resp.Status, b)
+	}
+	if err := api.SaveSnapshot(path, b); err != nil {
+		return err
+	}
+	fmt.Printf("snapshot written to %s (%d bytes)\n", path, len(b))
+	return nil
+}
+
+func init() {
+	snapshotCmd.Flags().StringVarP(&snapshotServer, "server", "s", "", "server URL (default http://localhost:<port of the config>)")
+	snapshotCmd.Flags().StringVarP(&snapshotToken, "token", "t", "", "admin token (default admin_token of the config)")
+	RootCmd.AddCommand(snapshotCmd)
+}
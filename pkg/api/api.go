@@ -3,12 +3,14 @@ package api
 import (
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
-	"sort"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/mgutz/logxi/v1"
+	"github.com/pkg/errors"
 )
 
 // Config is API server configuration, may contain configuration options
@@ -16,12 +18,82 @@ import (
 type Config struct {
 	Address string
 	Port    int
+	// GRPCPort is the port of the gRPC service (facets.proto) served next
+	// to the HTTP API on Address, it is not served when 0.
+	GRPCPort int `mapstructure:"grpc_port"`
 
 	// Timeouts
 	ReadTimeout       time.Duration `mapstructure:"read_timeout"`
 	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
 	WriteTimeout      time.Duration `mapstructure:"write_timeout"`
 	IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+
+	// MaxDecompressedSize limits the size of gzip or deflate encoded request
+	// bodies after decompression, in bytes.
+	MaxDecompressedSize int64 `mapstructure:"max_decompressed_size"`
+
+	// BatchWorkers limits the number of documents of one batch request
+	// aggregated concurrently, defaults to number of CPUs.
+	BatchWorkers int `mapstructure:"batch_workers"`
+
+	// ResultCacheSize limits the number of paged results kept for the
+	// following pages, defaults to 100.
+	ResultCacheSize int `mapstructure:"result_cache_size"`
+	// ResultCacheTTL is how long the paged results are kept since their last
+	// page was read, defaults to 10 minutes.
+	ResultCacheTTL time.Duration `mapstructure:"result_cache_ttl"`
+
+	// ExactNumbers makes the exact numbers mode the default, requests may
+	// still select float numbers with ?numbers=float. Endpoints and input
+	// formats which only support floats keep reading floats.
+	ExactNumbers bool `mapstructure:"exact_numbers"`
+
+	// DatasetsDir is the directory where datasets are persisted, they are
+	// kept only in memory when empty.
+	DatasetsDir string `mapstructure:"datasets_dir"`
+
+	// WindowBucket is the time resolution of the time-windowed counters,
+	// defaults to 10 seconds.
+	WindowBucket time.Duration `mapstructure:"window_bucket"`
+	// WindowRetention is how long the events of the time-windowed counters
+	// are kept, defaults to 24 hours.
+	WindowRetention time.Duration `mapstructure:"window_retention"`
+
+	// SnapshotPath is the file the keyed trees are snapshotted to by
+	// POST /api/v1/admin/snapshot and restored from at startup.
+	SnapshotPath string `mapstructure:"snapshot_path"`
+	// AdminToken authorizes the /api/v1/admin endpoints (Authorization:
+	// Bearer <token>), they are disabled when empty.
+	AdminToken string `mapstructure:"admin_token"`
+	// MaxTrees limits the number of keys of the trees stored with ?key=,
+	// defaults to 1000.
+	MaxTrees int `mapstructure:"max_trees"`
+
+	// JobWorkers limits the number of asynchronous jobs running concurrently,
+	// defaults to number of CPUs.
+	JobWorkers int `mapstructure:"job_workers"`
+	// JobQueueSize limits the number of jobs waiting for a worker, defaults
+	// to 100.
+	JobQueueSize int `mapstructure:"job_queue_size"`
+	// JobResultTTL is how long finished jobs and their results are kept,
+	// defaults to 1 hour.
+	JobResultTTL time.Duration `mapstructure:"job_result_ttl"`
+	// JobsDir is the directory uploads of jobs are stored in until they are
+	// processed, defaults to the system temporary directory.
+	JobsDir string `mapstructure:"jobs_dir"`
+	// JobMaxUploadSize limits the size of job uploads in bytes, defaults to
+	// 1 GiB.
+	JobMaxUploadSize int64 `mapstructure:"job_max_upload_size"`
+
+	// LiveIdleTimeout closes live sessions without messages, defaults to
+	// 1 minute.
+	LiveIdleTimeout time.Duration `mapstructure:"live_idle_timeout"`
+	// LiveMaxMessageSize limits the size of live session messages in bytes,
+	// defaults to 1 MiB.
+	LiveMaxMessageSize int64 `mapstructure:"live_max_message_size"`
+	// LiveAllowedOrigins are the origins (scheme://host[:port]) of web pages
+	// allowed to open live sessions besides the origin of the API itself.
+	LiveAllowedOrigins []string `mapstructure:"live_allowed_origins"`
 }
 
 // Addr returns the API listen address (address:port).
@@ -29,6 +101,11 @@ func (a *Config) Addr() string {
 	return fmt.Sprintf("%s:%d", a.Address, a.Port)
 }
 
+// GRPCAddr returns the gRPC listen address (address:grpc_port).
+func (a *Config) GRPCAddr() string {
+	return fmt.Sprintf("%s:%d", a.Address, a.GRPCPort)
+}
+
 // InputJSON represents incomming facets.
 type InputJSON struct {
 	Data map[string]interface{} `json:"data"`
@@ -36,21 +113,86 @@ type InputJSON struct {
 
 // OutputJSON represents outgoing computed facets.
 type OutputJSON struct {
-	Result []facetValues `json:"result"`
+	Result     []facetValues `json:"result"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	Skipped    []InvalidLeaf `json:"skipped,omitempty"`
 }
 
 type facetValues map[string]float64
 
-// RunServer runs net/http based API server.
-func RunServer(conf Config) error {
+// Router is http.Handler with all the API routes and middlewares. Close stops
+// the workers of the asynchronous jobs.
+type Router struct {
+	http.Handler
+	jobs *jobQueue
+}
+
+// Close cancels the asynchronous jobs and waits for their workers to stop.
+func (r *Router) Close() error {
+	r.jobs.close()
+	return nil
+}
+
+// NewRouter returns Router with all the API routes and middlewares.
+func NewRouter(conf Config) *Router {
+	return newRouter(conf, newTreeStore(conf.MaxTrees))
+}
+
+// newRouter returns the API handler serving the keyed trees of given store.
+func newRouter(conf Config, trees *treeStore) *Router {
+	// wrap adds the middlewares every API endpoint uses.
+	wrap := func(h handler) http.Handler {
+		return panicHandler(ErrHandler(compressHandler(conf.MaxDecompressedSize, h)))
+	}
+
+	// numbers makes the exact numbers mode the default of input read by
+	// types when configured.
+	numbers := func(types *MediaTypes, h handler) handler {
+		if conf.ExactNumbers {
+			return exactByDefault(types, h)
+		}
+		return h
+	}
+
+	results := newResultCache(conf.ResultCacheSize, conf.ResultCacheTTL)
+	// facets adds the middlewares of the facet endpoints.
+	facets := func(types *MediaTypes, h handler) http.Handler {
+		return wrap(numbers(types, withResultCache(results, h)))
+	}
+
 	router := mux.NewRouter()
 	// Clarify this is API.
 	apiRouter := router.PathPrefix("/api").Subrouter()
 	// API should be versioned. Period.
 	v1Router := apiRouter.PathPrefix("/v1").Subrouter()
-	v1Router.Handle("/buffered", panicHandler(ErrHandler(BufferedChallengeHandler))).Methods("POST")
-	v1Router.Handle("/streaming", panicHandler(ErrHandler(StreamingChallengeHandler))).Methods("POST")
+	v1Router.Handle("/buffered", facets(BufferedMediaTypes, withTreeStore(trees, BufferedChallengeHandler))).Methods("POST")
+	v1Router.Handle("/streaming", facets(StreamingMediaTypes, StreamingChallengeHandler)).Methods("POST")
+	v1Router.Handle("/batch", wrap(BatchHandler(conf.BatchWorkers))).Methods("POST")
+	v1Router.Handle("/merge", wrap(MergeHandler)).Methods("POST")
+	v1Router.Handle("/diff", wrap(DiffHandler)).Methods("POST")
+	v1Router.Handle("/datasets/{name}", wrap(withResultCache(results, DatasetHandler(conf.DatasetsDir)))).Methods("GET", "PUT", "PATCH")
+	v1Router.Handle("/windows/{name}", wrap(withResultCache(results, WindowHandler(conf.WindowBucket, conf.WindowRetention)))).Methods("GET", "POST")
+	v1Router.Handle("/trees/{key}", wrap(withResultCache(results, withTreeStore(trees, TreeHandler)))).Methods("GET")
+	v1Router.Handle("/admin/snapshot", wrap(withTreeStore(trees, SnapshotHandler(conf.SnapshotPath, conf.AdminToken)))).Methods("GET", "POST")
+	jobs := newJobQueue(conf.JobWorkers, conf.JobQueueSize, conf.JobResultTTL, conf.JobsDir, conf.JobMaxUploadSize)
+	v1Router.Handle("/jobs", wrap(numbers(StreamingMediaTypes, jobs.handleSubmit))).Methods("POST")
+	v1Router.Handle("/jobs/{id}", wrap(jobs.handleStatus)).Methods("GET", "DELETE")
+	v1Router.Handle("/jobs/{id}/result", wrap(jobs.handleResult)).Methods("GET")
+	v1Router.Handle("/live", wrap(LiveHandler(conf.LiveIdleTimeout, conf.LiveMaxMessageSize, conf.LiveAllowedOrigins))).Methods("GET")
+	return &Router{Handler: router, jobs: jobs}
+}
 
+// RunServer runs net/http based API server, and the gRPC server when
+// GRPCPort is set. The keyed trees are restored from the snapshot first, the
+// server does not start when it is corrupt. It returns when either of the
+// servers fails.
+func RunServer(conf Config) error {
+	trees, err := restoreTrees(conf.SnapshotPath, conf.MaxTrees)
+	if err != nil {
+		return err
+	}
+	router := newRouter(conf, trees)
+	defer closer(router)
 	server := http.Server{
 		Addr:              conf.Addr(),
 		Handler:           router,
@@ -59,32 +201,145 @@ func RunServer(conf Config) error {
 		WriteTimeout:      conf.WriteTimeout,
 		IdleTimeout:       conf.IdleTimeout,
 	}
-	return server.ListenAndServe()
-}
-
-// mapToSlice sorts keys of facets and produces correctly sorted slice of individual
-// {"facetN": 100} objects.
-func mapToSlice(facets facetValues) (out []facetValues) {
-	// Take length of facets map, and sort the keys by name.
-	lenFacets := len(facets)
-	var (
-		i         int
-		facetKeys = make([]string, lenFacets)
-	)
-	for key := range facets {
-		facetKeys[i] = key
-		i++
+
+	errs := make(chan error, 2)
+	if conf.GRPCPort != 0 {
+		// gRPC runs over HTTP/2 without TLS, HTTP/1 clients are told so.
+		// Calls may stream for long, so their deadline (grpc-timeout, up to
+		// grpcMaxTimeout) limits them instead of the server timeouts.
+		grpcServer := http.Server{
+			Addr:              conf.GRPCAddr(),
+			Handler:           GRPCHandler(),
+			ReadHeaderTimeout: conf.ReadHeaderTimeout,
+			IdleTimeout:       conf.IdleTimeout,
+			Protocols:         new(http.Protocols),
+		}
+		grpcServer.Protocols.SetHTTP1(true)
+		grpcServer.Protocols.SetUnencryptedHTTP2(true)
+		go func() {
+			errs <- errors.Wrap(grpcServer.ListenAndServe(), "gRPC server failed")
+		}()
+	}
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	return <-errs
+}
+
+// Facet is a single computed facet. Path contains names of all the facet's
+// ancestors followed by the facet name itself.
+type Facet struct {
+	Name  string
+	Path  []string
+	Count float64
+	// Exact is the exact count in exact numbers mode, nil otherwise.
+	Exact *big.Rat
+	// Series is the element-wise sum of count arrays in the facet's subtree,
+	// nil when there are none.
+	Series []float64
+
+	// Derived metrics, computed only when requested.
+	ShareOfParent   *float64
+	ShareOfTotal    *float64
+	ShareOfSiblings *float64
+}
+
+// Depth returns depth of the facet in the tree, top level facets have depth 1.
+func (f *Facet) Depth() int {
+	return len(f.Path)
+}
+
+// Parent returns name of the parent facet, empty for top level facets.
+func (f *Facet) Parent() string {
+	if len(f.Path) < 2 {
+		return ""
+	}
+	return f.Path[len(f.Path)-2]
+}
+
+// pathKey joins facet path into a single string usable as map key.
+func pathKey(path []string) string {
+	return strings.Join(path, "/")
+}
+
+// parentKey returns the path key of the parent facet, empty for top level
+// facets.
+func (f *Facet) parentKey() string {
+	if len(f.Path) < 2 {
+		return ""
 	}
-	sort.Strings(facetKeys)
+	return pathKey(f.Path[:len(f.Path)-1])
+}
+
+// Result is the computed output passed to Encoders.
+type Result struct {
+	Facets []Facet
+	// Metrics are the requested derived metrics to output along with counts.
+	Metrics []string
+	// NextCursor points to the next page of paged result, empty on the last page.
+	NextCursor string
+	// Skipped are the invalid leaves left out in skip validation mode.
+	Skipped []InvalidLeaf
+}
+
+// facetSlice produces slice of individual {"facetN": 100} objects in the
+// order of facets.
+func facetSlice(facets []Facet) []facetValues {
+	out := make([]facetValues, len(facets))
+	for i, facet := range facets {
+		out[i] = facetValues{facet.Name: facet.Count}
+	}
+	return out
+}
 
-	// Iterate over the sorted keys and insert facets into output slice in the
-	// sorted order.
-	out = make([]facetValues, lenFacets)
-	for i, facet := range facetKeys {
-		out[i] = facetValues{facet: facets[facet]}
+// outputJSON returns the JSON output of result. When derived metrics are
+// requested or facets have series, the facets are objects with name, count,
+// series and the metrics: {"name": "facetN", "count": 100, "share_of_parent": 0.5},
+// otherwise they are the individual {"facetN": 100} objects.
+func outputJSON(res *Result) interface{} {
+	objects := len(res.Metrics) > 0 || res.series()
+	if !objects && !res.exact() {
+		return &OutputJSON{Result: facetSlice(res.Facets), NextCursor: res.NextCursor, Skipped: res.Skipped}
 	}
 
-	return
+	facets := make([]map[string]interface{}, len(res.Facets))
+	for i := range res.Facets {
+		f := &res.Facets[i]
+		if !objects {
+			// Exact counts in the {"facetN": 100} objects.
+			facets[i] = map[string]interface{}{f.Name: f.countValue()}
+			continue
+		}
+		facet := map[string]interface{}{
+			"name":  f.Name,
+			"count": f.countValue(),
+		}
+		if f.Series != nil {
+			facet["series"] = f.Series
+		}
+		for _, metric := range res.Metrics {
+			facet[metric] = metricValues[metric](f)
+		}
+		facets[i] = facet
+	}
+	out := map[string]interface{}{"result": facets}
+	if res.NextCursor != "" {
+		out["next_cursor"] = res.NextCursor
+	}
+	if len(res.Skipped) > 0 {
+		out["skipped"] = res.Skipped
+	}
+	return out
+}
+
+// exact returns true when any of the facets has exact count.
+func (r *Result) exact() bool {
+	for i := range r.Facets {
+		if r.Facets[i].Exact != nil {
+			return true
+		}
+	}
+	return false
 }
 
 // closer serves as utility function to handle errors while closing any closer,
@@ -3,7 +3,11 @@ package api
 import (
 	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/json-iterator/go"
 	"github.com/kr/pretty"
@@ -19,98 +23,490 @@ type InputData struct {
 type Node struct {
 	Name  string
 	Count float64
+	// Exact is the exact count of leaf read in exact numbers mode, Count is
+	// its nearest float then.
+	Exact *big.Rat
+	// Series are the counts of leaf read from count array, Count is their sum.
+	Series []float64
 
 	Parent   *Node
 	Children []*Node
 }
 
+// BufferedMediaTypes are the request and response media types supported by
+// BufferedChallengeHandler.
+var BufferedMediaTypes = NewMediaTypes(mediaTypeJSON)
+
+func init() {
+	BufferedMediaTypes.RegisterInput(mediaTypeJSON, Decoder{
+		Tree: func(r io.Reader, params url.Values, v *Validator) (*Node, error) {
+			if isFlat(params) {
+				if err := floatNumbers(params, "layout=flat"); err != nil {
+					return nil, err
+				}
+				return unmarshalFlat(r, params, v)
+			}
+			sel, err := parseSelector(params)
+			if err != nil {
+				return nil, err
+			}
+			exact, err := exactNumbers(params)
+			if err != nil {
+				return nil, err
+			}
+			return unmarshal(r, treeReader{sel: sel, exact: exact, v: v})
+		},
+		Exact: true,
+	})
+	BufferedMediaTypes.RegisterOutput(mediaTypeJSON, func(w io.Writer, req *http.Request, res *Result) error {
+		return jsoniter.NewEncoder(w).Encode(outputJSON(res))
+	})
+}
+
 // BufferedChallengeHandler implements the same functionality as StreamingChallengeHandler
 // but it buffers the entire body, and parses the json as a whole. This version
 // is much more readable and extendable than the Streaming version.
 func BufferedChallengeHandler(rw http.ResponseWriter, req *http.Request) error {
-	var (
-		out OutputJSON
-	)
-
-	rootNode, err := unmarshal(req.Body)
 	defer closer(req.Body)
 
+	dec, err := BufferedMediaTypes.Decoder(req)
+	if err != nil {
+		return err
+	}
+	if dec.Tree == nil {
+		return newStatusError(http.StatusUnsupportedMediaType, "content type is not supported by buffered handler")
+	}
+	enc, mediaType, err := BufferedMediaTypes.Encoder(req)
+	if err != nil {
+		return err
+	}
+	opts, err := parseOptions(req.URL.Query())
+	if err != nil {
+		return err
+	}
+	key, err := treeKey(req)
+	if err != nil {
+		return err
+	}
+
+	res, err := opts.page(req, func() ([]Facet, error) {
+		rootNode, err := dec.Tree(req.Body, req.URL.Query(), opts.validator)
+		if err == nil {
+			err = opts.validator.Err()
+		}
+		if err != nil {
+			return nil, errors.Wrap(badRequest(err), "unable to parse facets")
+		}
+		if key != "" {
+			if err := treeStoreFrom(req.Context()).put(key, rootNode); err != nil {
+				return nil, err
+			}
+		}
+		return rootNode.selectFacets(opts.selector), nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "unable to parse facets json")
+		return err
 	}
-	out.Result = mapToSlice(rootNode.ToMap())
 
-	enc := jsoniter.NewEncoder(rw)
-	return enc.Encode(&out)
+	setNextLink(rw, req, &res)
+	setSkipped(rw, &res)
+	rw.Header().Set("Content-Type", mediaType)
+	return enc(rw, req, &res)
 }
 
 // unmarshal reads the input reader into a buffer and returns the Root Node
-// containing the entire node tree.
-func unmarshal(r io.Reader) (*Node, error) {
-	var (
-		input InputData
-	)
-
+// containing the entire node tree, read as configured by rd.
+func unmarshal(r io.Reader, rd treeReader) (*Node, error) {
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to read json body")
 	}
-	err = jsoniter.Unmarshal(b, &input)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to parse json")
-	}
-
-	return &input.Data, nil
+	return rd.data(b)
 }
 
 // UnmarshalJSON implements json.Unmarshaler interface for our Node.
+// It validates the input in lenient mode just like FromMap does, but keeps
+// the children in the document order.
 func (n *Node) UnmarshalJSON(b []byte) error {
-	var v map[string]interface{}
+	iter := jsoniter.ConfigDefault.BorrowIterator(b)
+	defer jsoniter.ConfigDefault.ReturnIterator(iter)
 
-	err := jsoniter.Unmarshal(b, &v)
-	if err != nil {
-		return err
+	if iter.WhatIsNext() == jsoniter.NilValue {
+		iter.Skip()
+		return iter.Error
 	}
-	err = n.FromMap(v)
-	if err != nil {
+	v := &Validator{mode: ValidationLenient}
+	treeReader{v: v}.children(jsonSource{iter}, n)
+	if iter.Error != nil && iter.Error != io.EOF {
+		return iter.Error
+	}
+	if err := v.Err(); err != nil {
 		return errors.Wrap(err, "error converting to node tree")
 	}
 	return nil
 }
 
-// FromMap builds the node tree from parsed json objects.
-func (n *Node) FromMap(m map[string]interface{}) error {
+// treeSource is the input document read by treeReader, either JSON read by
+// iterator or document decoded from other formats, see valueSource.
+type treeSource interface {
+	// next returns the type of the next value.
+	next() jsoniter.ValueType
+	// object calls fn with every key of the object, fn reads its value.
+	object(fn func(key string))
+	// array calls fn for every element of the array, fn reads it.
+	array(fn func())
+	// float reads the next number as float.
+	float() float64
+	// number reads the next number as exact as possible.
+	number() interface{}
+	// read reads the next value as decoded value for the validator.
+	read() interface{}
+	// skip skips the next value.
+	skip()
+}
+
+// jsonSource reads JSON document by iterator, the reading stops on the first
+// error, which is left in the iterator.
+type jsonSource struct {
+	iter *jsoniter.Iterator
+}
+
+func (s jsonSource) next() jsoniter.ValueType { return s.iter.WhatIsNext() }
+func (s jsonSource) float() float64           { return s.iter.ReadFloat64() }
+func (s jsonSource) number() interface{}      { return s.iter.ReadNumber() }
+func (s jsonSource) read() interface{}        { return s.iter.Read() }
+func (s jsonSource) skip()                    { s.iter.Skip() }
+
+func (s jsonSource) object(fn func(key string)) {
+	s.iter.ReadObjectCB(func(iter *jsoniter.Iterator, key string) bool {
+		fn(key)
+		return iter.Error == nil
+	})
+}
+
+func (s jsonSource) array(fn func()) {
+	s.iter.ReadArrayCB(func(iter *jsoniter.Iterator) bool {
+		fn()
+		return iter.Error == nil
+	})
+}
+
+// treeReader reads the node tree from the input document, it is the only
+// place which knows the structure of the input, all the formats of the same
+// structure are read by it.
+type treeReader struct {
+	// sel skips the unselected branches, nil selects everything.
+	sel *selector
+	// exact keeps the exact counts in Node.Exact.
+	exact bool
+	// v records the invalid leaves, they are left out of the tree.
+	v *Validator
+}
+
+// data reads the node tree from the "data" object of JSON document b.
+func (rd treeReader) data(b []byte) (*Node, error) {
+	iter := jsoniter.ConfigDefault.BorrowIterator(b)
+	defer jsoniter.ConfigDefault.ReturnIterator(iter)
+
+	root, err := rd.document(jsonSource{iter})
+	if iter.Error == nil && iter.WhatIsNext() != jsoniter.InvalidValue {
+		iter.ReportError("treeReader", "there are bytes left after the data")
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, errors.Wrap(iter.Error, "unable to parse json")
+	}
+	return root, err
+}
+
+// document reads the node tree from the "data" object of the input document.
+func (rd treeReader) document(src treeSource) (*Node, error) {
 	var (
-		err error
+		root = &Node{}
+		err  error
 	)
 
-	// Create slice of nodes of size len(input_map) to avoid reallocations.
-	n.Children = make([]*Node, 0, len(m))
-	for k, v := range m {
-		node := Node{
-			Name:   k,
-			Parent: n,
-		}
-		if inner, ok := v.(map[string]interface{}); ok {
-			// If inner map contains key "count", it is not a node, but our
-			// "attributes" map/struct.
-			if v, ok := inner["count"]; ok {
-				count, ok := v.(float64)
-				if !ok {
-					err = errors.Errorf("count value is invalid type: %+v %T", v, v)
-					return err
-				}
-				node.Count = count
-			} else {
-				err := node.FromMap(inner)
-				if err != nil {
-					return err
+	src.object(func(key string) {
+		switch {
+		case key != "data" || src.next() == jsoniter.NilValue:
+			src.skip()
+		case src.next() != jsoniter.ObjectValue:
+			err = errors.Errorf("data value is invalid type %s, must be object", typeName(src.read()))
+		default:
+			rd.children(src, root)
+		}
+	})
+	return root, err
+}
+
+// children reads object of children of n from src. Invalid leaves do not
+// stop the reading, they are recorded by the validator.
+func (rd treeReader) children(src treeSource, n *Node) {
+	index := make(map[string]int)
+	n.Children = nil
+	src.object(func(key string) {
+		rd.child(src, n, key, index)
+	})
+}
+
+// node reads object of n, object containing "count" key is a leaf (other
+// keys are ignored), otherwise it contains the children. Invalid children are
+// forgotten when the object turns out to be a leaf, valid is false when the
+// leaf count is invalid.
+func (rd treeReader) node(src treeSource, n *Node) (leaf, valid bool) {
+	var (
+		mark  = rd.v.mark()
+		index = make(map[string]int)
+	)
+	n.Children = nil
+	valid = true
+
+	src.object(func(key string) {
+		switch {
+		case key == "count":
+			leaf = true
+			rd.v.rewind(mark)
+			valid = rd.count(src, n)
+		case leaf:
+			src.skip()
+		default:
+			rd.child(src, n, key, index)
+		}
+	})
+	if leaf {
+		n.Children = nil
+	}
+	return leaf, valid
+}
+
+// list reads array of objects of n, every object is read like the object of
+// n and they are merged in order, see Node.mergeElement. Invalid objects are
+// left out.
+func (rd treeReader) list(src treeSource, n *Node) {
+	var leaf bool
+	src.array(func() {
+		if src.next() != jsoniter.ObjectValue {
+			rd.v.nonObject(n.Path(), src.read())
+			return
+		}
+		element := &Node{Name: n.Name, Parent: n.Parent}
+		if elementLeaf, valid := rd.node(src, element); valid {
+			n.mergeElement(element, elementLeaf)
+			leaf = leaf || elementLeaf
+		}
+	})
+	if leaf {
+		n.Children = nil
+	}
+}
+
+// count reads the count of n, count array is read as series. It returns
+// false when the count is invalid.
+func (rd treeReader) count(src treeSource, n *Node) bool {
+	if src.next() != jsoniter.ArrayValue {
+		var ok bool
+		n.Count, n.Exact, ok = rd.number(src, n)
+		return ok
+	}
+
+	valid := true
+	n.Count, n.Exact, n.Series = 0, nil, []float64{}
+	src.array(func() {
+		count, exact, ok := rd.number(src, n)
+		valid = valid && ok
+		n.Series = append(n.Series, count)
+		n.Count += count
+		if exact != nil {
+			n.Exact = addExact(n.Exact, exact)
+		}
+	})
+	return valid
+}
+
+// number reads one count value of n, it returns false when it is invalid.
+func (rd treeReader) number(src treeSource, n *Node) (float64, *big.Rat, bool) {
+	var value interface{}
+	switch {
+	case src.next() != jsoniter.NumberValue:
+		value = src.read()
+	case rd.exact:
+		value = src.number()
+	default:
+		count := src.float()
+		if count >= 0 && !math.IsInf(count, 1) {
+			// Valid, the path is needed only for invalid leaves.
+			return count, nil, true
+		}
+		value = count
+	}
+	return rd.v.number(n.Path(), value, rd.exact)
+}
+
+// child reads child of n of given name, objects are read as nodes and arrays
+// as lists of objects, other values are invalid leaves, or leaves with count 0
+// in lenient mode. Duplicate keys replace the earlier child, but keep its
+// position, index maps names to positions in the children. Invalid leaves are
+// left out.
+func (rd treeReader) child(src treeSource, n *Node, name string, index map[string]int) {
+	node := &Node{
+		Name:   name,
+		Parent: n,
+	}
+	if rd.sel != nil {
+		switch selected, descend := rd.sel.match(node.Path()); {
+		case selected:
+			// The whole subtree is selected.
+			rd.sel = nil
+		case !descend:
+			src.skip()
+			return
+		}
+	}
+	switch src.next() {
+	case jsoniter.ObjectValue:
+		if _, valid := rd.node(src, node); !valid {
+			return
+		}
+	case jsoniter.ArrayValue:
+		rd.list(src, node)
+	default:
+		if !rd.v.emptyLeaf(node.Path(), src.read()) {
+			return
+		}
+	}
+	if i, ok := index[name]; ok {
+		n.Children[i] = node
+	} else {
+		index[name] = len(n.Children)
+		n.Children = append(n.Children, node)
+	}
+}
+
+// MarshalJSON implements json.Marshaler interface for our Node, the output
+// has the same format as the input, so it can be parsed again. Children are
+// written in their order.
+func (n *Node) MarshalJSON() ([]byte, error) {
+	stream := jsoniter.ConfigDefault.BorrowStream(nil)
+	defer jsoniter.ConfigDefault.ReturnStream(stream)
+
+	n.writeDocument(stream)
+	if stream.Error != nil {
+		return nil, stream.Error
+	}
+	return append([]byte(nil), stream.Buffer()...), nil
+}
+
+// writeDocument writes the node in the input format, leaves are {"count": N}
+// objects, or {"count": [N, M]} when they have series.
+func (n *Node) writeDocument(stream *jsoniter.Stream) {
+	stream.WriteObjectStart()
+	if len(n.Children) == 0 && !n.IsRoot() {
+		stream.WriteObjectField("count")
+		switch {
+		case n.Series != nil:
+			stream.WriteArrayStart()
+			for i, v := range n.Series {
+				if i > 0 {
+					stream.WriteMore()
 				}
+				stream.WriteFloat64(v)
 			}
+			stream.WriteArrayEnd()
+		case n.Exact != nil:
+			stream.WriteRaw(formatExact(n.Exact))
+		default:
+			stream.WriteFloat64(n.Count)
+		}
+		stream.WriteObjectEnd()
+		return
+	}
+	for i, child := range n.Children {
+		if i > 0 {
+			stream.WriteMore()
+		}
+		stream.WriteObjectField(child.Name)
+		child.writeDocument(stream)
+	}
+	stream.WriteObjectEnd()
+}
+
+// FromMap builds the node tree from parsed json objects, the input is
+// validated in lenient mode, see ValidationLenient. Keys are read in sorted
+// order, so that the children are in the same order every time.
+func (n *Node) FromMap(m map[string]interface{}) error {
+	v := &Validator{mode: ValidationLenient}
+	treeReader{v: v}.children(&valueSource{value: normalizeDocument(m)}, n)
+	return v.Err()
+}
+
+// treeBuilder builds Node tree from facet paths and their counts, it is used
+// by formats which do not have the tree structure (rows, flattened keys).
+type treeBuilder struct {
+	root   *Node
+	nodes  map[string]*Node // path -> node
+	leaves map[*Node]bool   // nodes which were given count
+}
+
+func newTreeBuilder() *treeBuilder {
+	return &treeBuilder{
+		root:   &Node{},
+		nodes:  make(map[string]*Node),
+		leaves: make(map[*Node]bool),
+	}
+}
+
+// Add sets count of the leaf at path, creating all the missing nodes.
+// Repeated paths replace the earlier count, but keep its position, just like
+// duplicate keys of the JSON input. Paths that would make a node both leaf
+// with count and a parent of other nodes are rejected.
+func (b *treeBuilder) Add(path []string, count float64) error {
+	node, err := b.leaf(path)
+	if err != nil {
+		return err
+	}
+	node.Count, node.Series = count, nil
+	return nil
+}
+
+// AddSeries sets series of the leaf at path just like Add sets count, Count
+// is the sum of the series.
+func (b *treeBuilder) AddSeries(path []string, series []float64) error {
+	node, err := b.leaf(path)
+	if err != nil {
+		return err
+	}
+	node.Count, node.Series = 0, append([]float64(nil), series...)
+	for _, v := range series {
+		node.Count += v
+	}
+	return nil
+}
+
+// leaf returns the leaf at path, creating all the missing nodes.
+func (b *treeBuilder) leaf(path []string) (*Node, error) {
+	node := b.root
+	for i, name := range path {
+		key := strings.Join(path[:i+1], "\x00")
+		child, ok := b.nodes[key]
+		if !ok {
+			child = &Node{Name: name, Parent: node}
+			node.Children = append(node.Children, child)
+			b.nodes[key] = child
 		}
-		n.Children = append(n.Children, &node)
+		node = child
+		if i < len(path)-1 && b.leaves[node] {
+			return nil, errors.Errorf("facet %q has count, but also children", strings.Join(path[:i+1], "/"))
+		}
+	}
+	if len(node.Children) > 0 {
+		return nil, errors.Errorf("facet %q has children, but also count", strings.Join(path, "/"))
 	}
-	return err
+	b.leaves[node] = true
+	return node, nil
+}
+
+// Root returns the root of built tree.
+func (b *treeBuilder) Root() *Node {
+	return b.root
 }
 
 // SumChildren returns the sum of all child counts.
@@ -152,6 +548,73 @@ func (n *Node) ToMap() (out map[string]float64) {
 	return
 }
 
+// Facets goes over the Node tree and returns the facets with their paths and
+// counts, the same way ToMap does. Facets are in depth-first order of the
+// tree, parents before their children.
+func (n *Node) Facets() []Facet {
+	var out []Facet
+	n.facets(&out, make(map[string]int))
+	return out
+}
+
+// facets adds my own and my children's facets into out and returns my sum,
+// exact sum is nil when there are no exact counts in my subtree, series is
+// nil when there are no series.
+// Facets are told apart by their paths, index maps path keys to positions in
+// out.
+func (n *Node) facets(out *[]Facet, index map[string]int) (sum float64, exact *big.Rat, series []float64) {
+	i := -1
+	var path []string
+	if !n.IsRoot() {
+		// Reserve my position before my children.
+		path = n.Path()
+		key := pathKey(path)
+		var ok bool
+		if i, ok = index[key]; !ok {
+			i = len(*out)
+			index[key] = i
+			*out = append(*out, Facet{})
+		}
+	}
+
+	if len(n.Children) == 0 {
+		sum, exact, series = n.Count, n.Exact, addSeries(nil, n.Series)
+	}
+	for _, child := range n.Children {
+		childSum, childExact, childSeries := child.facets(out, index)
+		sum += childSum
+		exact = addExact(exact, childExact)
+		series = addSeries(series, childSeries)
+	}
+	if exact != nil {
+		// Exact sum is more precise than the sum of floats.
+		sum, _ = exact.Float64()
+	}
+	if i >= 0 {
+		(*out)[i] = Facet{
+			Name:   n.Name,
+			Path:   path,
+			Count:  sum,
+			Exact:  exact,
+			Series: series,
+		}
+	}
+	return
+}
+
+// Path returns names of all my ancestors (except root) and my own name.
+func (n *Node) Path() []string {
+	var path []string
+	for node := n; node != nil && !node.IsRoot(); node = node.Parent {
+		path = append(path, node.Name)
+	}
+	// Reverse, we walked from the leaf up.
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
 // IsRoot returns true if node name is empty.
 func (n *Node) IsRoot() bool {
 	return n.Name == ""
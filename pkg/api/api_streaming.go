@@ -3,11 +3,48 @@ package api
 import (
 	"encoding/json"
 	"io"
+	"math/big"
 	"net/http"
+	"net/url"
 
 	"github.com/pkg/errors"
 )
 
+// StreamingMediaTypes are the request and response media types supported by
+// StreamingChallengeHandler.
+var StreamingMediaTypes = NewMediaTypes(mediaTypeJSON)
+
+func init() {
+	StreamingMediaTypes.RegisterInput(mediaTypeJSON, Decoder{
+		Sums: func(r io.Reader, params url.Values, v *Validator) ([]Facet, error) {
+			sel, err := parseSelector(params)
+			if err != nil {
+				return nil, err
+			}
+			exact, err := exactNumbers(params)
+			if err != nil {
+				return nil, err
+			}
+			if isFlat(params) {
+				if exact {
+					return nil, floatNumbers(params, "layout=flat")
+				}
+				// Flattened keys have to be nested first.
+				rootNode, err := unmarshalFlat(r, params, v)
+				if err != nil {
+					return nil, err
+				}
+				return rootNode.selectFacets(sel), nil
+			}
+			return unmarshalWithToken(r, sel, exact, v)
+		},
+		Exact: true,
+	})
+	StreamingMediaTypes.RegisterOutput(mediaTypeJSON, func(w io.Writer, req *http.Request, res *Result) error {
+		return json.NewEncoder(w).Encode(outputJSON(res))
+	})
+}
+
 // StreamingChallengeHandler - implementation of challenge using json.Decoder without
 // buffering the data first. This version would work best when the input data
 // would be streamed. However it is difficult to run concurently, and might
@@ -15,68 +52,319 @@ import (
 // The output, however is not streamed since the "result" array is supposed to be
 // ordered.
 func StreamingChallengeHandler(rw http.ResponseWriter, req *http.Request) error {
-	var (
-		out OutputJSON
-	)
-
-	facetMap, err := unmarshalWithToken(req.Body)
 	defer closer(req.Body)
 
+	dec, err := StreamingMediaTypes.Decoder(req)
+	if err != nil {
+		return err
+	}
+	enc, mediaType, err := StreamingMediaTypes.Encoder(req)
+	if err != nil {
+		return err
+	}
+	opts, err := parseOptions(req.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	if dec.Sums == nil && dec.Tree == nil {
+		return newStatusError(http.StatusUnsupportedMediaType, "content type is not supported by streaming handler")
+	}
+	if mediaType == mediaTypeEventStream {
+		return streamEvents(rw, req, dec, enc, opts)
+	}
+	res, err := opts.page(req, func() ([]Facet, error) {
+		return dec.facets(req.Body, req.URL.Query(), opts)
+	})
 	if err != nil {
-		return errors.Wrap(err, "unable to parse facets json")
+		return err
 	}
-	out.Result = mapToSlice(facetMap)
 
-	enc := json.NewEncoder(rw)
-	return enc.Encode(&out)
+	setNextLink(rw, req, &res)
+	setSkipped(rw, &res)
+	rw.Header().Set("Content-Type", mediaType)
+	return enc(rw, req, &res)
+}
+
+// facets returns the facets of the document read from r, as configured by
+// the query params and opts. Formats which can't be summed while streaming
+// are parsed to tree.
+func (dec Decoder) facets(r io.Reader, params url.Values, opts Options) (facets []Facet, err error) {
+	if dec.Sums != nil {
+		facets, err = dec.Sums(r, params, opts.validator)
+	} else {
+		var rootNode *Node
+		rootNode, err = dec.Tree(r, params, opts.validator)
+		if err == nil {
+			facets = rootNode.selectFacets(opts.selector)
+		}
+	}
+	if err == nil {
+		err = opts.validator.Err()
+	}
+	if err != nil {
+		return nil, errors.Wrap(badRequest(err), "unable to parse facets")
+	}
+	return facets, nil
+}
+
+// tokenFrame is one open JSON object or array while walking the tokens.
+type tokenFrame struct {
+	object    bool   // object or array
+	expectKey bool   // next string token in object is a key
+	key       string // last seen key in object
+	tree      bool   // "data" object, a facet object or object of facet list, its object keys are facets
+	facet     bool   // facet object or list, its name is on top of the path
+	list      bool   // facet list, its objects are read like facet objects
+	count     bool   // "count" array, its numbers are counted as series
+	wave      int    // index of the next number in "count" array
+	selected  bool   // last seen key in object is selected facet
+	selects   bool   // facet object starting the selected subtree
+	invalid   bool   // facet object with invalid count, it is dropped in skip mode
+	start     int    // length of facets when the facet object opened
+	undo      int    // length of undo log when the facet object opened
+}
+
+// countUndo records count added to facet, so that it can be subtracted when
+// the facet object it was counted for is dropped.
+type countUndo struct {
+	facet int      // index in facets
+	count float64  // added count
+	exact *big.Rat // added exact count
+	wave  int      // index in series, -1 when not counted as series
+	waves int      // length of series before the count was added
 }
 
 // nolint: gocyclo
 // unmarshalWithToken name is a bit misleading, but I use it to discern this "token type switch"
 // version from the "buffered map[string]interface{}" version.
-// This version goes over the JSON tokens and saves all the seen facet names in a buffer
-// and upon encountering numeric type, it saves the buffered names a keys in a map
-// and increases their values by the number seen.
-func unmarshalWithToken(reader io.Reader) (facetValues, error) {
+// This version goes over the JSON tokens and keeps the path of currently open facets,
+// upon encountering "count" number, it increases the values of all the facets
+// on the path by the number seen. Numbers of "count" arrays are added to the
+// series of the facets as well, lists of objects are read like the facet
+// object.
+// Facets not selected by sel are skipped without walking their tokens, exact
+// keeps the exact sums in Facet.Exact. Invalid counts and facet values are
+// recorded by v and not counted.
+func unmarshalWithToken(reader io.Reader, sel *selector, exact bool, v *Validator) ([]Facet, error) {
 	var (
-		seenBuf     []string            // all the facets encountered before "count"
-		facetValues = make(facetValues) // map of "facetN": 100
+		path     []string           // currently open facets
+		open     []int              // index in facets of every facet on the path, -1 when not selected
+		stack    []tokenFrame       // currently open objects and arrays
+		facets   []Facet            // facets in the order they were seen
+		undo     []countUndo        // counts added within open facets, in skip mode
+		index    = map[string]int{} // path key -> index in facets
+		selected = 0                // index of the selected subtree root in path, -1 outside of it
+		progress = progressOf(reader)
 	)
+	if sel != nil {
+		selected = -1
+	}
+
+	// addFacet registers facet of given name as a child of the current path
+	// and returns its index in facets.
+	addFacet := func(name string) int {
+		facetPath := append(append([]string(nil), path...), name)
+		key := pathKey(facetPath)
+		if i, ok := index[key]; ok {
+			return i
+		}
+		index[key] = len(facets)
+		facets = append(facets, Facet{Name: name, Path: facetPath})
+		return len(facets) - 1
+	}
+
+	// dropFacet removes the facet of frame on top of the path with its
+	// descendants, which were added after it, the counts added within it are
+	// subtracted from the facets which were there before.
+	dropFacet := func(frame *tokenFrame) {
+		if selected < 0 {
+			return
+		}
+		for i := len(undo) - 1; i >= frame.undo; i-- {
+			u := undo[i]
+			if u.facet >= frame.start {
+				continue
+			}
+			f := &facets[u.facet]
+			f.Count -= u.count
+			if u.exact != nil {
+				f.Exact.Sub(f.Exact, u.exact)
+			}
+			if u.wave >= 0 {
+				f.Series[u.wave] -= u.count
+				if f.Series = f.Series[:u.waves]; u.waves == 0 {
+					f.Series = nil
+				}
+			}
+		}
+		undo = undo[:frame.undo]
+		for _, f := range facets[frame.start:] {
+			delete(index, pathKey(f.Path))
+		}
+		facets = facets[:frame.start]
+	}
 
 	dec := json.NewDecoder(reader)
+	if exact {
+		dec.UseNumber()
+	}
 	for {
 		tok, err := dec.Token()
 		if err == io.EOF {
+			if len(stack) > 0 {
+				return nil, errors.Wrap(io.ErrUnexpectedEOF, "error decoding input data")
+			}
 			break
 		}
 		if err != nil {
 			return nil, errors.Wrap(err, "error decoding input data")
 		}
 
-		switch v := tok.(type) {
-		case json.Delim:
-			switch v {
-			case '}':
-				// Upon closing of JSON object, we remove 1 item from the end of "seen".
-				if len(seenBuf) > 1 {
-					seenBuf = seenBuf[:len(seenBuf)-1]
+		var parent *tokenFrame
+		if len(stack) > 0 {
+			parent = &stack[len(stack)-1]
+		}
+		// Object keys are just remembered, their value decides what they are.
+		if key, ok := tok.(string); ok && parent != nil && parent.object && parent.expectKey {
+			parent.key = key
+			parent.expectKey = false
+			parent.selected = selected >= 0
+			if parent.tree && key != "count" && selected < 0 {
+				var descend bool
+				parent.selected, descend = sel.match(append(path[:len(path):len(path)], key))
+				if !parent.selected && !descend {
+					// Nothing selected below, skip the whole value at once.
+					var skipped json.RawMessage
+					if err := dec.Decode(&skipped); err != nil {
+						return nil, errors.Wrap(err, "error decoding input data")
+					}
+					parent.expectKey = true
 				}
 			}
-		case string:
-			switch v {
-			// "data" and "count" values are skipped, everything else is facet.
-			case "data", "count":
-				continue
-			default:
-				seenBuf = append(seenBuf, v)
+			continue
+		}
+		if parent != nil && parent.object {
+			parent.expectKey = true
+		}
+		// Key in a facet tree object other than "count" is a facet.
+		isFacet := parent != nil && parent.object && parent.tree && parent.key != "count"
+		// Facets on the way to the selected subtrees are walked, but not counted.
+		isSelected := isFacet && parent.selected
+
+		switch delim := tok.(type) {
+		case json.Delim:
+			switch delim {
+			case '{', '[':
+				frame := tokenFrame{object: delim == '{', expectKey: true}
+				switch {
+				case parent == nil:
+				case isFacet:
+					frame.start, frame.undo = len(facets), len(undo)
+					i := -1
+					if isSelected {
+						i = addFacet(parent.key)
+						if selected < 0 {
+							selected, frame.selects = len(path), true
+						}
+					}
+					path, open = append(path, parent.key), append(open, i)
+					frame.tree, frame.facet, frame.list = frame.object, true, !frame.object
+					progress.enter(len(path))
+				case parent.list && frame.object:
+					frame.tree = true
+				case parent.list:
+					v.nonObject(path, []interface{}{})
+				case len(stack) == 1 && parent.key == "data" && frame.object:
+					frame.tree = true
+				case parent.object && parent.tree && parent.key == "count" && !frame.object:
+					frame.count = true
+				case (parent.object && parent.tree && parent.key == "count") || parent.count:
+					// Counts are numbers or arrays of numbers.
+					value := interface{}([]interface{}{})
+					if frame.object {
+						value = map[string]interface{}{}
+					}
+					v.Invalid(path, nil, "count value is invalid type "+typeName(value))
+					countOwner(stack).invalid = true
+					parent.wave++
+				}
+				stack = append(stack, frame)
+			case '}', ']':
+				if parent.facet {
+					if parent.invalid && v.mode == ValidationSkip {
+						dropFacet(parent)
+					}
+					path, open = path[:len(path)-1], open[:len(open)-1]
+					if len(path) == 0 {
+						// No facet is open, the counts can't be dropped anymore.
+						undo = undo[:0]
+					}
+					progress.leave(len(path))
+				}
+				if parent.selects {
+					selected = -1
+				}
+				stack = stack[:len(stack)-1]
 			}
-		case float64:
-			// Increase all the seen facet's values by v.
-			for _, facet := range seenBuf {
-				facetValues[facet] += v
+		default:
+			counted := parent != nil && ((parent.object && parent.tree && parent.key == "count") || parent.count)
+			switch {
+			case counted:
+				wave := -1
+				if parent.count {
+					wave = parent.wave
+					parent.wave++
+				}
+				count, exactCount, ok := v.number(path, tok, exact)
+				if !ok {
+					countOwner(stack).invalid = true
+					break
+				}
+				if selected < 0 {
+					break
+				}
+				if len(path) > selected {
+					progress.count(path[selected], count)
+				}
+				// Increase all the selected facets on the path by the count.
+				for _, i := range open[selected:] {
+					if v.mode == ValidationSkip {
+						undo = append(undo, countUndo{facet: i, count: count, exact: exactCount, wave: wave, waves: len(facets[i].Series)})
+					}
+					f := &facets[i]
+					f.Count += count
+					if exactCount != nil {
+						f.Exact = addExact(f.Exact, exactCount)
+					}
+					if wave >= 0 {
+						f.Series = addSeriesAt(f.Series, wave, count)
+					}
+				}
+			case isFacet:
+				if v.emptyLeaf(append(path[:len(path):len(path)], parent.key), tok) && isSelected {
+					addFacet(parent.key)
+				}
+			case parent != nil && parent.list:
+				v.nonObject(path, tok)
 			}
 		}
 	}
 
-	return facetValues, nil
+	for i := range facets {
+		if facets[i].Exact != nil {
+			// Exact sum is more precise than the sum of floats.
+			facets[i].Count, _ = facets[i].Exact.Float64()
+		}
+	}
+	return facets, nil
+}
+
+// countOwner returns the object frame of the "count" key of the value on top
+// of the stack, which is either the count itself or its "count" array.
+func countOwner(stack []tokenFrame) *tokenFrame {
+	if top := &stack[len(stack)-1]; top.object {
+		return top
+	}
+	return &stack[len(stack)-2]
 }
@@ -1,6 +1,8 @@
 package api_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -84,6 +86,27 @@ func TestStreamingChallengeHandlerNoData(t *testing.T) {
 	assert.JSONEq(t, `{"result": []}`, rr.Body.String(), "Response body differs")
 }
 
+// TestStreamingChallengeHandlerSiblings tests that counts of top level
+// facets are not added to their preceding siblings.
+func TestStreamingChallengeHandlerSiblings(t *testing.T) {
+	body := `{"data": {"facet1": {"facet3": {"count": 10}}, "facet2": {"count": 5}}}`
+	req, err := http.NewRequest("POST", "/api/v1/challenge", strings.NewReader(body))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	http.Handler(api.ErrHandler(api.StreamingChallengeHandler)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Status code differs. Expected %d .\n Got %d instead", http.StatusOK, status)
+	}
+
+	assert.JSONEq(t, `{"result": [{"facet1": 10}, {"facet2": 5}, {"facet3": 10}]}`, rr.Body.String(), "Response body differs")
+}
+
 func TestBufferedChallengeHandler(t *testing.T) {
 	req, err := http.NewRequest("POST", "/api/v1/challenge2", strings.NewReader(testBody))
 
@@ -182,3 +205,104 @@ func BenchmarkBufferedChallengeHandler(b *testing.B) {
 		assert.JSONEq(b, expectedOutput, rr.Body.String(), "Response body differs")
 	}
 }
+
+// formatTypes are the media types compared by the format benchmarks.
+var formatTypes = []string{"application/json", "application/x-protobuf", "application/msgpack"}
+
+// formatBodies returns the small test document and document of 1000 leaves
+// in the input formats.
+func formatBodies(b *testing.B) map[string]map[string][]byte {
+	bodies := make(map[string]map[string][]byte)
+	for name, body := range map[string]string{"small": testBody, "large": largeBody(1000)} {
+		tree := parseTree(b, body)
+		bodies[name] = map[string][]byte{
+			formatTypes[0]: []byte(body),
+			formatTypes[1]: tree.MarshalProto(),
+			formatTypes[2]: tree.MarshalMsgpack(),
+		}
+	}
+	return bodies
+}
+
+// BenchmarkFormats compares the input and output formats of the buffered
+// handler, the same format is used for both.
+func BenchmarkFormats(b *testing.B) {
+	router := api.NewRouter(api.Config{})
+	for _, size := range []string{"small", "large"} {
+		bodies := formatBodies(b)[size]
+		for _, mediaType := range formatTypes {
+			body := bodies[mediaType]
+			b.Run(size+"/"+mediaType[strings.Index(mediaType, "/")+1:], func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(body)))
+				for i := 0; i < b.N; i++ {
+					rr := binaryRequest(b, router, "/api/v1/buffered", mediaType, mediaType, body)
+					if rr.Code != http.StatusOK {
+						b.Fatalf("status code %d: %s", rr.Code, rr.Body.String())
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkCodecs compares parsing the document and encoding its result
+// without the HTTP handling: the registered formats (JSON by jsoniter) and
+// encoding/json, which was used before jsoniter.
+func BenchmarkCodecs(b *testing.B) {
+	for _, size := range []string{"small", "large"} {
+		bodies := formatBodies(b)[size]
+		for _, mediaType := range formatTypes {
+			body := bodies[mediaType]
+			req := httptest.NewRequest("POST", "/api/v1/buffered", nil)
+			req.Header.Set("Accept", mediaType)
+			enc, _, err := api.BufferedMediaTypes.Encoder(req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(size+"/"+mediaType[strings.Index(mediaType, "/")+1:], func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(body)))
+				var out bytes.Buffer
+				for i := 0; i < b.N; i++ {
+					root, err := api.BufferedMediaTypes.ParseTree(bytes.NewReader(body), mediaType, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					out.Reset()
+					if err := enc(&out, req, &api.Result{Facets: root.Facets()}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+
+		body := bodies["application/json"]
+		b.Run(size+"/encoding-json", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			var out bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				var (
+					in   api.InputJSON
+					root api.Node
+				)
+				if err := json.Unmarshal(body, &in); err != nil {
+					b.Fatal(err)
+				}
+				if err := root.FromMap(in.Data); err != nil {
+					b.Fatal(err)
+				}
+				facets := root.Facets()
+				result := make([]map[string]float64, len(facets))
+				for i, f := range facets {
+					result[i] = map[string]float64{f.Name: f.Count}
+				}
+				out.Reset()
+				if err := json.NewEncoder(&out).Encode(map[string]interface{}{"result": result}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
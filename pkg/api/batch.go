@@ -0,0 +1,241 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeNDJSON = "application/x-ndjson"
+)
+
+// batchDocument is a single named facet document of the batch request, err
+// is set when it could not be decoded.
+type batchDocument struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+
+	err error
+}
+
+// batchResult is the result of a single batch document, either Result
+// or Error is set.
+type batchResult struct {
+	index int
+
+	Name   string        `json:"name"`
+	Result []facetValues `json:"result"`
+	Error  *errJSON      `json:"error,omitempty"`
+}
+
+// BatchOutputJSON represents outgoing results of batch request, in the order
+// of the input documents.
+type BatchOutputJSON struct {
+	Results []batchResult `json:"results"`
+}
+
+// BatchHandler returns handler aggregating many named facet documents in one
+// request. Documents are sent either as JSON array or as NDJSON stream:
+//
+//	[{"name": "segment1", "data": {...}}, {"name": "segment2", "data": {...}}]
+//
+// They are aggregated concurrently by at most workers goroutines (number of CPUs
+// when workers <= 0). Invalid document does not fail the whole batch, its
+// result contains the error instead. Facets of every result are ordered by
+// ?sort= option.
+func BatchHandler(workers int) func(http.ResponseWriter, *http.Request) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		var (
+			out     BatchOutputJSON
+			wg      sync.WaitGroup
+			jobs    = make(chan batchJob)
+			results = make(chan batchResult)
+			done    = make(chan struct{})
+		)
+		defer closer(req.Body)
+
+		ndjson, err := batchContentType(req)
+		if err != nil {
+			return err
+		}
+		// Documents are read as floats.
+		if err := floatNumbers(req.URL.Query(), "batch"); err != nil {
+			return err
+		}
+		order, err := parseSort(req.URL.Query().Get("sort"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					results <- job.aggregate()
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+		go func() {
+			for result := range results {
+				out.Results = append(out.Results, result)
+			}
+			close(done)
+		}()
+
+		err = decodeBatch(req.Body, ndjson, func(index int, doc batchDocument) error {
+			jobs <- batchJob{index: index, doc: doc, order: order}
+			return nil
+		})
+		close(jobs)
+		<-done
+		if err != nil {
+			return errors.Wrap(badRequest(err), "unable to parse batch")
+		}
+
+		sort.Slice(out.Results, func(i, j int) bool {
+			return out.Results[i].index < out.Results[j].index
+		})
+		if out.Results == nil {
+			out.Results = []batchResult{}
+		}
+		rw.Header().Set("Content-Type", mediaTypeJSON)
+		return jsoniter.NewEncoder(rw).Encode(&out)
+	}
+}
+
+// batchJob is a document waiting for aggregation.
+type batchJob struct {
+	index int
+	doc   batchDocument
+	order string
+}
+
+// aggregate computes facets of the job's document.
+func (j batchJob) aggregate() batchResult {
+	var (
+		root   Node
+		result = batchResult{index: j.index, Name: j.doc.Name}
+	)
+
+	if j.doc.err != nil {
+		result.Error = &errJSON{StatusCode: http.StatusBadRequest, Message: j.doc.err.Error()}
+		return result
+	}
+	if len(j.doc.Data) > 0 {
+		if err := jsoniter.Unmarshal(j.doc.Data, &root); err != nil {
+			result.Error = &errJSON{
+				StatusCode: http.StatusBadRequest,
+				Message:    errors.Wrap(err, "unable to parse facets").Error(),
+			}
+			return result
+		}
+	}
+	facets := root.Facets()
+	sortFacets(facets, j.order)
+	result.Result = facetSlice(facets)
+	return result
+}
+
+// batchContentType returns true for NDJSON requests and false for JSON array
+// requests, other content types are rejected.
+func batchContentType(req *http.Request) (ndjson bool, err error) {
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		return false, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false, newStatusError(http.StatusUnsupportedMediaType, "invalid content type %q: %s", contentType, err)
+	}
+	switch mediaType {
+	case mediaTypeJSON:
+		return false, nil
+	case mediaTypeNDJSON, "application/ndjson":
+		return true, nil
+	}
+	return false, newStatusError(
+		http.StatusUnsupportedMediaType,
+		"unsupported content type %q, supported: %s, %s", mediaType, mediaTypeJSON, mediaTypeNDJSON,
+	)
+}
+
+// decodeBatch reads the documents one by one and calls fn for each of them,
+// error returned from fn stops the decoding. Documents which are not
+// objects, and malformed NDJSON lines, are passed to fn with err set, other
+// malformed JSON ends the array.
+func decodeBatch(r io.Reader, ndjson bool, fn func(int, batchDocument) error) error {
+	if ndjson {
+		return decodeNDJSON(r, fn)
+	}
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return errors.Wrap(err, "error decoding batch")
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errors.New("batch must be JSON array of documents")
+	}
+
+	for index := 0; ; index++ {
+		if !dec.More() {
+			// Consume the closing ']'.
+			_, err := dec.Token()
+			return errors.Wrap(err, "error decoding batch")
+		}
+		var doc batchDocument
+		if err := dec.Decode(&doc); err != nil {
+			// The decoder skips values of wrong type.
+			if _, ok := err.(*json.UnmarshalTypeError); !ok {
+				return errors.Wrapf(err, "error decoding document %d", index)
+			}
+			doc.err = errors.Wrapf(err, "error decoding document %d", index)
+		}
+		if err := fn(index, doc); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeNDJSON decodes every non-empty line as document on its own, so that
+// a malformed line only fails its document.
+func decodeNDJSON(r io.Reader, fn func(int, batchDocument) error) error {
+	br := bufio.NewReader(r)
+	for index := 0; ; {
+		line, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return errors.Wrapf(readErr, "error reading document %d", index)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var doc batchDocument
+			if err := json.Unmarshal(line, &doc); err != nil {
+				doc = batchDocument{err: errors.Wrapf(err, "error decoding document %d", index)}
+			}
+			if err := fn(index, doc); err != nil {
+				return err
+			}
+			index++
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
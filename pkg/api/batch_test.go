@@ -0,0 +1,150 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const expectedBatchOutput = `{
+	"results": [
+		{"name": "segment1", "result": [{"facet1": 10}, {"facet2": 10}]},
+		{"name": "segment2", "result": null, "error": {"status_code": 400, "error": "invalid count"}},
+		{"name": "segment3", "result": []}
+	]
+}`
+
+func TestBatchHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			"array", "application/json",
+			`[
+				{"name": "segment1", "data": {"facet1": {"facet2": {"count": 10}}}},
+				{"name": "segment2", "data": {"facet1": {"count": "abc"}}},
+				{"name": "segment3", "data": {}}
+			]`,
+		},
+		{
+			"ndjson", "application/x-ndjson",
+			`{"name": "segment1", "data": {"facet1": {"facet2": {"count": 10}}}}
+{"name": "segment2", "data": {"facet1": {"count": "abc"}}}
+{"name": "segment3", "data": {}}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/v1/batch", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{BatchWorkers: 2}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+
+			// Error messages contain parser details, only check they exist.
+			var out api.BatchOutputJSON
+			if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+				t.Fatal(err)
+			}
+			if assert.Equal(t, 3, len(out.Results), "number of results differs") {
+				assert.Contains(t, out.Results[1].Error.Message, "count value is invalid type", "error message differs")
+				out.Results[1].Error.Message = "invalid count"
+			}
+			b, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.JSONEq(t, expectedBatchOutput, string(b), "response body differs")
+		})
+	}
+}
+
+func TestBatchHandlerInvalidDocument(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			"array", "application/json",
+			`[{"name": "segment1", "data": {}}, "segment2", {"name": "segment3", "data": {}}]`,
+		},
+		{
+			"ndjson", "application/x-ndjson",
+			`{"name": "segment1", "data": {}}
+{"name": "segment2", "data": {
+{"name": "segment3", "data": {}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/v1/batch", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+			var out api.BatchOutputJSON
+			if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+				t.Fatal(err)
+			}
+			if assert.Equal(t, 3, len(out.Results), "number of results differs") {
+				assert.Nil(t, out.Results[0].Error, "error differs")
+				if assert.NotNil(t, out.Results[1].Error, "error differs") {
+					assert.Equal(t, http.StatusBadRequest, out.Results[1].Error.StatusCode, "status code differs")
+					assert.Contains(t, out.Results[1].Error.Message, "error decoding document 1", "error message differs")
+				}
+				assert.Equal(t, "segment3", out.Results[2].Name, "name differs")
+				assert.Nil(t, out.Results[2].Error, "error differs")
+			}
+		})
+	}
+}
+
+func TestBatchHandlerInvalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"not array", "application/json", `{"name": "segment1"}`, http.StatusBadRequest},
+		{"malformed", "application/json", `[{"name": "segment1", "data": {}`, http.StatusBadRequest},
+		{"content type", "text/plain", `[]`, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/v1/batch", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.status, rr.Code, "status code differs")
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultMaxDecompressedSize is used when Config.MaxDecompressedSize is not set.
+const defaultMaxDecompressedSize = 100 << 20 // 100 MiB
+
+// compressHandler transparently decompresses request bodies sent with
+// Content-Encoding gzip or deflate, and gzips the response when client
+// accepts it. The decompressed body is limited to maxSize bytes, so that
+// small compressed payloads can't explode into gigabytes (zip bombs).
+func compressHandler(maxSize int64, next handler) handler {
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		body, err := decodeBody(req.Body, req.Header.Get("Content-Encoding"), maxSize)
+		if err != nil {
+			return err
+		}
+		req.Body = body
+		req.Header.Del("Content-Encoding")
+
+		if acceptsGzip(req.Header.Get("Accept-Encoding")) {
+			gw := &gzipResponseWriter{ResponseWriter: rw}
+			defer closer(gw)
+			rw = gw
+		}
+		rw.Header().Add("Vary", "Accept-Encoding")
+		return next(rw, req)
+	}
+}
+
+// decodeBody wraps body with decompressing readers for each of the encodings
+// listed in contentEncoding. Encodings are listed in the order they were applied,
+// so they are removed in reverse order.
+// Only the decompressed output is limited, identity bodies are passed as they are.
+func decodeBody(body io.ReadCloser, contentEncoding string, maxSize int64) (io.ReadCloser, error) {
+	var (
+		encodings []string
+		closers             = []io.Closer{body}
+		r         io.Reader = body
+	)
+	for _, enc := range strings.Split(contentEncoding, ",") {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if enc != "" && enc != "identity" {
+			encodings = append(encodings, enc)
+		}
+	}
+	if len(encodings) == 0 {
+		return body, nil
+	}
+
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "gzip", "x-gzip":
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, newStatusError(http.StatusBadRequest, "invalid gzip body: %s", err)
+			}
+			closers = append(closers, gr)
+			r = gr
+		case "deflate":
+			dr, err := newDeflateReader(r)
+			if err != nil {
+				return nil, newStatusError(http.StatusBadRequest, "invalid deflate body: %s", err)
+			}
+			closers = append(closers, dr)
+			r = dr
+		default:
+			return nil, newStatusError(http.StatusUnsupportedMediaType, "unsupported content encoding: %s", encodings[i])
+		}
+	}
+
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedSize
+	}
+	return &decodedBody{
+		Reader:  &limitReader{r: r, remaining: maxSize},
+		closers: closers,
+	}, nil
+}
+
+// newDeflateReader returns reader for "deflate" content encoding. RFC 7230 says
+// it is zlib format, but some clients send raw deflate stream, so we detect
+// the zlib header and fall back to raw deflate.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// zlib header: compression method 8 and header checksum divisible by 31.
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// decodedBody is the decompressed request body, Close closes all the
+// decompressors and the original body.
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close implements io.Closer.
+func (b *decodedBody) Close() error {
+	var err error
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		if cerr := b.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// limitReader returns 413 error once more than remaining bytes are read.
+type limitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// Read implements io.Reader.
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read at most 1 byte over the limit, so we know it was exceeded.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = -1
+		return n, errBodyTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+var errBodyTooLarge = newStatusError(http.StatusRequestEntityTooLarge, "decompressed body is too large")
+
+// acceptsGzip parses Accept-Encoding header and returns true if gzip
+// is acceptable (it is listed, or "*" is listed) with non-zero quality.
+func acceptsGzip(acceptEncoding string) bool {
+	accepted := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseQuality(part)
+		switch coding {
+		case "gzip", "x-gzip":
+			// Explicit gzip always wins over "*".
+			return q > 0
+		case "*":
+			accepted = q > 0
+		}
+	}
+	return accepted
+}
+
+// parseQuality splits "gzip;q=0.5" into lowercase name and its quality.
+// Quality defaults to 1 when not present or invalid.
+func parseQuality(part string) (string, float64) {
+	var (
+		params = strings.Split(part, ";")
+		name   = strings.ToLower(strings.TrimSpace(params[0]))
+		q      = 1.0
+	)
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				q = v
+			}
+		}
+	}
+	return name, q
+}
+
+// gzipResponseWriter compresses everything written to it. The gzip stream
+// is started lazily on first write, so that handlers returning errors before
+// writing anything produce regular uncompressed error response.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gw *gzip.Writer
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	w.start()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements io.Writer.
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	w.start()
+	return w.gw.Write(b)
+}
+
+// Flush implements http.Flusher, so that streamed responses are not held in
+// the gzip buffer.
+func (w *gzipResponseWriter) Flush() {
+	if w.gw != nil {
+		if err := w.gw.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter, it is used by
+// http.ResponseController.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close flushes the remaining gzip data, does nothing if nothing was written.
+func (w *gzipResponseWriter) Close() error {
+	if w.gw == nil {
+		return nil
+	}
+	return errors.Wrap(w.gw.Close(), "unable to close gzip writer")
+}
+
+func (w *gzipResponseWriter) start() {
+	if w.gw != nil {
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.gw = gzip.NewWriter(w.ResponseWriter)
+}
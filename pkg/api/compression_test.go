@@ -0,0 +1,107 @@
+package api_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipRequestAndResponse(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/streaming", bytes.NewReader(gzipBytes(t, testBody)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "Status code differs")
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"), "response should be gzipped")
+
+	gr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, expectedOutput, string(out), "Response body differs")
+}
+
+func TestDeflateRequest(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write([]byte(testBody)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/v1/streaming", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "deflate")
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "Status code differs")
+	assert.Empty(t, rr.Header().Get("Content-Encoding"), "response should not be compressed")
+	assert.JSONEq(t, expectedOutput, rr.Body.String(), "Response body differs")
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		req, err := http.NewRequest("POST", path, bytes.NewReader(gzipBytes(t, testBody)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", "gzip")
+
+		rr := httptest.NewRecorder()
+		api.NewRouter(api.Config{MaxDecompressedSize: 64}).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, "Status code differs for %s", path)
+	}
+}
+
+func TestUnsupportedContentEncoding(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/streaming", strings.NewReader(testBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "br")
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code, "Status code differs")
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/csv"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	mediaTypeCSV = "text/csv"
+)
+
+func init() {
+	BufferedMediaTypes.RegisterOutput(mediaTypeCSV, encodeCSV)
+	StreamingMediaTypes.RegisterOutput(mediaTypeCSV, encodeCSV)
+}
+
+// csvColumn is a single column of CSV output.
+type csvColumn struct {
+	name  string
+	value func(*Facet) string
+}
+
+// csvColumns are the CSV output columns, facet description followed by count.
+var csvColumns = []csvColumn{
+	{"facet", func(f *Facet) string { return f.Name }},
+	{"path", func(f *Facet) string { return strings.Join(f.Path, "/") }},
+	{"depth", func(f *Facet) string { return strconv.Itoa(f.Depth()) }},
+	{"parent", func(f *Facet) string { return f.Parent() }},
+	{"count", func(f *Facet) string { return f.formatCount() }},
+}
+
+// encodeCSV writes facets as CSV rows in the order of res.Facets.
+// Options:
+//
+//	?header=false (or Accept: text/csv;header=absent) omits the header row.
+//	?delimiter=; sets the field delimiter, "tab" may be used for tab.
+func encodeCSV(w io.Writer, req *http.Request, res *Result) error {
+	header, delimiter, err := csvOptions(req)
+	if err != nil {
+		return err
+	}
+
+	// Series and requested derived metrics follow the count.
+	columns := csvColumns
+	if res.series() {
+		columns = append(columns[:len(columns):len(columns)], csvColumn{"series", func(f *Facet) string {
+			return formatSeries(f.Series)
+		}})
+	}
+	for _, metric := range res.Metrics {
+		value := metricValues[metric]
+		columns = append(columns[:len(columns):len(columns)], csvColumn{metric, func(f *Facet) string {
+			if v := value(f); v != nil {
+				return formatFloat(*v)
+			}
+			return ""
+		}})
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Comma = delimiter
+	row := make([]string, len(columns))
+	if header {
+		for i, column := range columns {
+			row[i] = column.name
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	for i := range res.Facets {
+		for j, column := range columns {
+			row[j] = column.value(&res.Facets[i])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvOptions reads CSV output options from request.
+func csvOptions(req *http.Request) (header bool, delimiter rune, err error) {
+	var (
+		query = req.URL.Query()
+	)
+
+	header = true
+	// RFC 7111 "header" parameter of text/csv media type.
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err == nil && mediaType == mediaTypeCSV && params["header"] == "absent" {
+			header = false
+		}
+	}
+	if v := query.Get("header"); v != "" {
+		header, err = strconv.ParseBool(v)
+		if err != nil {
+			return false, 0, newStatusError(http.StatusBadRequest, "invalid header option %q", v)
+		}
+	}
+
+	delimiter = ','
+	if v := query.Get("delimiter"); v != "" {
+		if v == "tab" {
+			v = "\t"
+		}
+		r, size := utf8.DecodeRuneInString(v)
+		if size != len(v) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+			return false, 0, newStatusError(http.StatusBadRequest, "invalid delimiter %q, must be single character", v)
+		}
+		delimiter = r
+	}
+	return
+}
+
+// formatFloat formats number in the shortest exact representation.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,71 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const expectedCSV = `facet,path,depth,parent,count
+facet1,facet1,1,,100
+facet2,facet2,1,,0
+facet3,facet1/facet3,2,facet1,100
+facet4,facet1/facet3/facet4,3,facet3,50
+facet5,facet1/facet3/facet5,3,facet3,50
+facet6,facet1/facet3/facet4/facet6,4,facet4,20
+facet7,facet1/facet3/facet4/facet7,4,facet4,30
+`
+
+func TestCSVOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		accept   string
+		expected string
+	}{
+		{"accept", "", "text/csv", expectedCSV},
+		{"format", "?format=csv", "application/json", expectedCSV},
+		{"no header", "?format=csv&header=false", "", expectedCSV[strings.Index(expectedCSV, "\n")+1:]},
+		{"header absent", "", "text/csv;header=absent", expectedCSV[strings.Index(expectedCSV, "\n")+1:]},
+		{"semicolon", "?format=csv&delimiter=%3B", "", strings.Replace(expectedCSV, ",", ";", -1)},
+		{"tab", "?format=csv&delimiter=tab", "", strings.Replace(expectedCSV, ",", "\t", -1)},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(testBody))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.accept != "" {
+					req.Header.Set("Accept", tt.accept)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"), "content type differs")
+				assert.Equal(t, tt.expected, rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+func TestCSVInvalidDelimiter(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/streaming?format=csv&delimiter=ab", strings.NewReader(testBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+}
@@ -0,0 +1,432 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/json-iterator/go"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/pkg/errors"
+)
+
+// datasetName matches valid dataset names, they are used as file names.
+var datasetName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,63}$`)
+
+// Delta is an increment of a leaf count, missing facets on the path are
+// created. Facet names of the path are separated by "/".
+type Delta struct {
+	Path  string  `json:"path"`
+	Delta float64 `json:"delta"`
+}
+
+// PatchJSON represents incoming dataset update.
+type PatchJSON struct {
+	Deltas []Delta `json:"deltas"`
+}
+
+// DatasetHandler returns handler of named facet trees kept between requests,
+// persisted in dir (only in memory when dir is empty):
+//
+//	PUT /api/v1/datasets/{name}   replaces the dataset with posted tree, in any input format of /buffered
+//	PATCH /api/v1/datasets/{name} adds leaf deltas: {"deltas": [{"path": "facet1/facet3", "delta": 5}]}
+//	GET /api/v1/datasets/{name}   returns the current rollup
+//
+// All of them respond with the rollup, the output options are the same as
+// of /buffered. Counts of datasets are floats.
+func DatasetHandler(dir string) func(http.ResponseWriter, *http.Request) error {
+	store := newDatasetStore(dir)
+
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		defer closer(req.Body)
+
+		name := mux.Vars(req)["name"]
+		if !datasetName.MatchString(name) {
+			return newStatusError(http.StatusBadRequest, "invalid dataset name %q, must be letters, digits, '_', '-' or '.'", name)
+		}
+		// Datasets keep float counts, deltas are floats.
+		if err := floatNumbers(req.URL.Query(), "datasets"); err != nil {
+			return err
+		}
+		enc, mediaType, err := BufferedMediaTypes.Encoder(req)
+		if err != nil {
+			return err
+		}
+		opts, err := parseOptions(req.URL.Query())
+		if err != nil {
+			return err
+		}
+
+		var (
+			ds     *dataset
+			status = http.StatusOK
+		)
+		switch req.Method {
+		case http.MethodPut:
+			root, err := decodeDataset(req, opts.validator)
+			if err != nil {
+				return err
+			}
+			var created bool
+			if ds, created, err = store.put(name, root); err != nil {
+				return err
+			}
+			if created {
+				status = http.StatusCreated
+			}
+		case http.MethodPatch:
+			patch, err := decodePatch(req)
+			if err != nil {
+				return err
+			}
+			if ds, err = store.get(name); err != nil {
+				return err
+			}
+			if err := ds.patch(patch.Deltas); err != nil {
+				return err
+			}
+		default:
+			if ds, err = store.get(name); err != nil {
+				return err
+			}
+		}
+
+		res, err := opts.page(req, func() ([]Facet, error) {
+			return ds.rollup(), nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// The status is written only once the output is encoded, so that
+		// encoding errors are still returned with their own status.
+		var buf bytes.Buffer
+		if err := enc(&buf, req, &res); err != nil {
+			return err
+		}
+		setNextLink(rw, req, &res)
+		setSkipped(rw, &res)
+		rw.Header().Set("Content-Type", mediaType)
+		rw.WriteHeader(status)
+		_, err = buf.WriteTo(rw)
+		return err
+	}
+}
+
+// decodeDataset parses the tree of PUT request.
+func decodeDataset(req *http.Request, v *Validator) (*Node, error) {
+	dec, err := BufferedMediaTypes.Decoder(req)
+	if err != nil {
+		return nil, err
+	}
+	if dec.Tree == nil {
+		return nil, newStatusError(http.StatusUnsupportedMediaType, "content type is not supported by datasets")
+	}
+	root, err := dec.Tree(req.Body, req.URL.Query(), v)
+	if err == nil {
+		err = v.Err()
+	}
+	if err != nil {
+		return nil, errors.Wrap(badRequest(err), "unable to parse facets")
+	}
+	return root, nil
+}
+
+// decodePatch parses the deltas of PATCH request, only JSON is accepted.
+func decodePatch(req *http.Request) (*PatchJSON, error) {
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != mediaTypeJSON {
+			return nil, newStatusError(http.StatusUnsupportedMediaType, "unsupported content type %q, supported: %s", contentType, mediaTypeJSON)
+		}
+	}
+	var patch PatchJSON
+	if err := jsoniter.NewDecoder(req.Body).Decode(&patch); err != nil {
+		return nil, errors.Wrap(badRequest(err), "unable to parse deltas")
+	}
+	return &patch, nil
+}
+
+// datasetStore keeps the datasets in memory, they are persisted in dir when
+// it is set and loaded from it on first use.
+type datasetStore struct {
+	dir      string
+	mu       sync.Mutex
+	datasets map[string]*dataset
+}
+
+func newDatasetStore(dir string) *datasetStore {
+	return &datasetStore{
+		dir:      dir,
+		datasets: make(map[string]*dataset),
+	}
+}
+
+// get returns dataset of given name, 404 error when it does not exist.
+func (s *datasetStore) get(name string) (*dataset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds, err := s.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if ds == nil {
+		return nil, newStatusError(http.StatusNotFound, "dataset %q not found", name)
+	}
+	return ds, nil
+}
+
+// put replaces the tree of dataset, created is true when it did not exist.
+func (s *datasetStore) put(name string, root *Node) (ds *dataset, created bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ds, err = s.load(name); err != nil {
+		return nil, false, err
+	}
+	if ds == nil {
+		created = true
+		ds = newDataset(&Node{})
+		if s.dir != "" {
+			if ds.log, err = createDatasetLog(s.dir, name); err != nil {
+				return nil, false, err
+			}
+		}
+		s.datasets[name] = ds
+	}
+	if err := ds.replace(root); err != nil {
+		if created {
+			// The dataset was never written, it does not exist.
+			delete(s.datasets, name)
+			if ds.log != nil {
+				if err := ds.log.remove(); err != nil {
+					log.Warn("Unable to remove dataset log", "name", name, "err", err)
+				}
+			}
+		}
+		return nil, false, err
+	}
+	return ds, created, nil
+}
+
+// load returns dataset of given name from memory, or loads it from dir, nil
+// when it does not exist.
+func (s *datasetStore) load(name string) (*dataset, error) {
+	if ds, ok := s.datasets[name]; ok || s.dir == "" {
+		return ds, nil
+	}
+	ds, err := loadDataset(s.dir, name)
+	if err != nil || ds == nil {
+		return nil, err
+	}
+	s.datasets[name] = ds
+	return ds, nil
+}
+
+// dataset is a named facet tree kept between requests, its rollup is updated
+// incrementally by deltas.
+type dataset struct {
+	mu    sync.Mutex
+	root  *Node
+	nodes map[string]*Node // path key -> node
+	// facets is the rollup in document order, nil when it has to be recomputed
+	// (new facets were added), index maps path keys to positions in facets.
+	facets []Facet
+	index  map[string]int
+	// log persists the changes, nil for datasets kept only in memory.
+	log *datasetLog
+}
+
+func newDataset(root *Node) *dataset {
+	ds := &dataset{}
+	ds.reset(root)
+	return ds
+}
+
+// reset replaces the tree of dataset, the rollup is recomputed.
+func (d *dataset) reset(root *Node) {
+	d.root = root
+	d.nodes = make(map[string]*Node)
+	d.facets, d.index = nil, nil
+	var walk func(n *Node, path []string)
+	walk = func(n *Node, path []string) {
+		for _, child := range n.Children {
+			childPath := append(path[:len(path):len(path)], child.Name)
+			d.nodes[pathKey(childPath)] = child
+			walk(child, childPath)
+		}
+	}
+	walk(root, nil)
+}
+
+// replace replaces the tree of dataset, the change is persisted first.
+func (d *dataset) replace(root *Node) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.log != nil {
+		if err := d.log.snapshot(root); err != nil {
+			return err
+		}
+	}
+	d.reset(root)
+	return nil
+}
+
+// patch validates and applies the deltas, either all of them or none. The
+// change is persisted first, failed compaction of the log does not fail the
+// committed change, it is retried with the next one.
+func (d *dataset) patch(deltas []Delta) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.check(deltas); err != nil {
+		return err
+	}
+	if d.log != nil {
+		if err := d.log.append(deltas); err != nil {
+			return err
+		}
+	}
+	d.apply(deltas)
+	if d.log != nil && d.log.full() {
+		if err := d.log.snapshot(d.root); err != nil {
+			log.Error("Unable to compact dataset log", "path", d.log.walPath, "err", err)
+		}
+	}
+	return nil
+}
+
+// check returns ValidationError listing all the invalid deltas: deltas of
+// facets with children or series, paths through leaves and deltas making a
+// leaf count negative.
+func (d *dataset) check(deltas []Delta) error {
+	var (
+		invalid []InvalidLeaf
+		counts  = make(map[string]float64) // leaf path key -> count after the deltas
+		created = make(map[string]bool)    // path key of facets created by the deltas -> leaf
+	)
+	report := func(delta Delta, reason string) {
+		invalid = append(invalid, InvalidLeaf{Path: delta.Path, Value: delta.Delta, Reason: reason})
+	}
+
+	for _, delta := range deltas {
+		path := strings.Split(delta.Path, "/")
+		if contains(path, "") {
+			report(delta, "path contains empty facet name")
+			continue
+		}
+		if math.IsNaN(delta.Delta) || math.IsInf(delta.Delta, 0) {
+			report(delta, "delta is not finite")
+			continue
+		}
+		reason := pathConflict(path, created, func(key string) (leaf, exists bool) {
+			node, ok := d.nodes[key]
+			return ok && len(node.Children) == 0, ok
+		})
+		if node := d.nodes[pathKey(path)]; reason == "" && node != nil && node.Series != nil {
+			reason = "facet has series"
+		}
+		if reason != "" {
+			report(delta, reason)
+			continue
+		}
+		key := pathKey(path)
+		if _, ok := counts[key]; !ok && d.nodes[key] != nil {
+			counts[key] = d.nodes[key].Count
+		}
+		counts[key] += delta.Delta
+	}
+
+	reported := make(map[string]bool)
+	for _, delta := range deltas {
+		key := pathKey(strings.Split(delta.Path, "/"))
+		if count, ok := counts[key]; ok && count < 0 && !reported[key] {
+			reported[key] = true
+			report(delta, "count would be negative")
+		}
+	}
+	if len(invalid) > 0 {
+		return &ValidationError{Leaves: invalid}
+	}
+	return nil
+}
+
+// pathConflict returns the reason why a count can't be added to the leaf at
+// path, empty when it can. facet reports the existing facets, created collects
+// the facets created by the previous deltas of the same request (path key ->
+// leaf) and it is updated.
+func pathConflict(path []string, created map[string]bool, facet func(key string) (leaf, exists bool)) string {
+	for i := range path {
+		key, last := pathKey(path[:i+1]), i == len(path)-1
+		leaf, exists := facet(key)
+		createdLeaf, isCreated := created[key]
+		switch {
+		case exists && !last && leaf:
+			return fmt.Sprintf("facet %q is a leaf", key)
+		case exists && last && !leaf:
+			return "facet has children"
+		case isCreated && createdLeaf != last:
+			return fmt.Sprintf("facet %q would have count and children", key)
+		case !exists:
+			created[key] = last
+		}
+	}
+	return ""
+}
+
+// apply adds the checked deltas, the rollup is updated incrementally unless
+// new facets are created.
+func (d *dataset) apply(deltas []Delta) {
+	for _, delta := range deltas {
+		path := strings.Split(delta.Path, "/")
+		node := d.root
+		for i, name := range path {
+			key := pathKey(path[:i+1])
+			child, ok := d.nodes[key]
+			if !ok {
+				child = &Node{Name: name, Parent: node}
+				node.Children = append(node.Children, child)
+				d.nodes[key] = child
+				d.facets = nil
+			}
+			node = child
+		}
+		node.Count += delta.Delta
+
+		if d.facets == nil {
+			continue
+		}
+		for i := range path {
+			j, ok := d.index[pathKey(path[:i+1])]
+			if !ok {
+				// Facets of duplicate names, recompute.
+				d.facets = nil
+				break
+			}
+			d.facets[j].Count += delta.Delta
+		}
+	}
+}
+
+// rollup returns copy of the facets of dataset.
+func (d *dataset) rollup() []Facet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.facets == nil {
+		d.facets = d.root.Facets()
+		d.index = make(map[string]int, len(d.facets))
+		for i := range d.facets {
+			d.index[pathKey(d.facets[i].Path)] = i
+		}
+	}
+	return append([]Facet(nil), d.facets...)
+}
@@ -0,0 +1,186 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// request sends request with body to path of router.
+func request(t *testing.T, router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// jsonField returns the raw value of top level field of JSON object b.
+func jsonField(t *testing.T, b []byte, field string) string {
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	return string(out[field])
+}
+
+func TestDataset(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+
+	steps := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		code     int
+		expected string
+	}{
+		{"missing", "GET", "segment1", "", http.StatusNotFound, ""},
+		{"create", "PUT", "segment1", testBody, http.StatusCreated, expectedOutput},
+		{"get", "GET", "segment1", "", http.StatusOK, expectedOutput},
+		{
+			"patch", "PATCH", "segment1",
+			`{"deltas": [{"path": "facet1/facet3/facet5", "delta": 5}, {"path": "facet1/facet8", "delta": 1}, {"path": "facet2", "delta": 2}]}`,
+			http.StatusOK,
+			`{"result": [{"facet1": 106}, {"facet2": 2}, {"facet3": 105}, {"facet4": 50}, {"facet5": 55}, {"facet6": 20}, {"facet7": 30}, {"facet8": 1}]}`,
+		},
+		{
+			"patch existing leaves", "PATCH", "segment1?select=facet1/facet3/facet4",
+			`{"deltas": [{"path": "facet1/facet3/facet4/facet6", "delta": -20}, {"path": "facet1/facet3/facet4/facet7", "delta": 0.5}]}`,
+			http.StatusOK,
+			`{"result": [{"facet4": 30.5}, {"facet6": 0}, {"facet7": 30.5}]}`,
+		},
+		{"replace", "PUT", "segment1?select=facet2", `{"data": {"facet2": {"count": 7}}}`, http.StatusOK, `{"result": [{"facet2": 7}]}`},
+		{"other dataset", "GET", "segment2", "", http.StatusNotFound, ""},
+		{"invalid name", "GET", ".segment1", "", http.StatusBadRequest, ""},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			rr := request(t, router, step.method, "/api/v1/datasets/"+step.path, step.body)
+			assert.Equal(t, step.code, rr.Code, "status code differs")
+			if step.expected != "" {
+				assert.JSONEq(t, step.expected, rr.Body.String(), "response body differs")
+			}
+		})
+	}
+}
+
+func TestDatasetInvalidPatch(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	rr := request(t, router, "PUT", "/api/v1/datasets/segment1", testBody)
+	assert.Equal(t, http.StatusCreated, rr.Code, "status code differs")
+
+	rr = request(t, router, "PATCH", "/api/v1/datasets/segment1", `{"deltas": [
+		{"path": "facet1/facet3/facet5", "delta": 1},
+		{"path": "facet1/facet3", "delta": 1},
+		{"path": "facet2/facet9", "delta": 1},
+		{"path": "facet1//facet5", "delta": 1},
+		{"path": "facet5", "delta": -10},
+		{"path": "facet5/facet9", "delta": 1},
+		{"path": "facet1/facet3/facet5", "delta": -60}
+	]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+	assert.JSONEq(t, `[
+		{"path": "facet1/facet3", "value": 1, "reason": "facet has children"},
+		{"path": "facet2/facet9", "value": 1, "reason": "facet \"facet2\" is a leaf"},
+		{"path": "facet1//facet5", "value": 1, "reason": "path contains empty facet name"},
+		{"path": "facet5/facet9", "value": 1, "reason": "facet \"facet5\" would have count and children"},
+		{"path": "facet1/facet3/facet5", "value": 1, "reason": "count would be negative"},
+		{"path": "facet5", "value": -10, "reason": "count would be negative"}
+	]`, jsonField(t, rr.Body.Bytes(), "invalid"), "invalid deltas differ")
+
+	// Nothing was applied.
+	rr = request(t, router, "GET", "/api/v1/datasets/segment1", "")
+	assert.JSONEq(t, expectedOutput, rr.Body.String(), "response body differs")
+}
+
+func TestDatasetInvalidOutput(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+
+	req, err := http.NewRequest("PUT", "/api/v1/datasets/segment1?header=maybe", strings.NewReader(testBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/csv")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+	assert.Contains(t, rr.Body.String(), "invalid header option", "response body differs")
+}
+
+func TestDatasetPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datasets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const expected = `{"result": [{"facet1": 101}, {"facet2": 0}, {"facet3": 101}, {"facet4": 51}, {"facet5": 50}, {"facet6": 21}, {"facet7": 30}]}`
+	router := api.NewRouter(api.Config{DatasetsDir: dir})
+	rr := request(t, router, "PUT", "/api/v1/datasets/segment1", testBody)
+	assert.Equal(t, http.StatusCreated, rr.Code, "status code differs")
+	rr = request(t, router, "PATCH", "/api/v1/datasets/segment1", `{"deltas": [{"path": "facet1/facet3/facet4/facet6", "delta": 1}]}`)
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+
+	// Restarted server reads the snapshot and replays the log.
+	rr = request(t, api.NewRouter(api.Config{DatasetsDir: dir}), "GET", "/api/v1/datasets/segment1", "")
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.JSONEq(t, expected, rr.Body.String(), "response body differs")
+
+	// Interrupted write of the last record is dropped.
+	wal, err := os.OpenFile(filepath.Join(dir, "segment1.wal"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.WriteString(`{"seq": 3, "deltas": [{"path": "fac`); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	router = api.NewRouter(api.Config{DatasetsDir: dir})
+	rr = request(t, router, "GET", "/api/v1/datasets/segment1", "")
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.JSONEq(t, expected, rr.Body.String(), "response body differs")
+	rr = request(t, router, "PATCH", "/api/v1/datasets/segment1", `{"deltas": [{"path": "facet2", "delta": 1}]}`)
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+
+	rr = request(t, api.NewRouter(api.Config{DatasetsDir: dir}), "GET", "/api/v1/datasets/segment1?select=facet2", "")
+	assert.JSONEq(t, `{"result": [{"facet2": 1}]}`, rr.Body.String(), "response body differs")
+}
+
+func TestDatasetFailedCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datasets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The snapshot can't replace a directory.
+	snapshot := filepath.Join(dir, "segment1.json")
+	if err := os.Mkdir(snapshot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	router := api.NewRouter(api.Config{DatasetsDir: dir})
+	rr := request(t, router, "PUT", "/api/v1/datasets/segment1", testBody)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code, "status code differs")
+	_, err = os.Stat(filepath.Join(dir, "segment1.wal"))
+	assert.True(t, os.IsNotExist(err), "log not removed")
+
+	if err := os.Remove(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	rr = request(t, router, "GET", "/api/v1/datasets/segment1", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code, "status code differs")
+}
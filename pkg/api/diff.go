@@ -0,0 +1,276 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeText = "text/plain"
+)
+
+// Facet statuses of FacetDiff.
+const (
+	DiffAdded     = "added"
+	DiffRemoved   = "removed"
+	DiffChanged   = "changed"
+	DiffUnchanged = "unchanged"
+)
+
+// FacetDiff is the change of a single facet between two trees.
+// Relative is the change relative to Before, it is nil when Before is 0.
+type FacetDiff struct {
+	Path             string   `json:"path"`
+	Name             string   `json:"name"`
+	Depth            int      `json:"depth"`
+	Before           float64  `json:"before"`
+	After            float64  `json:"after"`
+	Change           float64  `json:"change"`
+	Relative         *float64 `json:"relative"`
+	Status           string   `json:"status"`
+	StructureChanged bool     `json:"structure_changed"`
+}
+
+// DiffOutputJSON represents outgoing difference of two trees. Facets are in
+// depth-first order (see Diff), Added, Removed and StructureChanged list the
+// paths of such facets.
+type DiffOutputJSON struct {
+	Facets           []FacetDiff `json:"facets"`
+	Added            []string    `json:"added"`
+	Removed          []string    `json:"removed"`
+	StructureChanged []string    `json:"structure_changed"`
+}
+
+// DiffHandler compares two facet documents, sent the same way as to
+// BatchHandler (JSON array or NDJSON of exactly 2 {"data": {...}} objects),
+// the first one is the old one.
+// The output is JSON, or human readable tree with Accept: text/plain
+// (or ?format=plain), siblings are ordered by ?sort= option.
+func DiffHandler(rw http.ResponseWriter, req *http.Request) error {
+	var (
+		trees []*Node
+	)
+	defer closer(req.Body)
+
+	ndjson, err := batchContentType(req)
+	if err != nil {
+		return err
+	}
+	// Documents are read as floats.
+	if err := floatNumbers(req.URL.Query(), "diff"); err != nil {
+		return err
+	}
+	mediaType, err := negotiate(req, []string{mediaTypeJSON, mediaTypeText}, mediaTypeJSON)
+	if err != nil {
+		return err
+	}
+	order, err := parseSort(req.URL.Query().Get("sort"))
+	if err != nil {
+		return err
+	}
+
+	err = decodeBatch(req.Body, ndjson, func(index int, doc batchDocument) error {
+		if doc.err != nil {
+			return doc.err
+		}
+		if index > 1 {
+			return errors.New("diff needs exactly 2 documents")
+		}
+		var root Node
+		if len(doc.Data) > 0 {
+			if err := jsoniter.Unmarshal(doc.Data, &root); err != nil {
+				return errors.Wrapf(err, "error parsing document %d", index)
+			}
+		}
+		trees = append(trees, &root)
+		return nil
+	})
+	if err == nil && len(trees) != 2 {
+		err = errors.New("diff needs exactly 2 documents")
+	}
+	if err != nil {
+		return errors.Wrap(badRequest(err), "unable to parse documents")
+	}
+
+	out := Diff(trees[0], trees[1], order)
+	rw.Header().Set("Content-Type", mediaType)
+	if mediaType == mediaTypeText {
+		return WriteDiffTree(rw, out)
+	}
+	return jsoniter.NewEncoder(rw).Encode(out)
+}
+
+// Diff compares facets of before and after trees by their paths. Facets are
+// in depth-first order, siblings are ordered by given sort order, counts
+// are compared by the after counts and document order is the order of before
+// followed by the added facets.
+func Diff(before, after *Node, order string) *DiffOutputJSON {
+	out := &DiffOutputJSON{
+		Facets:           []FacetDiff{},
+		Added:            []string{},
+		Removed:          []string{},
+		StructureChanged: []string{},
+	}
+	diffChildren(before, after, nil, order, out)
+	return out
+}
+
+// diffChildren compares children of before and after nodes, either of them
+// may be nil when the facet does not exist in that tree.
+func diffChildren(before, after *Node, path []string, order string, out *DiffOutputJSON) {
+	var (
+		beforeChildren = childrenByName(before)
+		afterChildren  = childrenByName(after)
+		names          []string
+		diffs          = make(map[string]*FacetDiff)
+	)
+	// Document order, names of before followed by the added ones.
+	for _, tree := range []*Node{before, after} {
+		if tree == nil {
+			continue
+		}
+		for _, child := range tree.Children {
+			if _, ok := diffs[child.Name]; !ok {
+				diffs[child.Name] = nil
+				names = append(names, child.Name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		var (
+			b, a      = beforeChildren[name], afterChildren[name]
+			childPath = append(path[:len(path):len(path)], name)
+			d         = &FacetDiff{
+				Path:  strings.Join(childPath, "/"),
+				Name:  name,
+				Depth: len(childPath),
+			}
+		)
+		if b != nil {
+			d.Before = b.SumChildren()
+		}
+		if a != nil {
+			d.After = a.SumChildren()
+		}
+		d.Change = d.After - d.Before
+		if d.Before != 0 {
+			relative := d.Change / d.Before
+			d.Relative = &relative
+		}
+
+		switch {
+		case b == nil:
+			d.Status = DiffAdded
+		case a == nil:
+			d.Status = DiffRemoved
+		case d.Change != 0:
+			d.Status = DiffChanged
+		default:
+			d.Status = DiffUnchanged
+		}
+		if b != nil && a != nil && (len(b.Children) == 0) != (len(a.Children) == 0) {
+			d.StructureChanged = true
+		}
+		diffs[name] = d
+	}
+
+	sort.SliceStable(names, func(i, j int) bool {
+		x, y := diffs[names[i]], diffs[names[j]]
+		switch order {
+		case SortDocument:
+			return false
+		case SortCountDesc, SortCountAsc:
+			if x.After != y.After {
+				return (x.After > y.After) == (order == SortCountDesc)
+			}
+			if x.Before != y.Before {
+				return (x.Before > y.Before) == (order == SortCountDesc)
+			}
+			return naturalLess(x.Name, y.Name)
+		case SortNatural, SortTree:
+			return naturalLess(x.Name, y.Name)
+		}
+		return x.Name < y.Name
+	})
+
+	for _, name := range names {
+		d := diffs[name]
+		switch {
+		case d.Status == DiffAdded:
+			out.Added = append(out.Added, d.Path)
+		case d.Status == DiffRemoved:
+			out.Removed = append(out.Removed, d.Path)
+		case d.StructureChanged:
+			out.StructureChanged = append(out.StructureChanged, d.Path)
+		}
+		out.Facets = append(out.Facets, *d)
+		diffChildren(beforeChildren[name], afterChildren[name], append(path[:len(path):len(path)], name), order, out)
+	}
+}
+
+// childrenByName returns map of node's children, empty for nil node.
+func childrenByName(n *Node) map[string]*Node {
+	children := make(map[string]*Node)
+	if n == nil {
+		return children
+	}
+	for _, child := range n.Children {
+		children[child.Name] = child
+	}
+	return children
+}
+
+// WriteDiffTree writes the difference as human readable indented tree. Lines
+// of added facets start with "+", removed with "-" and facets with changed
+// structure with "~":
+//
+//	  facet1: 100 -> 120 (+20, +20.0%)
+//	+   facet8: 0 -> 20 (+20)
+func WriteDiffTree(w io.Writer, diff *DiffOutputJSON) error {
+	bw := bufio.NewWriter(w)
+	for _, d := range diff.Facets {
+		marker := " "
+		switch {
+		case d.Status == DiffAdded:
+			marker = "+"
+		case d.Status == DiffRemoved:
+			marker = "-"
+		case d.StructureChanged:
+			marker = "~"
+		}
+
+		change := ""
+		if d.Change != 0 {
+			change = fmt.Sprintf(" (%s%s", sign(d.Change), formatFloat(d.Change))
+			if d.Relative != nil {
+				change += fmt.Sprintf(", %s%.1f%%", sign(*d.Relative), *d.Relative*100)
+			}
+			change += ")"
+		}
+		_, err := fmt.Fprintf(
+			bw, "%s %s%s: %s -> %s%s\n",
+			marker, strings.Repeat("  ", d.Depth-1), d.Name, formatFloat(d.Before), formatFloat(d.After), change,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// sign returns "+" for positive numbers, negative numbers are already
+// formatted with "-".
+func sign(f float64) string {
+	if f > 0 {
+		return "+"
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDiffBody = `[
+	{"data": {"facet1": {"facet3": {"count": 10}, "facet4": {"count": 10}}, "facet2": {"count": 0}, "facet5": {"count": 5}}},
+	{"data": {"facet1": {"facet3": {"count": 15}, "facet4": {"facet6": {"count": 10}}}, "facet2": {"count": 3}, "facet7": {"count": 1}}}
+]`
+
+func TestDiff(t *testing.T) {
+	var before, after api.Node
+	err := json.Unmarshal([]byte(`{"facet1": {"facet3": {"count": 10}}, "facet2": {"count": 5}}`), &before)
+	assert.NoError(t, err, "unmarshal should not return error")
+	err = json.Unmarshal([]byte(`{"facet1": {"facet3": {"count": 15}}, "facet4": {"count": 1}}`), &after)
+	assert.NoError(t, err, "unmarshal should not return error")
+
+	diff := api.Diff(&before, &after, api.SortName)
+
+	assert.Equal(t, []string{"facet4"}, diff.Added, "added facets differ")
+	assert.Equal(t, []string{"facet2"}, diff.Removed, "removed facets differ")
+	if assert.Equal(t, 4, len(diff.Facets), "incorrect number of facets") {
+		facet3 := diff.Facets[1]
+		assert.Equal(t, "facet1/facet3", facet3.Path, "facet path differs")
+		assert.Equal(t, float64(5), facet3.Change, "facet change differs")
+		assert.Equal(t, 0.5, *facet3.Relative, "facet relative change differs")
+		assert.Equal(t, api.DiffChanged, facet3.Status, "facet status differs")
+		assert.Nil(t, diff.Facets[3].Relative, "relative change of added facet should be nil")
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/diff", strings.NewReader(testDiffBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+
+	var out api.DiffOutputJSON
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"facet1/facet4/facet6", "facet7"}, out.Added, "added facets differ")
+	assert.Equal(t, []string{"facet5"}, out.Removed, "removed facets differ")
+	assert.Equal(t, []string{"facet1/facet4"}, out.StructureChanged, "changed structure differs")
+}
+
+func TestDiffHandlerTree(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/diff?format=plain", strings.NewReader(testDiffBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, "text/plain", rr.Header().Get("Content-Type"), "content type differs")
+	assert.Equal(t, `  facet1: 20 -> 25 (+5, +25.0%)
+    facet3: 10 -> 15 (+5, +50.0%)
+~   facet4: 10 -> 10
++     facet6: 0 -> 10 (+10)
+  facet2: 0 -> 3 (+3)
+- facet5: 5 -> 0 (-5, -100.0%)
++ facet7: 0 -> 1 (+1)
+`, rr.Body.String(), "response body differs")
+}
+
+func TestDiffHandlerDocumentCount(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/diff", strings.NewReader(`[{"data": {}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+
+	"github.com/json-iterator/go"
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	mediaTypeYAML = "application/yaml"
+	mediaTypeTOML = "application/toml"
+)
+
+func init() {
+	decoders := map[string]Decoder{
+		mediaTypeYAML:        {Tree: unmarshalYAML},
+		"application/x-yaml": {Tree: unmarshalYAML},
+		mediaTypeTOML:        {Tree: unmarshalTOML},
+	}
+	for mediaType, dec := range decoders {
+		BufferedMediaTypes.RegisterInput(mediaType, dec)
+		StreamingMediaTypes.RegisterInput(mediaType, dec)
+	}
+}
+
+// unmarshalYAML parses YAML document with the same structure as the JSON input:
+//
+//	data:
+//	  facet1:
+//	    count: 10
+func unmarshalYAML(r io.Reader, _ url.Values, v *Validator) (*Node, error) {
+	var doc yaml.MapSlice
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read yaml body")
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, errors.Wrap(err, "unable to parse yaml")
+	}
+	return documentToTree(normalizeDocument(doc).(documentObject), v)
+}
+
+// unmarshalTOML parses TOML document with the same structure as the JSON input:
+//
+//	[data.facet1]
+//	count = 10
+func unmarshalTOML(r io.Reader, _ url.Values, v *Validator) (*Node, error) {
+	tree, err := toml.LoadReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse toml")
+	}
+	return documentToTree(normalizeDocument(tree).(documentObject), v)
+}
+
+// documentToTree builds the node tree from the "data" key of decoded
+// document, just like the JSON input is read, v validates the leaves.
+func documentToTree(doc documentObject, v *Validator) (*Node, error) {
+	return treeReader{v: v}.document(&valueSource{value: doc})
+}
+
+// documentObject is decoded object of the input document, its members are in
+// the document order.
+type documentObject []documentMember
+
+// documentMember is one key of documentObject with its value.
+type documentMember struct {
+	Key   string
+	Value interface{}
+}
+
+// valueSource reads decoded document, objects are documentObject, arrays are
+// []interface{} and numbers are float64, just like the JSON input is read.
+type valueSource struct {
+	// value is the next value.
+	value interface{}
+}
+
+func (s *valueSource) next() jsoniter.ValueType {
+	switch s.value.(type) {
+	case documentObject:
+		return jsoniter.ObjectValue
+	case []interface{}:
+		return jsoniter.ArrayValue
+	case float64:
+		return jsoniter.NumberValue
+	case string:
+		return jsoniter.StringValue
+	case bool:
+		return jsoniter.BoolValue
+	case nil:
+		return jsoniter.NilValue
+	}
+	return jsoniter.InvalidValue
+}
+
+func (s *valueSource) object(fn func(key string)) {
+	object, _ := s.value.(documentObject)
+	for _, member := range object {
+		s.value = member.Value
+		fn(member.Key)
+	}
+}
+
+func (s *valueSource) array(fn func()) {
+	array, _ := s.value.([]interface{})
+	for _, element := range array {
+		s.value = element
+		fn()
+	}
+}
+
+func (s *valueSource) float() float64 {
+	f, _ := s.value.(float64)
+	return f
+}
+
+func (s *valueSource) number() interface{} { return s.value }
+func (s *valueSource) read() interface{}   { return s.value }
+func (s *valueSource) skip()               {}
+
+// normalizeDocument converts values produced by YAML and TOML parsers and
+// maps into the types read by valueSource, so that all the formats are read
+// the same way. Members of YAML and TOML objects are kept in the document
+// order, keys of maps are sorted.
+func normalizeDocument(v interface{}) interface{} {
+	switch t := v.(type) {
+	case yaml.MapSlice:
+		object := make(documentObject, len(t))
+		for i, item := range t {
+			// YAML keys may be numbers, facet names are always strings.
+			object[i] = documentMember{Key: fmt.Sprint(item.Key), Value: normalizeDocument(item.Value)}
+		}
+		return object
+	case *toml.Tree:
+		keys := t.Keys()
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := t.GetPositionPath([]string{keys[i]}), t.GetPositionPath([]string{keys[j]})
+			if a.Line != b.Line {
+				return a.Line < b.Line
+			}
+			if a.Col != b.Col {
+				return a.Col < b.Col
+			}
+			return keys[i] < keys[j]
+		})
+		object := make(documentObject, len(keys))
+		for i, key := range keys {
+			object[i] = documentMember{Key: key, Value: normalizeDocument(t.GetPath([]string{key}))}
+		}
+		return object
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		object := make(documentObject, len(keys))
+		for i, key := range keys {
+			object[i] = documentMember{Key: key, Value: normalizeDocument(t[key])}
+		}
+		return object
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, value := range t {
+			s[i] = normalizeDocument(value)
+		}
+		return s
+	case []*toml.Tree:
+		// TOML arrays of tables.
+		s := make([]interface{}, len(t))
+		for i, value := range t {
+			s[i] = normalizeDocument(value)
+		}
+		return s
+	case int:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	}
+	return v
+}
@@ -0,0 +1,100 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testYAML = `
+data:
+  facet1:
+    facet3:
+      facet4:
+        facet6:
+          count: 20
+        facet7:
+          count: 30
+      facet5:
+        count: 50
+  facet2:
+    count: 0
+`
+
+	testTOML = `
+[data.facet1.facet3.facet4.facet6]
+count = 20
+
+[data.facet1.facet3.facet4.facet7]
+count = 30.0
+
+[data.facet1.facet3.facet5]
+count = 50
+
+[data.facet2]
+count = 0
+`
+)
+
+func TestDocumentInput(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{"application/yaml", testYAML},
+		{"application/toml", testTOML},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.contentType, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", tt.contentType)
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				assert.JSONEq(t, expectedOutput, rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+// TestDocumentInputInvalidCount tests that all document formats report
+// invalid counts the same way.
+func TestDocumentInputInvalidCount(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json", `{"data": {"facet1": {"count": "abc"}}}`},
+		{"application/yaml", "data:\n  facet1:\n    count: abc\n"},
+		{"application/toml", "[data.facet1]\ncount = \"abc\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/v1/buffered", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+			assert.Contains(t, rr.Body.String(), "count value is invalid type", "error message differs")
+		})
+	}
+}
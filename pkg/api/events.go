@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeEventStream = "text/event-stream"
+
+	defaultProgressInterval = time.Second
+	minProgressInterval     = 10 * time.Millisecond
+)
+
+func init() {
+	StreamingMediaTypes.RegisterOutput(mediaTypeEventStream, encodeResultEvent)
+}
+
+// ProgressJSON represents progress event of streamed aggregation.
+type ProgressJSON struct {
+	Bytes int64 `json:"bytes"`
+	Nodes int64 `json:"nodes"`
+	Depth int64 `json:"depth"`
+	// Totals are the partial counts of the top level facets.
+	Totals map[string]float64 `json:"totals"`
+}
+
+// encodeResultEvent writes the result as the final "result" event.
+func encodeResultEvent(w io.Writer, req *http.Request, res *Result) error {
+	return writeEvent(w, "result", outputJSON(res))
+}
+
+// streamEvents aggregates the request body like StreamingChallengeHandler,
+// but responds with Server-Sent Events: "progress" events every
+// ?progress_interval= while the body is parsed, followed by the "result"
+// event, or the "error" event when the aggregation fails.
+func streamEvents(rw http.ResponseWriter, req *http.Request, dec Decoder, enc Encoder, opts Options) error {
+	interval := defaultProgressInterval
+	if v := req.URL.Query().Get("progress_interval"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil || interval < minProgressInterval {
+			return newStatusError(http.StatusBadRequest, "invalid progress_interval option %q, must be duration of at least %s", v, minProgressInterval)
+		}
+	}
+
+	// The events are written while the body is read, which HTTP/1.1 server
+	// allows only in full duplex mode. The upload is bounded by the server
+	// read timeout as usual, the write deadline is cleared as the response
+	// lasts as long as the upload.
+	rc := http.NewResponseController(rw)
+	if err := rc.EnableFullDuplex(); err != nil {
+		log.Warn("Unable to enable full duplex for event stream", "err", err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Warn("Unable to clear write deadline of event stream", "err", err)
+	}
+	rw.Header().Set("Content-Type", mediaTypeEventStream)
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+
+	var (
+		p    = &progress{}
+		body = newProgressReader(req.Context(), req.Body, p)
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := writeEvent(rw, "progress", p.json()); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	res, err := opts.page(req, func() ([]Facet, error) {
+		return dec.facets(body, req.URL.Query(), opts)
+	})
+	close(stop)
+	<-done
+	if writeErr := writeEvent(rw, "progress", p.json()); writeErr != nil {
+		return nil
+	}
+	if err != nil {
+		if writeErr := writeEvent(rw, "error", newErrJSON(err)); writeErr != nil {
+			log.Error("Error writing error event", "err", writeErr)
+		}
+		return nil
+	}
+	return enc(rw, req, &res)
+}
+
+// writeEvent writes Server-Sent Event of given type with JSON data and
+// flushes it to the client.
+func writeEvent(w io.Writer, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "unable to write event")
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
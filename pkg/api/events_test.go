@@ -0,0 +1,138 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	event string
+	data  string
+}
+
+// parseEvents returns the Server-Sent Events of body.
+func parseEvents(t *testing.T, body string) []sseEvent {
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var e sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				e.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			default:
+				t.Fatalf("invalid event line %q", line)
+			}
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// streamEvents posts body to the streaming endpoint of a server and returns
+// the response with its body read. The server is real, as HTTP/1.1 server
+// differs from the recorder in reading the body after response is flushed.
+func streamEvents(t *testing.T, query string, body io.Reader) (*http.Response, string) {
+	srv := httptest.NewServer(api.NewRouter(api.Config{}))
+	defer srv.Close()
+	req, err := http.NewRequest("POST", srv.URL+"/api/v1/streaming"+query, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestStreamingEvents(t *testing.T) {
+	for _, query := range []string{"", "?format=event-stream"} {
+		resp, body := streamEvents(t, query, strings.NewReader(testBody))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "status code differs")
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"), "content type differs")
+
+		events := parseEvents(t, body)
+		if !assert.True(t, len(events) >= 2, "events missing") {
+			continue
+		}
+		last := events[len(events)-1]
+		assert.Equal(t, "result", last.event, "last event differs")
+		assert.JSONEq(t, expectedOutput, last.data, "result differs")
+
+		progress := events[len(events)-2]
+		assert.Equal(t, "progress", progress.event, "event differs")
+		var p api.ProgressJSON
+		if err := json.Unmarshal([]byte(progress.data), &p); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, api.ProgressJSON{
+			Bytes:  int64(len(testBody)),
+			Nodes:  7,
+			Totals: map[string]float64{"facet1": 100, "facet2": 0},
+		}, p, "final progress differs")
+	}
+}
+
+func TestStreamingEventsPartial(t *testing.T) {
+	r, w := io.Pipe()
+	go func() {
+		io.WriteString(w, `{"data": {"facet1": {"facet3": {"count": 1}, `)
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, `"facet4": {"count": 2}}, `)
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, `"facet2": {"count": 2}}}`)
+		w.Close()
+	}()
+
+	resp, body := streamEvents(t, "?progress_interval=10ms", r)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "status code differs")
+	var partial bool
+	events := parseEvents(t, body)
+	for _, e := range events {
+		var p api.ProgressJSON
+		if e.event != "progress" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(e.data), &p); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := p.Totals["facet2"]; p.Totals["facet1"] == 1 && !ok {
+			// facet1 is open while the rest of the body is not sent.
+			assert.Equal(t, int64(1), p.Depth, "depth differs")
+			partial = true
+		}
+	}
+	assert.True(t, partial, "no progress event while parsing")
+	assert.Equal(t, "result", events[len(events)-1].event, "last event differs: %s", events[len(events)-1].data)
+}
+
+func TestStreamingEventsErrors(t *testing.T) {
+	resp, _ := streamEvents(t, "?progress_interval=1ms", strings.NewReader(testBody))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "status code differs")
+
+	// The error of aggregation is sent as the last event.
+	resp, body := streamEvents(t, "", strings.NewReader(`{"data": {"facet1": {"count": "x"}}}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "status code differs")
+	events := parseEvents(t, body)
+	last := events[len(events)-1]
+	assert.Equal(t, "error", last.event, "last event differs")
+	assert.Equal(t, "400", jsonField(t, []byte(last.data), "status_code"), "status code differs")
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Numbers modes, selected by ?numbers= option.
+const (
+	// NumbersFloat reads counts as float64 numbers (the default).
+	NumbersFloat = "float"
+	// NumbersExact reads counts as arbitrary-precision integers and decimals,
+	// the sums keep all their digits.
+	NumbersExact = "exact"
+)
+
+// exactNumbers returns true when request asks for exact numbers mode
+// (?numbers=exact).
+func exactNumbers(params url.Values) (bool, error) {
+	switch v := params.Get("numbers"); v {
+	case "", NumbersFloat:
+		return false, nil
+	case NumbersExact:
+		return true, nil
+	default:
+		return false, newStatusError(http.StatusBadRequest, "unknown numbers %q, supported: %s, %s", v, NumbersFloat, NumbersExact)
+	}
+}
+
+// floatNumbers returns 400 error when params ask for exact numbers mode and
+// what only supports floats, so that the counts are not silently rounded.
+func floatNumbers(params url.Values, what string) error {
+	exact, err := exactNumbers(params)
+	if err == nil && exact {
+		err = newStatusError(http.StatusBadRequest, "exact numbers are not supported by %s, use ?numbers=%s", what, NumbersFloat)
+	}
+	return err
+}
+
+// exactByDefault makes the exact numbers mode the default of requests which
+// do not set ?numbers= themselves and whose input is read exactly by the
+// decoder of types, other requests keep float numbers.
+func exactByDefault(types *MediaTypes, next handler) handler {
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		query := req.URL.Query()
+		if query.Get("numbers") == "" && !isFlat(query) {
+			if dec, err := types.Decoder(req); err != nil || !dec.Exact {
+				// The handler reports unsupported content types.
+				return next(rw, req)
+			}
+			query.Set("numbers", NumbersExact)
+			req = req.Clone(req.Context())
+			req.URL.RawQuery = query.Encode()
+		}
+		return next(rw, req)
+	}
+}
+
+const (
+	// maxExactExponent limits the exponent of exact numbers, 1e1000000000
+	// would need gigabytes of digits.
+	maxExactExponent = 1000
+	// maxExactLength limits the length of exact number literals, so that
+	// their sums can be formatted with all the digits cheaply.
+	maxExactLength = 1000
+)
+
+// parseExact parses JSON number literal without losing precision.
+func parseExact(number json.Number) (*big.Rat, error) {
+	s := string(number)
+	if len(s) > maxExactLength {
+		return nil, newStatusError(http.StatusBadRequest, "number %.20s... is longer than %d characters of exact numbers", number, maxExactLength)
+	}
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exp, err := strconv.Atoi(strings.TrimPrefix(s[i+1:], "+"))
+		if err != nil || exp > maxExactExponent || exp < -maxExactExponent {
+			return nil, newStatusError(http.StatusBadRequest, "number %q is out of range of exact numbers", number)
+		}
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, newStatusError(http.StatusBadRequest, "invalid number %q", number)
+	}
+	return r, nil
+}
+
+// addExact returns the sum of a and b, nil values are missing, not zeros.
+// The arguments are not modified.
+func addExact(a, b *big.Rat) *big.Rat {
+	switch {
+	case a == nil && b == nil:
+		return nil
+	case a == nil:
+		return new(big.Rat).Set(b)
+	case b == nil:
+		return new(big.Rat).Set(a)
+	}
+	return new(big.Rat).Add(a, b)
+}
+
+// formatExact formats the number as JSON number literal with all its
+// digits. Sums of decimal numbers always have finite decimal representation.
+func formatExact(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	// The denominator of a decimal is 2^a * 5^b, it needs max(a, b) decimal
+	// places.
+	var (
+		denom  = new(big.Int).Set(r.Denom())
+		twos   = int(denom.TrailingZeroBits())
+		fives  int
+		five   = big.NewInt(5)
+		quo    = new(big.Int)
+		rem    = new(big.Int)
+		places = twos
+	)
+	denom.Rsh(denom, uint(twos))
+	for {
+		quo.QuoRem(denom, five, rem)
+		if rem.Sign() != 0 {
+			break
+		}
+		denom, quo = quo, denom
+		fives++
+	}
+	if fives > places {
+		places = fives
+	}
+	return r.FloatString(places)
+}
+
+// countValue returns the count of facet for JSON output, exact count is
+// written as a number literal with all its digits.
+func (f *Facet) countValue() interface{} {
+	if f.Exact != nil {
+		return json.Number(formatExact(f.Exact))
+	}
+	return f.Count
+}
+
+// formatCount formats the count of facet for text outputs.
+func (f *Facet) formatCount() string {
+	if f.Exact != nil {
+		return formatExact(f.Exact)
+	}
+	return formatFloat(f.Count)
+}
@@ -0,0 +1,159 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const exactBody = `{"data": {
+	"big": {"a": {"count": 9007199254740993}, "b": {"count": 1}},
+	"decimal": {"c": {"count": 0.1}, "d": {"count": 0.2}},
+	"exponent": {"count": 1.5e2}
+}}`
+
+func TestExactNumbers(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     api.Config
+		query    string
+		expected string
+	}{
+		{"exact", api.Config{}, "?numbers=exact", `{"result":[{"a":9007199254740993},{"b":1},{"big":9007199254740994},{"c":0.1},{"d":0.2},{"decimal":0.3},{"exponent":150}]}`},
+		{"float", api.Config{}, "", `{"result":[{"a":9007199254740992},{"b":1},{"big":9007199254740992},{"c":0.1},{"d":0.2},{"decimal":0.30000000000000004},{"exponent":150}]}`},
+		{"exact by default", api.Config{ExactNumbers: true}, "", `{"result":[{"a":9007199254740993},{"b":1},{"big":9007199254740994},{"c":0.1},{"d":0.2},{"decimal":0.3},{"exponent":150}]}`},
+		{"float override", api.Config{ExactNumbers: true}, "?numbers=float", `{"result":[{"a":9007199254740992},{"b":1},{"big":9007199254740992},{"c":0.1},{"d":0.2},{"decimal":0.30000000000000004},{"exponent":150}]}`},
+		{"sorted", api.Config{}, "?numbers=exact&sort=count_desc&select=big", `{"result":[{"big":9007199254740994},{"a":9007199254740993},{"b":1}]}`},
+		{"other", api.Config{}, "?numbers=exact&top=1&other=true&select=decimal", `{"result":[{"d":0.2},{"decimal":0.3},{"decimal/other":0.1}]}`},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(exactBody))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(tt.conf).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				// JSONEq would compare the numbers as floats.
+				assert.Equal(t, tt.expected, strings.TrimSpace(rr.Body.String()), "response body differs")
+			})
+		}
+	}
+}
+
+func TestExactNumbersCSV(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/streaming?numbers=exact&format=csv&select=decimal", strings.NewReader(exactBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, `facet,path,depth,parent,count
+c,decimal/c,2,decimal,0.1
+d,decimal/d,2,decimal,0.2
+decimal,decimal,1,,0.3
+`, rr.Body.String(), "response body differs")
+}
+
+func TestExactNumbersPlaces(t *testing.T) {
+	body := `{"data": {"a": {"count": 1e-40}, "b": {"count": 0.125}, "c": {"count": 0.` + strings.Repeat("3", 900) + `}}}`
+	req, err := http.NewRequest("POST", "/api/v1/streaming?numbers=exact", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, `{"result":[{"a":0.`+strings.Repeat("0", 39)+`1},{"b":0.125},{"c":0.`+strings.Repeat("3", 900)+`}]}`, strings.TrimSpace(rr.Body.String()), "response body differs")
+}
+
+func TestExactNumbersInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		body  string
+	}{
+		{"unknown mode", "?numbers=decimal", exactBody},
+		{"huge exponent", "?numbers=exact", `{"data": {"a": {"count": 1e1000000000}}}`},
+		{"long number", "?numbers=exact", `{"data": {"a": {"count": 0.` + strings.Repeat("1", 1000) + `}}}`},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+			})
+		}
+	}
+}
+
+func TestExactNumbersUnsupported(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        api.Config
+		method      string
+		path        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"csv", api.Config{}, "POST", "/api/v1/streaming?numbers=exact", "text/csv", "facet1,1\n", http.StatusBadRequest},
+		{"yaml", api.Config{}, "POST", "/api/v1/buffered?numbers=exact", "application/yaml", "data: {}\n", http.StatusBadRequest},
+		{"yaml by default", api.Config{ExactNumbers: true}, "POST", "/api/v1/buffered", "application/yaml", "data: {}\n", http.StatusOK},
+		{"buffered flat", api.Config{}, "POST", "/api/v1/buffered?numbers=exact&layout=flat", "", `{"facet1": 1}`, http.StatusBadRequest},
+		{"streaming flat", api.Config{}, "POST", "/api/v1/streaming?numbers=exact&layout=flat", "", `{"facet1": 1}`, http.StatusBadRequest},
+		{"flat by default", api.Config{ExactNumbers: true}, "POST", "/api/v1/streaming?layout=flat", "", `{"facet1": 1}`, http.StatusOK},
+		{"batch", api.Config{}, "POST", "/api/v1/batch?numbers=exact", "", `[{"data": {}}]`, http.StatusBadRequest},
+		{"batch by default", api.Config{ExactNumbers: true}, "POST", "/api/v1/batch", "", `[{"data": {}}]`, http.StatusOK},
+		{"merge", api.Config{}, "POST", "/api/v1/merge?numbers=exact", "", `[{"data": {}}]`, http.StatusBadRequest},
+		{"diff", api.Config{}, "POST", "/api/v1/diff?numbers=exact", "", `[{"data": {}}, {"data": {}}]`, http.StatusBadRequest},
+		{"diff by default", api.Config{ExactNumbers: true}, "POST", "/api/v1/diff", "", `[{"data": {}}, {"data": {}}]`, http.StatusOK},
+		{"dataset", api.Config{}, "PUT", "/api/v1/datasets/segment1?numbers=exact", "", exactBody, http.StatusBadRequest},
+		{"dataset by default", api.Config{ExactNumbers: true}, "PUT", "/api/v1/datasets/segment1", "", exactBody, http.StatusCreated},
+		{"window", api.Config{}, "GET", "/api/v1/windows/counter1?numbers=exact", "", "", http.StatusBadRequest},
+		{"window by default", api.Config{ExactNumbers: true}, "GET", "/api/v1/windows/counter1", "", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(tt.conf).ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code, "status code differs")
+			if tt.code == http.StatusBadRequest {
+				assert.Contains(t, rr.Body.String(), "exact numbers are not supported", "response body differs")
+			}
+		})
+	}
+}
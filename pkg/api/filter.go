@@ -0,0 +1,125 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+)
+
+// otherFacet is the last name of the path of the facet which sums the
+// facets dropped by filters when Options.Other is set, the facet is named by
+// its path (e.g. "facet1/other"), so that facets of different parents can be
+// told apart.
+const otherFacet = "other"
+
+// filter drops facets according to the options. Facets are dropped together
+// with all their descendants, so the kept facets still form a tree. Input
+// with a facet of the same path as an added "other" facet is rejected.
+func (o Options) filter(facets []Facet) ([]Facet, error) {
+	if o.Top <= 0 && o.MinCount == nil && o.MinShare == nil && o.MaxDepth <= 0 {
+		return facets, nil
+	}
+
+	var (
+		levels  [][]*Facet                              // facets by depth
+		counts  = make(map[string]float64, len(facets)) // path key -> count
+		dropped = make(map[string]bool)                 // path keys of dropped facets
+		others  = make(map[string]*Facet)               // parent path key -> sum of its dropped children
+		total   float64
+	)
+	for i := range facets {
+		f := &facets[i]
+		for len(levels) < f.Depth() {
+			levels = append(levels, nil)
+		}
+		levels[f.Depth()-1] = append(levels[f.Depth()-1], f)
+		counts[pathKey(f.Path)] = f.Count
+	}
+	for i := range facets {
+		// Roots of selected subtrees are top level facets as well.
+		if _, ok := counts[facets[i].parentKey()]; !ok {
+			total += facets[i].Count
+		}
+	}
+
+	// fold drops the facet and adds its count to the "other" facet of its parent.
+	fold := func(f *Facet) {
+		dropped[pathKey(f.Path)] = true
+		if !o.Other {
+			return
+		}
+		other, ok := others[f.parentKey()]
+		if !ok {
+			path := append(append([]string(nil), f.Path[:len(f.Path)-1]...), otherFacet)
+			other = &Facet{Name: pathKey(path), Path: path}
+			others[f.parentKey()] = other
+		}
+		other.Count += f.Count
+		if f.Exact != nil {
+			other.Exact = addExact(other.Exact, f.Exact)
+		}
+		if f.Series != nil {
+			other.Series = addSeries(other.Series, f.Series)
+		}
+	}
+
+	// Parents are always decided before their children.
+	for depth, level := range levels {
+		siblings := make(map[string][]*Facet) // parent path key -> kept children
+		for _, f := range level {
+			parent := f.parentKey()
+			parentCount, ok := counts[parent]
+			if !ok {
+				parentCount = total
+			}
+			switch {
+			case dropped[parent]:
+				// Counted in the dropped ancestor already.
+				dropped[pathKey(f.Path)] = true
+			case o.MaxDepth > 0 && depth+1 > o.MaxDepth:
+				// Parent's count contains this facet, totals still add up.
+				dropped[pathKey(f.Path)] = true
+			case o.MinCount != nil && f.Count < *o.MinCount:
+				fold(f)
+			case o.MinShare != nil && parentCount != 0 && f.Count/parentCount < *o.MinShare:
+				fold(f)
+			default:
+				siblings[parent] = append(siblings[parent], f)
+			}
+		}
+
+		// Keep only the top N of the remaining children of every facet.
+		if o.Top <= 0 {
+			continue
+		}
+		for _, children := range siblings {
+			if len(children) <= o.Top {
+				continue
+			}
+			sort.SliceStable(children, func(i, j int) bool {
+				if children[i].Count != children[j].Count {
+					return children[i].Count > children[j].Count
+				}
+				return children[i].Name < children[j].Name
+			})
+			for _, f := range children[o.Top:] {
+				fold(f)
+			}
+		}
+	}
+
+	for _, other := range others {
+		if _, ok := counts[other.Name]; ok {
+			return nil, newStatusError(http.StatusBadRequest, "facet %s collides with the facets added by other option", other.Name)
+		}
+	}
+	out := make([]Facet, 0, len(facets)-len(dropped)+len(others))
+	for _, f := range facets {
+		if !dropped[pathKey(f.Path)] {
+			out = append(out, f)
+		}
+	}
+	for _, other := range others {
+		out = append(out, *other)
+	}
+	return out, nil
+}
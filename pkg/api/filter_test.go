@@ -0,0 +1,126 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	body := `{"data": {
+		"facet1": {"facet3": {"count": 30}, "facet4": {"count": 10}, "facet5": {"count": 5}},
+		"facet2": {"facet6": {"count": 4}},
+		"facet7": {"count": 51}
+	}}`
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{"no filters", "", `{"result": [{"facet1": 45}, {"facet2": 4}, {"facet3": 30}, {"facet4": 10}, {"facet5": 5}, {"facet6": 4}, {"facet7": 51}]}`},
+		{"top", "?top=2", `{"result": [{"facet1": 45}, {"facet3": 30}, {"facet4": 10}, {"facet7": 51}]}`},
+		{"top with other", "?top=1&other=true", `{"result": [{"facet7": 51}, {"other": 49}]}`},
+		{"min count", "?min_count=10", `{"result": [{"facet1": 45}, {"facet3": 30}, {"facet4": 10}, {"facet7": 51}]}`},
+		{"min count with other", "?min_count=10&other=1", `{"result": [{"facet1": 45}, {"facet1/other": 5}, {"facet3": 30}, {"facet4": 10}, {"facet7": 51}, {"other": 4}]}`},
+		{"min share", "?min_share=0.2", `{"result": [{"facet1": 45}, {"facet3": 30}, {"facet4": 10}, {"facet7": 51}]}`},
+		{"max depth", "?max_depth=1", `{"result": [{"facet1": 45}, {"facet2": 4}, {"facet7": 51}]}`},
+		{"combined", "?max_depth=1&top=2", `{"result": [{"facet1": 45}, {"facet7": 51}]}`},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				assert.JSONEq(t, tt.expected, rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+func TestFilterCSV(t *testing.T) {
+	body := `{"data": {"facet1": {"facet3": {"count": 30}, "facet4": {"count": 10}}, "facet2": {"count": 4}}}`
+	req, err := http.NewRequest("POST", "/api/v1/buffered?format=csv&top=1&other=true&metrics=share_of_parent", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, `facet,path,depth,parent,count,share_of_parent
+facet1,facet1,1,,40,0.9090909090909091
+facet1/other,facet1/other,2,facet1,10,0.25
+facet3,facet1/facet3,2,facet1,30,0.75
+other,other,1,,4,0.09090909090909091
+`, rr.Body.String(), "response body differs")
+}
+
+func TestFilterInvalidOptions(t *testing.T) {
+	for _, query := range []string{"?top=-1", "?top=x", "?max_depth=1.5", "?min_count=x", "?min_share=NaN", "?other=maybe"} {
+		t.Run(query, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/v1/buffered"+query, strings.NewReader(testBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+		})
+	}
+}
+
+func TestFilterOtherRepeatedNames(t *testing.T) {
+	body := `{"data": {"a": {"p": {"x": {"count": 5}, "y": {"count": 1}}}, "b": {"p": {"x": {"count": 2}, "y": {"count": 3}}}}}`
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		t.Run(strings.TrimPrefix(path, "/api/v1/"), func(t *testing.T) {
+			req, err := http.NewRequest("POST", path+"?min_count=3&other=true", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+			assert.JSONEq(t, `{"result": [
+				{"a": 6}, {"a/p/other": 1}, {"b": 5}, {"b/p/other": 2}, {"p": 6}, {"p": 5}, {"x": 5}, {"y": 3}
+			]}`, rr.Body.String(), "response body differs")
+		})
+	}
+}
+
+func TestFilterOtherFacet(t *testing.T) {
+	const body = `{"data": {"facet1": {"other": {"count": 1}, "facet2": {"count": 2}}}}`
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for query, code := range map[string]int{"?top=1&other=true": http.StatusBadRequest, "?top=1": http.StatusOK, "?other=true": http.StatusOK} {
+			req, err := http.NewRequest("POST", path+query, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, code, rr.Code, "status code of %s%s differs", path, query)
+			if code != http.StatusOK {
+				assert.Contains(t, rr.Body.String(), "facet facet1/other collides with the facets added by other option", "error differs")
+			}
+		}
+	}
+}
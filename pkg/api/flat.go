@@ -0,0 +1,137 @@
+package api
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+// isFlat returns true when request asks for flattened JSON input (?layout=flat).
+func isFlat(params url.Values) bool {
+	return params.Get("layout") == "flat"
+}
+
+// unmarshalFlat builds the node tree from flattened JSON object where keys are
+// facet paths and values are leaf counts:
+//
+//	{"facet1.facet3.facet5": 50, "facet2": 0, "facet7": [10, 12]}
+//
+// The object may also be wrapped in {"data": ...} like the nested input.
+// Options:
+//
+//	?path_separator=. separates facet names in keys, backslash escapes
+//	the separator (or backslash) in facet names, e.g. "facet\.1.facet2".
+//
+// Keys are read in the document order, invalid counts are recorded by v.
+func unmarshalFlat(r io.Reader, params url.Values, v *Validator) (*Node, error) {
+	separator := paramOrDefault(params, "path_separator", ".")
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read json body")
+	}
+	iter := jsoniter.ConfigDefault.BorrowIterator(b)
+	defer jsoniter.ConfigDefault.ReturnIterator(iter)
+
+	doc := readOrdered(iter)
+	if iter.Error == nil && iter.WhatIsNext() != jsoniter.InvalidValue {
+		iter.ReportError("unmarshalFlat", "there are bytes left after the document")
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, errors.Wrap(iter.Error, "unable to parse json")
+	}
+	input, ok := doc.(documentObject)
+	if !ok && doc != nil {
+		return nil, errors.Errorf("document is invalid type %s, must be object", typeName(doc))
+	}
+	if len(input) == 1 && input[0].Key == "data" {
+		if data, ok := input[0].Value.(documentObject); ok {
+			input = data
+		}
+	}
+
+	builder := newTreeBuilder()
+	for _, member := range input {
+		path, err := splitEscaped(member.Key, separator)
+		if err != nil {
+			return nil, err
+		}
+		if values, ok := member.Value.([]interface{}); ok {
+			series, _, ok := v.series(path, values)
+			if !ok {
+				continue
+			}
+			if err := builder.AddSeries(path, series); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		count, ok := v.Count(path, member.Value)
+		if !ok {
+			continue
+		}
+		if err := builder.Add(path, count); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Root(), nil
+}
+
+// splitEscaped splits key by separator, unless the separator is escaped with
+// backslash. Backslash followed by another backslash is a literal backslash.
+func splitEscaped(key, separator string) ([]string, error) {
+	var (
+		path []string
+		name strings.Builder
+	)
+
+	for i := 0; i < len(key); {
+		switch {
+		case key[i] == '\\':
+			if i+1 >= len(key) {
+				return nil, errors.Errorf("key %q ends with escape character", key)
+			}
+			i++
+			if strings.HasPrefix(key[i:], separator) {
+				name.WriteString(separator)
+				i += len(separator)
+				continue
+			}
+			name.WriteByte(key[i])
+			i++
+		case strings.HasPrefix(key[i:], separator):
+			path = append(path, name.String())
+			name.Reset()
+			i += len(separator)
+		default:
+			name.WriteByte(key[i])
+			i++
+		}
+	}
+	path = append(path, name.String())
+
+	for _, name := range path {
+		if name == "" {
+			return nil, errors.Errorf("key %q contains empty facet name", key)
+		}
+	}
+	return path, nil
+}
+
+// readOrdered reads JSON value, objects are read as documentObject, so that
+// their keys are kept in the document order.
+func readOrdered(iter *jsoniter.Iterator) interface{} {
+	if iter.WhatIsNext() != jsoniter.ObjectValue {
+		return iter.Read()
+	}
+	object := documentObject{}
+	iter.ReadObjectCB(func(iter *jsoniter.Iterator, key string) bool {
+		object = append(object, documentMember{Key: key, Value: readOrdered(iter)})
+		return iter.Error == nil
+	})
+	return object
+}
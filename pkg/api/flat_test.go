@@ -0,0 +1,85 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		body     string
+		expected string
+	}{
+		{
+			"dotted", "?layout=flat",
+			`{"facet1.facet3.facet4.facet6": 20, "facet1.facet3.facet4.facet7": 30, "facet1.facet3.facet5": 50, "facet2": 0}`,
+			expectedOutput,
+		},
+		{
+			"wrapped in data", "?layout=flat",
+			`{"data": {"facet1.facet3.facet4.facet6": 20, "facet1.facet3.facet4.facet7": 30, "facet1.facet3.facet5": 50, "facet2": 0}}`,
+			expectedOutput,
+		},
+		{
+			"custom separator", "?layout=flat&path_separator=%3A%3A",
+			`{"facet1::facet3::facet4::facet6": 20, "facet1::facet3::facet4::facet7": 30, "facet1::facet3::facet5": 50, "facet2": 0}`,
+			expectedOutput,
+		},
+		{
+			"escaped separator", "?layout=flat",
+			`{"facet\\.1.facet2": 10, "facet\\\\3": 5}`,
+			`{"result": [{"facet.1": 10}, {"facet2": 10}, {"facet\\3": 5}]}`,
+		},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				assert.JSONEq(t, tt.expected, rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+func TestFlatInputInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"non numeric count", `{"facet1.facet2": "10"}`},
+		{"empty facet name", `{"facet1..facet2": 10}`},
+		{"trailing escape", `{"facet1\\": 10}`},
+		{"leaf with children", `{"facet1": 10, "facet1.facet2": 10}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/v1/buffered?layout=flat", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+		})
+	}
+}
@@ -0,0 +1,695 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// grpcMaxMessageSize limits the size of gRPC request messages, the
+	// default of gRPC implementations.
+	grpcMaxMessageSize = 4 << 20 // 4 MiB
+	// grpcMaxStreamSize limits the size of all request messages of a call.
+	grpcMaxStreamSize = 64 << 20 // 64 MiB
+	// grpcMaxTimeout is the deadline of calls without grpc-timeout, longer
+	// timeouts are shortened to it.
+	grpcMaxTimeout = 5 * time.Minute
+	mediaTypeGRPC  = "application/grpc"
+)
+
+// gRPC status codes.
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+)
+
+// AggregateRequest is the request of Aggregate and the messages of
+// AggregateStream of facets.proto, Data is the root of the tree.
+type AggregateRequest struct {
+	Data *Node
+	Sort string
+}
+
+// AggregateResponse is the response of Aggregate and AggregateStream, and
+// the application/x-protobuf output of the HTTP API, which sets NextCursor
+// and Skipped too.
+type AggregateResponse struct {
+	Result     []Facet
+	NextCursor string
+	Skipped    []InvalidLeaf
+}
+
+// DiffRequest is the request of Diff, the response is DiffOutputJSON.
+type DiffRequest struct {
+	Before *Node
+	After  *Node
+	Sort   string
+}
+
+// MergeRequest is the request of Merge, Documents are the roots of the trees.
+type MergeRequest struct {
+	Documents []*Node
+	Sort      string
+}
+
+// MergeResponse is the response of Merge.
+type MergeResponse struct {
+	Data      *Node
+	Result    []Facet
+	Conflicts []Conflict
+}
+
+// grpcRecv returns the next request message of gRPC call, io.EOF after the
+// last one.
+type grpcRecv func() ([]byte, error)
+
+// grpcMethods are the methods of the Facets service by their path, they
+// return the response message.
+var grpcMethods = map[string]func(grpcRecv) ([]byte, error){
+	"/facets.v1.Facets/Aggregate":       grpcAggregate,
+	"/facets.v1.Facets/AggregateStream": grpcAggregateStream,
+	"/facets.v1.Facets/Diff":            grpcDiff,
+	"/facets.v1.Facets/Merge":           grpcMerge,
+}
+
+// GRPCHandler returns the handler of the Facets gRPC service of facets.proto,
+// it has to be served over HTTP/2 (see RunServer). The gRPC protocol is
+// implemented on net/http with the messages encoded by protobuf.go, so only
+// its basics are supported: request messages are limited to 4 MiB and can't
+// be compressed, grpc-timeout is honored.
+func GRPCHandler() http.Handler {
+	return http.HandlerFunc(serveGRPC)
+}
+
+func serveGRPC(rw http.ResponseWriter, req *http.Request) {
+	if req.ProtoMajor != 2 {
+		http.Error(rw, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if contentType := strings.SplitN(req.Header.Get("Content-Type"), ";", 2)[0]; req.Method != "POST" ||
+		(contentType != mediaTypeGRPC && contentType != mediaTypeGRPC+"+proto") {
+		http.Error(rw, "gRPC request expected", http.StatusUnsupportedMediaType)
+		return
+	}
+	defer closer(req.Body)
+
+	rw.Header().Set("Content-Type", mediaTypeGRPC)
+	rw.Header().Set("Grpc-Accept-Encoding", "identity")
+	rw.WriteHeader(http.StatusOK)
+	// The headers are sent right away, so that the response is streamed and
+	// the status ends it in the trailers.
+	if err := http.NewResponseController(rw).Flush(); err != nil {
+		log.Warn("Unable to flush gRPC headers", "err", err)
+	}
+
+	out, err := callGRPC(rw, req)
+	if err == nil {
+		err = writeGRPCMessage(rw, out)
+	}
+	// The status is sent in the trailers, also when there is no response.
+	code, message := grpcStatus(err)
+	if code == grpcInternal {
+		log.Error("gRPC call failed", "method", req.URL.Path, "err", err)
+	}
+	rw.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		rw.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeGRPCMessage(message))
+	}
+}
+
+// callGRPC calls the method of request and returns its response message.
+func callGRPC(rw http.ResponseWriter, req *http.Request) (out []byte, err error) {
+	method, ok := grpcMethods[req.URL.Path]
+	if !ok {
+		return nil, newStatusError(http.StatusNotImplemented, "unknown method %s", req.URL.Path)
+	}
+	if encoding := req.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+		return nil, newStatusError(http.StatusNotImplemented, "unsupported grpc-encoding %q, supported: identity", encoding)
+	}
+
+	timeout := grpcMaxTimeout
+	if v := req.Header.Get("Grpc-Timeout"); v != "" {
+		d, err := parseGRPCTimeout(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	// Reads of streams stalled by client fail at the deadline.
+	deadline, _ := ctx.Deadline()
+	if err := http.NewResponseController(rw).SetReadDeadline(deadline); err != nil {
+		return nil, errors.Wrap(err, "unable to set deadline")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("panic: %v", r)
+		}
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	return method(func() ([]byte, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return readGRPCMessage(req.Body)
+	})
+}
+
+// readGRPCMessage reads one length-prefixed message, io.EOF is returned at
+// the end of the stream.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, newStatusError(http.StatusBadRequest, "truncated message")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, newStatusError(http.StatusNotImplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessageSize {
+		return nil, newStatusError(http.StatusRequestEntityTooLarge, "message of %d bytes is larger than %d", size, grpcMaxMessageSize)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, newStatusError(http.StatusBadRequest, "truncated message")
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeGRPCMessage writes length-prefixed uncompressed message.
+func writeGRPCMessage(w io.Writer, b []byte) error {
+	prefix := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(b)))
+	_, err := w.Write(append(prefix, b...))
+	return err
+}
+
+// grpcStatus returns gRPC status code and message of err, the status codes
+// of API errors are mapped to their gRPC counterparts.
+func grpcStatus(err error) (int, string) {
+	if err == nil {
+		return grpcOK, ""
+	}
+	switch cause := errors.Cause(err); {
+	case cause == context.Canceled:
+		return grpcCanceled, err.Error()
+	case cause == context.DeadlineExceeded || cause == os.ErrDeadlineExceeded:
+		return grpcDeadlineExceeded, err.Error()
+	}
+	if e, ok := errors.Cause(err).(Error); ok {
+		switch code := e.StatusCode(); {
+		case code == http.StatusNotFound:
+			return grpcNotFound, err.Error()
+		case code == http.StatusRequestEntityTooLarge:
+			return grpcResourceExhausted, err.Error()
+		case code == http.StatusNotImplemented:
+			return grpcUnimplemented, err.Error()
+		case code == http.StatusServiceUnavailable:
+			return grpcUnavailable, err.Error()
+		case code >= 400 && code < 500:
+			return grpcInvalidArgument, err.Error()
+		}
+	}
+	return grpcInternal, err.Error()
+}
+
+// encodeGRPCMessage percent-encodes grpc-message value.
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout parses grpc-timeout value, e.g. "100m" is 100ms.
+func parseGRPCTimeout(v string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	if len(v) < 2 || len(v) > 9 {
+		return 0, newStatusError(http.StatusBadRequest, "invalid grpc-timeout %q", v)
+	}
+	unit, ok := units[v[len(v)-1]]
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, newStatusError(http.StatusBadRequest, "invalid grpc-timeout %q", v)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// recvUnary returns the only request message of unary call.
+func recvUnary(recv grpcRecv) ([]byte, error) {
+	b, err := recv()
+	if err == io.EOF {
+		return nil, newStatusError(http.StatusBadRequest, "request message missing")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := recv(); err != io.EOF {
+		if err != nil {
+			return nil, err
+		}
+		return nil, newStatusError(http.StatusBadRequest, "unary method got more than one request message")
+	}
+	return b, nil
+}
+
+func grpcAggregate(recv grpcRecv) ([]byte, error) {
+	b, err := recvUnary(recv)
+	if err != nil {
+		return nil, err
+	}
+	var in AggregateRequest
+	if err := in.UnmarshalProto(b); err != nil {
+		return nil, errors.Wrap(badRequest(err), "unable to parse request")
+	}
+	order, err := parseSort(in.Sort)
+	if err != nil {
+		return nil, err
+	}
+	facets := in.Data.Facets()
+	sortFacets(facets, order)
+	return (&AggregateResponse{Result: facets}).MarshalProto(), nil
+}
+
+// grpcAggregateStream merges the trees of the messages as they arrive, so
+// that only the merged tree is kept. The messages are limited to
+// grpcMaxStreamSize in total.
+func grpcAggregateStream(recv grpcRecv) ([]byte, error) {
+	var (
+		root  = &Node{}
+		order string
+		size  int
+	)
+	for i := 0; ; i++ {
+		b, err := recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size += len(b); size > grpcMaxStreamSize {
+			return nil, newStatusError(http.StatusRequestEntityTooLarge, "messages are larger than %d bytes in total", grpcMaxStreamSize)
+		}
+		var in AggregateRequest
+		if err := in.UnmarshalProto(b); err != nil {
+			return nil, errors.Wrapf(badRequest(err), "unable to parse message %d", i)
+		}
+		if i == 0 {
+			if order, err = parseSort(in.Sort); err != nil {
+				return nil, err
+			}
+		}
+		if conflicts := mergeNode(root, in.Data, i, nil, nil); len(conflicts) > 0 {
+			c := conflicts[0]
+			return nil, newStatusError(http.StatusBadRequest, "message %d conflicts at %s: %s", c.Document, c.Path, c.Message)
+		}
+	}
+	if order == "" {
+		order = SortName
+	}
+	facets := root.Facets()
+	sortFacets(facets, order)
+	return (&AggregateResponse{Result: facets}).MarshalProto(), nil
+}
+
+func grpcDiff(recv grpcRecv) ([]byte, error) {
+	b, err := recvUnary(recv)
+	if err != nil {
+		return nil, err
+	}
+	var in DiffRequest
+	if err := in.UnmarshalProto(b); err != nil {
+		return nil, errors.Wrap(badRequest(err), "unable to parse request")
+	}
+	order, err := parseSort(in.Sort)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(in.Before, in.After, order).MarshalProto(), nil
+}
+
+func grpcMerge(recv grpcRecv) ([]byte, error) {
+	b, err := recvUnary(recv)
+	if err != nil {
+		return nil, err
+	}
+	var in MergeRequest
+	if err := in.UnmarshalProto(b); err != nil {
+		return nil, errors.Wrap(badRequest(err), "unable to parse request")
+	}
+	order, err := parseSort(in.Sort)
+	if err != nil {
+		return nil, err
+	}
+	merged, conflicts := MergeTrees(in.Documents)
+	sortNodes(merged, order)
+	facets := merged.Facets()
+	sortFacets(facets, order)
+	return (&MergeResponse{Data: merged, Result: facets, Conflicts: conflicts}).MarshalProto(), nil
+}
+
+// MarshalProto returns the AggregateRequest message.
+func (m *AggregateRequest) MarshalProto() []byte {
+	var b []byte
+	if m.Data != nil {
+		b = appendProtoNodes(b, 1, m.Data.Children)
+	}
+	return appendProtoString(b, 2, m.Sort)
+}
+
+// UnmarshalProto reads the AggregateRequest message, the leaves are
+// validated strictly.
+func (m *AggregateRequest) UnmarshalProto(b []byte) error {
+	var (
+		r    = protoReader{b: b}
+		data [][]byte
+	)
+	*m = AggregateRequest{}
+	for r.next() {
+		switch r.field {
+		case 1:
+			data = append(data, r.bytes())
+		case 2:
+			m.Sort = r.string()
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	m.Data = &Node{}
+	return readProtoTree(data, m.Data)
+}
+
+// MarshalProto returns the AggregateResponse message.
+func (m *AggregateResponse) MarshalProto() []byte {
+	b := appendProtoFacets(nil, 1, m.Result)
+	b = appendProtoString(b, 2, m.NextCursor)
+	for i := range m.Skipped {
+		b = appendProtoBytes(b, 3, m.Skipped[i].appendProto(nil))
+	}
+	return b
+}
+
+// UnmarshalProto reads the AggregateResponse message.
+func (m *AggregateResponse) UnmarshalProto(b []byte) error {
+	r := protoReader{b: b}
+	*m = AggregateResponse{}
+	for r.next() {
+		switch r.field {
+		case 1:
+			f, err := readProtoFacet(r.bytes())
+			if err != nil {
+				return err
+			}
+			m.Result = append(m.Result, f)
+		case 2:
+			m.NextCursor = r.string()
+		case 3:
+			leaf, err := readProtoInvalidLeaf(r.bytes())
+			if err != nil {
+				return err
+			}
+			m.Skipped = append(m.Skipped, leaf)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+// MarshalProto returns the DiffRequest message.
+func (m *DiffRequest) MarshalProto() []byte {
+	var b []byte
+	if m.Before != nil {
+		b = appendProtoNodes(b, 1, m.Before.Children)
+	}
+	if m.After != nil {
+		b = appendProtoNodes(b, 2, m.After.Children)
+	}
+	return appendProtoString(b, 3, m.Sort)
+}
+
+// UnmarshalProto reads the DiffRequest message, the leaves are validated
+// strictly.
+func (m *DiffRequest) UnmarshalProto(b []byte) error {
+	var (
+		r             = protoReader{b: b}
+		before, after [][]byte
+	)
+	*m = DiffRequest{}
+	for r.next() {
+		switch r.field {
+		case 1:
+			before = append(before, r.bytes())
+		case 2:
+			after = append(after, r.bytes())
+		case 3:
+			m.Sort = r.string()
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	m.Before, m.After = &Node{}, &Node{}
+	if err := readProtoTree(before, m.Before); err != nil {
+		return errors.Wrap(err, "before")
+	}
+	return errors.Wrap(readProtoTree(after, m.After), "after")
+}
+
+// MarshalProto returns the DiffResponse message.
+func (m *DiffOutputJSON) MarshalProto() []byte {
+	var b []byte
+	for i := range m.Facets {
+		f := &m.Facets[i]
+		facet := appendProtoString(nil, 1, f.Path)
+		facet = appendProtoString(facet, 2, f.Name)
+		facet = appendProtoInt(facet, 3, int64(f.Depth))
+		facet = appendProtoDouble(facet, 4, f.Before)
+		facet = appendProtoDouble(facet, 5, f.After)
+		facet = appendProtoDouble(facet, 6, f.Change)
+		if f.Relative != nil {
+			facet = appendProtoFixed64(facet, 7, *f.Relative)
+		}
+		facet = appendProtoString(facet, 8, f.Status)
+		facet = appendProtoBool(facet, 9, f.StructureChanged)
+		b = appendProtoBytes(b, 1, facet)
+	}
+	b = appendProtoStrings(b, 2, m.Added)
+	b = appendProtoStrings(b, 3, m.Removed)
+	return appendProtoStrings(b, 4, m.StructureChanged)
+}
+
+// UnmarshalProto reads the DiffResponse message.
+func (m *DiffOutputJSON) UnmarshalProto(b []byte) error {
+	r := protoReader{b: b}
+	*m = DiffOutputJSON{}
+	for r.next() {
+		switch r.field {
+		case 1:
+			var (
+				f  FacetDiff
+				fr = protoReader{b: r.bytes()}
+			)
+			for fr.next() {
+				switch fr.field {
+				case 1:
+					f.Path = fr.string()
+				case 2:
+					f.Name = fr.string()
+				case 3:
+					f.Depth = int(fr.int())
+				case 4:
+					f.Before = fr.double()
+				case 5:
+					f.After = fr.double()
+				case 6:
+					f.Change = fr.double()
+				case 7:
+					relative := fr.double()
+					f.Relative = &relative
+				case 8:
+					f.Status = fr.string()
+				case 9:
+					f.StructureChanged = fr.bool()
+				default:
+					fr.skip()
+				}
+			}
+			if fr.err != nil {
+				return fr.err
+			}
+			m.Facets = append(m.Facets, f)
+		case 2:
+			m.Added = append(m.Added, r.string())
+		case 3:
+			m.Removed = append(m.Removed, r.string())
+		case 4:
+			m.StructureChanged = append(m.StructureChanged, r.string())
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+// MarshalProto returns the MergeRequest message.
+func (m *MergeRequest) MarshalProto() []byte {
+	var b []byte
+	for _, doc := range m.Documents {
+		b = appendProtoBytes(b, 1, appendProtoNodes(nil, 1, doc.Children))
+	}
+	return appendProtoString(b, 2, m.Sort)
+}
+
+// UnmarshalProto reads the MergeRequest message, the leaves are validated
+// strictly.
+func (m *MergeRequest) UnmarshalProto(b []byte) error {
+	r := protoReader{b: b}
+	*m = MergeRequest{}
+	for r.next() {
+		switch r.field {
+		case 1:
+			var (
+				data [][]byte
+				dr   = protoReader{b: r.bytes()}
+			)
+			for dr.next() {
+				if dr.field == 1 {
+					data = append(data, dr.bytes())
+				} else {
+					dr.skip()
+				}
+			}
+			if dr.err != nil {
+				return dr.err
+			}
+			doc := &Node{}
+			if err := readProtoTree(data, doc); err != nil {
+				return errors.Wrapf(err, "document %d", len(m.Documents))
+			}
+			m.Documents = append(m.Documents, doc)
+		case 2:
+			m.Sort = r.string()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+// MarshalProto returns the MergeResponse message.
+func (m *MergeResponse) MarshalProto() []byte {
+	var b []byte
+	if m.Data != nil {
+		b = appendProtoNodes(b, 1, m.Data.Children)
+	}
+	b = appendProtoFacets(b, 2, m.Result)
+	for _, c := range m.Conflicts {
+		conflict := appendProtoString(nil, 1, c.Path)
+		conflict = appendProtoInt(conflict, 2, int64(c.Document))
+		b = appendProtoBytes(b, 3, appendProtoString(conflict, 3, c.Message))
+	}
+	return b
+}
+
+// UnmarshalProto reads the MergeResponse message.
+func (m *MergeResponse) UnmarshalProto(b []byte) error {
+	var (
+		r    = protoReader{b: b}
+		data [][]byte
+	)
+	*m = MergeResponse{}
+	for r.next() {
+		switch r.field {
+		case 1:
+			data = append(data, r.bytes())
+		case 2:
+			f, err := readProtoFacet(r.bytes())
+			if err != nil {
+				return err
+			}
+			m.Result = append(m.Result, f)
+		case 3:
+			var (
+				c  Conflict
+				cr = protoReader{b: r.bytes()}
+			)
+			for cr.next() {
+				switch cr.field {
+				case 1:
+					c.Path = cr.string()
+				case 2:
+					c.Document = int(cr.int())
+				case 3:
+					c.Message = cr.string()
+				default:
+					cr.skip()
+				}
+			}
+			if cr.err != nil {
+				return cr.err
+			}
+			m.Conflicts = append(m.Conflicts, c)
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	m.Data = &Node{}
+	return readProtoTree(data, m.Data)
+}
+
+// readProtoTree reads repeated Node field as the children of root, the
+// leaves are validated strictly.
+func readProtoTree(data [][]byte, root *Node) error {
+	v := &Validator{mode: ValidationStrict}
+	if err := readProtoNodes(data, root, v); err != nil {
+		return err
+	}
+	return v.Err()
+}
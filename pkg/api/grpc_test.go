@@ -0,0 +1,226 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// grpcServer returns started gRPC server and HTTP/2 client of it.
+func grpcServer(t *testing.T) (*httptest.Server, *http.Client) {
+	server := httptest.NewUnstartedServer(api.GRPCHandler())
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return server, &http.Client{Transport: transport}
+}
+
+// grpcCall calls method with request messages and returns the response
+// message, gRPC status code and message.
+func grpcCall(t *testing.T, server *httptest.Server, client *http.Client, method string, header http.Header, messages ...[]byte) ([]byte, int, string) {
+	var body bytes.Buffer
+	for _, message := range messages {
+		prefix := make([]byte, 5)
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+		body.Write(prefix)
+		body.Write(message)
+	}
+	req, err := http.NewRequest("POST", server.URL+"/facets.v1.Facets/"+method, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "status code differs")
+
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := url.PathUnescape(resp.Trailer.Get("Grpc-Message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) == 0 {
+		return nil, code, message
+	}
+	assert.Equal(t, int(binary.BigEndian.Uint32(b[1:5])), len(b)-5, "message length differs")
+	return b[5:], code, message
+}
+
+// parseTree parses JSON document.
+func parseTree(t testing.TB, body string) *api.Node {
+	root, err := api.BufferedMediaTypes.ParseTree(strings.NewReader(body), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// facetCounts returns "path: count" of facets.
+func facetCounts(facets []api.Facet) []string {
+	out := make([]string, len(facets))
+	for i, f := range facets {
+		out[i] = strings.Join(f.Path, "/") + ": " + strconv.FormatFloat(f.Count, 'g', -1, 64)
+	}
+	return out
+}
+
+func TestGRPCAggregate(t *testing.T) {
+	server, client := grpcServer(t)
+	defer server.Close()
+
+	in := api.AggregateRequest{Data: parseTree(t, testBody), Sort: "count_desc"}
+	b, code, message := grpcCall(t, server, client, "Aggregate", nil, in.MarshalProto())
+	assert.Equal(t, 0, code, "status differs: %s", message)
+	var out api.AggregateResponse
+	if err := out.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"facet1: 100", "facet1/facet3: 100", "facet1/facet3/facet4: 50", "facet1/facet3/facet5: 50",
+		"facet1/facet3/facet4/facet7: 30", "facet1/facet3/facet4/facet6: 20", "facet2: 0",
+	}, facetCounts(out.Result), "result differs")
+
+	// The tree is sent in parts, the sort of the first message is used.
+	parts := []string{
+		`{"data": {"facet1": {"facet3": {"count": 50}}}}`,
+		`{"data": {"facet1": {"facet3": {"count": 25}, "facet4": {"count": [1, 2]}}}}`,
+		`{"data": {"facet2": {"count": 0}}}`,
+	}
+	var messages [][]byte
+	for i, part := range parts {
+		in := api.AggregateRequest{Data: parseTree(t, part)}
+		if i == 0 {
+			in.Sort = "document"
+		}
+		messages = append(messages, in.MarshalProto())
+	}
+	b, code, message = grpcCall(t, server, client, "AggregateStream", nil, messages...)
+	assert.Equal(t, 0, code, "status differs: %s", message)
+	if err := out.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"facet1: 78", "facet1/facet3: 75", "facet1/facet4: 3", "facet2: 0"}, facetCounts(out.Result), "result differs")
+	assert.Equal(t, []float64{1, 2}, out.Result[2].Series, "series differs")
+
+	// No messages aggregate empty tree.
+	b, code, _ = grpcCall(t, server, client, "AggregateStream", nil)
+	assert.Equal(t, 0, code, "status differs")
+	assert.Empty(t, b, "response differs")
+}
+
+func TestGRPCDiffMerge(t *testing.T) {
+	server, client := grpcServer(t)
+	defer server.Close()
+
+	before := parseTree(t, `{"data": {"a": {"count": 10}, "b": {"count": 5}}}`)
+	after := parseTree(t, `{"data": {"a": {"count": 15}, "c": {"x": {"count": 1}}}}`)
+
+	in := api.DiffRequest{Before: before, After: after}
+	b, code, message := grpcCall(t, server, client, "Diff", nil, in.MarshalProto())
+	assert.Equal(t, 0, code, "status differs: %s", message)
+	var diff api.DiffOutputJSON
+	if err := diff.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	expected := api.Diff(before, after, api.SortName)
+	assert.Equal(t, expected.Facets, diff.Facets, "facets differ")
+	assert.Equal(t, []string{"c", "c/x"}, diff.Added, "added differ")
+	assert.Equal(t, []string{"b"}, diff.Removed, "removed differ")
+	assert.Nil(t, diff.Facets[2].Relative, "relative of added facet differs")
+
+	merge := api.MergeRequest{Documents: []*api.Node{before, after, parseTree(t, `{"data": {"a": {"y": {"count": 1}}}}`)}}
+	b, code, message = grpcCall(t, server, client, "Merge", nil, merge.MarshalProto())
+	assert.Equal(t, 0, code, "status differs: %s", message)
+	var merged api.MergeResponse
+	if err := merged.UnmarshalProto(b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a: 1", "b: 5", "c: 1", "c/x: 1", "a/y: 1"}, facetCounts(merged.Result), "result differs")
+	assert.Equal(t, []api.Conflict{{Path: "a", Document: 2, Message: "facet has children, but it is a leaf with count 25 in previous documents"}}, merged.Conflicts, "conflicts differ")
+	b, err := merged.Data.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `{"a": {"y": {"count": 1}}, "b": {"count": 5}, "c": {"x": {"count": 1}}}`, string(b), "tree differs")
+}
+
+func TestGRPCErrors(t *testing.T) {
+	server, client := grpcServer(t)
+	defer server.Close()
+
+	valid := (&api.AggregateRequest{Data: parseTree(t, testBody)}).MarshalProto()
+	// Node {name: "a", count: -1}.
+	negative := []byte{0x0a, 0x0c, 0x0a, 0x01, 'a', 0x11, 0, 0, 0, 0, 0, 0, 0xf0, 0xbf}
+	// Messages of the largest size with unknown field 15, too many of them
+	// for a stream.
+	large := make([]byte, 4<<20)
+	copy(large, binary.AppendUvarint([]byte{0x7a}, uint64(len(large)-5)))
+	stream := make([][]byte, 17)
+	for i := range stream {
+		stream[i] = large
+	}
+	tests := []struct {
+		name     string
+		method   string
+		header   http.Header
+		messages [][]byte
+		code     int
+		message  string
+	}{
+		{"unknown method", "Count", nil, [][]byte{valid}, 12, "unknown method /facets.v1.Facets/Count"},
+		{"missing", "Aggregate", nil, nil, 3, "request message missing"},
+		{"many", "Aggregate", nil, [][]byte{valid, valid}, 3, "unary method got more than one request message"},
+		{"sort", "Aggregate", nil, [][]byte{(&api.AggregateRequest{Sort: "size"}).MarshalProto()}, 3, `unknown sort "size", supported: name, natural, count_desc, count_asc, document, tree`},
+		{"invalid", "Aggregate", nil, [][]byte{negative}, 3, "unable to parse request: 1 invalid leaves: a: count value is negative"},
+		{"malformed", "Diff", nil, [][]byte{{0x0a, 0x05, 0x0a}}, 3, "unable to parse request: invalid protobuf field 1: truncated bytes"},
+		{"conflict", "AggregateStream", nil, [][]byte{valid, (&api.AggregateRequest{Data: parseTree(t, `{"data": {"facet1": {"count": 1}}}`)}).MarshalProto()}, 3,
+			"message 1 conflicts at facet1: facet is a leaf with count 1, but it has children in previous documents"},
+		{"encoding", "Aggregate", http.Header{"Grpc-Encoding": {"gzip"}}, [][]byte{valid}, 12, `unsupported grpc-encoding "gzip", supported: identity`},
+		{"timeout", "Aggregate", http.Header{"Grpc-Timeout": {"1n"}}, [][]byte{valid}, 4, "context deadline exceeded"},
+		{"invalid timeout", "Aggregate", http.Header{"Grpc-Timeout": {"1s"}}, [][]byte{valid}, 3, `invalid grpc-timeout "1s"`},
+		{"large stream", "AggregateStream", nil, stream, 8, "messages are larger than 67108864 bytes in total"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, code, message := grpcCall(t, server, client, tt.method, tt.header, tt.messages...)
+			assert.Equal(t, tt.code, code, "status differs")
+			assert.Equal(t, tt.message, message, "message differs")
+			assert.Empty(t, b, "response differs")
+		})
+	}
+
+	// gRPC needs HTTP/2.
+	resp, err := http.Post(server.URL+"/facets.v1.Facets/Aggregate", "application/grpc", bytes.NewReader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusHTTPVersionNotSupported, resp.StatusCode, "status code differs")
+}
@@ -0,0 +1,435 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/json-iterator/go"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultJobQueueSize     = 100
+	defaultJobResultTTL     = time.Hour
+	defaultJobMaxUploadSize = 1 << 30 // 1 GiB
+	// jobUploadMinRate is the slowest upload rate in bytes per second the
+	// deadlines of job uploads allow for, jobUploadTimeout is added to it.
+	jobUploadMinRate = 1 << 20 // 1 MiB/s
+	jobUploadTimeout = time.Minute
+)
+
+// Statuses of asynchronous jobs.
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// JobJSON represents the status of asynchronous job.
+type JobJSON struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Progress of parsing, facets are counted while walking nested JSON.
+	BytesTotal  int64 `json:"bytes_total"`
+	BytesParsed int64 `json:"bytes_parsed"`
+	NodesSeen   int64 `json:"nodes_seen"`
+	// Error of failed job.
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Expires is when the finished job and its result are dropped.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// job is one asynchronous aggregation of uploaded document.
+type job struct {
+	id       string
+	path     string // spooled upload, removed when the job finishes
+	size     int64
+	dec      Decoder
+	params   url.Values
+	opts     Options
+	ctx      context.Context
+	cancel   context.CancelFunc
+	progress progress
+	created  time.Time
+
+	// Guarded by the mutex of jobQueue.
+	status   string
+	err      error
+	res      Result
+	finished time.Time
+}
+
+// jobQueue runs the jobs in a bounded pool of workers, finished jobs are kept
+// for ttl. The workers are started with the first job and stopped by close.
+type jobQueue struct {
+	dir           string
+	ttl           time.Duration
+	maxUploadSize int64
+	workers       int
+	queue         chan *job
+	running       sync.WaitGroup
+
+	mu      sync.Mutex
+	jobs    map[string]*job
+	started bool
+	closed  bool
+}
+
+// newJobQueue returns queue of at most size queued jobs processed by workers,
+// uploads of at most maxUploadSize bytes are spooled to dir (the system
+// temporary directory when empty). Zero values select the defaults.
+func newJobQueue(workers, size int, ttl time.Duration, dir string, maxUploadSize int64) *jobQueue {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if size <= 0 {
+		size = defaultJobQueueSize
+	}
+	if ttl <= 0 {
+		ttl = defaultJobResultTTL
+	}
+	if maxUploadSize <= 0 {
+		maxUploadSize = defaultJobMaxUploadSize
+	}
+	return &jobQueue{
+		dir:           dir,
+		ttl:           ttl,
+		maxUploadSize: maxUploadSize,
+		workers:       workers,
+		queue:         make(chan *job, size),
+		jobs:          make(map[string]*job),
+	}
+}
+
+// close cancels the queued and running jobs and waits for the workers to
+// stop, jobs are not accepted anymore.
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	for _, j := range q.jobs {
+		switch j.status {
+		case JobQueued:
+			j.status, j.finished = JobCanceled, time.Now()
+			removeUpload(j.path)
+		case JobRunning:
+		default:
+			continue
+		}
+		j.cancel()
+	}
+	close(q.queue)
+	q.mu.Unlock()
+	q.running.Wait()
+}
+
+// handleSubmit spools the upload and queues its job, POST /api/v1/jobs. The
+// input formats and options are the same as of /streaming.
+func (q *jobQueue) handleSubmit(rw http.ResponseWriter, req *http.Request) error {
+	defer closer(req.Body)
+
+	dec, err := StreamingMediaTypes.Decoder(req)
+	if err != nil {
+		return err
+	}
+	if dec.Sums == nil && dec.Tree == nil {
+		return newStatusError(http.StatusUnsupportedMediaType, "content type is not supported by jobs")
+	}
+	params := req.URL.Query()
+	opts, err := parseOptions(params)
+	if err != nil {
+		return err
+	}
+
+	j := &job{
+		dec:     dec,
+		params:  params,
+		opts:    opts,
+		created: time.Now(),
+		status:  JobQueued,
+	}
+	if j.id, err = jobID(); err != nil {
+		return err
+	}
+	// The upload may take longer than the server timeouts allow, the
+	// deadlines are extended by the time it takes at jobUploadMinRate.
+	deadline := time.Now().Add(q.uploadTimeout(req.ContentLength))
+	rc := http.NewResponseController(rw)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		log.Warn("Unable to extend read deadline of job upload", "err", err)
+	}
+	if err := rc.SetWriteDeadline(deadline.Add(jobUploadTimeout)); err != nil {
+		log.Warn("Unable to extend write deadline of job upload", "err", err)
+	}
+	if j.path, j.size, err = q.spool(http.MaxBytesReader(rw, req.Body, q.maxUploadSize)); err != nil {
+		return err
+	}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	if err := q.submit(j); err != nil {
+		j.cancel()
+		removeUpload(j.path)
+		return err
+	}
+
+	rw.Header().Set("Location", "/api/v1/jobs/"+j.id)
+	rw.Header().Set("Content-Type", mediaTypeJSON)
+	rw.WriteHeader(http.StatusAccepted)
+	return jsoniter.NewEncoder(rw).Encode(q.status(j))
+}
+
+// handleStatus returns the status of job, GET /api/v1/jobs/{id}, or cancels
+// it, DELETE /api/v1/jobs/{id}. Queued and running jobs are canceled, finished
+// jobs are dropped with their result.
+func (q *jobQueue) handleStatus(rw http.ResponseWriter, req *http.Request) error {
+	defer closer(req.Body)
+
+	j, err := q.get(mux.Vars(req)["id"])
+	if err != nil {
+		return err
+	}
+	if req.Method == http.MethodDelete {
+		if !q.cancel(j) {
+			rw.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		rw.Header().Set("Content-Type", mediaTypeJSON)
+		rw.WriteHeader(http.StatusAccepted)
+	} else {
+		rw.Header().Set("Content-Type", mediaTypeJSON)
+	}
+	return jsoniter.NewEncoder(rw).Encode(q.status(j))
+}
+
+// handleResult returns the result of finished job, GET /api/v1/jobs/{id}/result,
+// in any output format of /buffered. Failed jobs return their error.
+func (q *jobQueue) handleResult(rw http.ResponseWriter, req *http.Request) error {
+	defer closer(req.Body)
+
+	enc, mediaType, err := BufferedMediaTypes.Encoder(req)
+	if err != nil {
+		return err
+	}
+	j, err := q.get(mux.Vars(req)["id"])
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	status, jobErr, res := j.status, j.err, j.res
+	q.mu.Unlock()
+	switch status {
+	case JobDone:
+	case JobFailed:
+		return jobErr
+	default:
+		return newStatusError(http.StatusConflict, "job is %s, result is not available", status)
+	}
+
+	setSkipped(rw, &res)
+	rw.Header().Set("Content-Type", mediaType)
+	return enc(rw, req, &res)
+}
+
+// spool writes the upload to a temporary file, so that the request can end
+// before the job runs.
+func (q *jobQueue) spool(body io.Reader) (path string, size int64, err error) {
+	f, err := ioutil.TempFile(q.dir, "job")
+	if err != nil {
+		return "", 0, errors.Wrap(err, "unable to store upload")
+	}
+	size, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeUpload(f.Name())
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return "", 0, newStatusError(http.StatusRequestEntityTooLarge, "upload is larger than %d bytes", q.maxUploadSize)
+		}
+		return "", 0, errors.Wrap(badRequest(err), "unable to read upload")
+	}
+	return f.Name(), size, nil
+}
+
+// uploadTimeout returns how long the upload of size bytes may take, the
+// largest upload allowed when the size is not known.
+func (q *jobQueue) uploadTimeout(size int64) time.Duration {
+	if size < 0 || size > q.maxUploadSize {
+		size = q.maxUploadSize
+	}
+	return jobUploadTimeout + time.Duration(size/jobUploadMinRate)*time.Second
+}
+
+// removeUpload removes the spooled upload, the error is only logged.
+func removeUpload(path string) {
+	if err := os.Remove(path); err != nil {
+		log.Warn("Unable to remove job upload", "path", path, "err", err)
+	}
+}
+
+// submit queues the job, 503 error when the queue is full or closed. The
+// workers are started with the first job.
+func (q *jobQueue) submit(j *job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return newStatusError(http.StatusServiceUnavailable, "job queue is closed")
+	}
+	if !q.started {
+		q.started = true
+		q.running.Add(q.workers)
+		for i := 0; i < q.workers; i++ {
+			go func() {
+				defer q.running.Done()
+				for j := range q.queue {
+					q.run(j)
+				}
+			}()
+		}
+	}
+	q.expire(time.Now())
+	select {
+	case q.queue <- j:
+		q.jobs[j.id] = j
+		return nil
+	default:
+		return newStatusError(http.StatusServiceUnavailable, "job queue is full, try again later")
+	}
+}
+
+// get returns the job of given id, 404 error when it does not exist or it
+// expired.
+func (q *jobQueue) get(id string) (*job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(time.Now())
+	j, ok := q.jobs[id]
+	if !ok {
+		return nil, newStatusError(http.StatusNotFound, "job %q not found", id)
+	}
+	return j, nil
+}
+
+// cancel cancels queued or running job and returns true, finished job is
+// dropped and false is returned. Running job is marked canceled once its
+// worker stops.
+func (q *jobQueue) cancel(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch j.status {
+	case JobQueued:
+		// The worker skips it.
+		j.status, j.finished = JobCanceled, time.Now()
+		removeUpload(j.path)
+	case JobRunning:
+	default:
+		delete(q.jobs, j.id)
+		return false
+	}
+	j.cancel()
+	return true
+}
+
+// run processes the job unless it was canceled while queued.
+func (q *jobQueue) run(j *job) {
+	q.mu.Lock()
+	if j.status != JobQueued {
+		q.mu.Unlock()
+		return
+	}
+	j.status = JobRunning
+	q.mu.Unlock()
+
+	res, err := j.compute()
+	removeUpload(j.path)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j.finished = time.Now()
+	switch {
+	case j.ctx.Err() != nil:
+		j.status = JobCanceled
+	case err != nil:
+		j.status, j.err = JobFailed, err
+	default:
+		j.status, j.res = JobDone, res
+	}
+	j.cancel()
+}
+
+// compute aggregates the spooled upload.
+func (j *job) compute() (Result, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "unable to read upload")
+	}
+	defer closer(f)
+
+	facets, err := j.dec.facets(newProgressReader(j.ctx, f, &j.progress), j.params, j.opts)
+	if err != nil {
+		return Result{}, err
+	}
+	return j.opts.result(facets)
+}
+
+// status returns the status of job.
+func (q *jobQueue) status(j *job) JobJSON {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := JobJSON{
+		ID:          j.id,
+		Status:      j.status,
+		BytesTotal:  j.size,
+		BytesParsed: j.progress.Bytes(),
+		NodesSeen:   j.progress.Nodes(),
+		Created:     j.created,
+	}
+	if j.err != nil {
+		out.Error = j.err.Error()
+	}
+	if !j.finished.IsZero() {
+		finished, expires := j.finished, j.finished.Add(q.ttl)
+		out.Finished, out.Expires = &finished, &expires
+	}
+	return out
+}
+
+// expire drops the jobs finished more than ttl ago.
+func (q *jobQueue) expire(now time.Time) {
+	for id, j := range q.jobs {
+		if !j.finished.IsZero() && now.After(j.finished.Add(q.ttl)) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// jobID returns random job id.
+func jobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,181 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// submitJob posts body as a new job and returns its id.
+func submitJob(t *testing.T, router http.Handler, query, body string) string {
+	rr := request(t, router, "POST", "/api/v1/jobs"+query, body)
+	if !assert.Equal(t, http.StatusAccepted, rr.Code, "status code differs") {
+		t.FailNow()
+	}
+	var job api.JobJSON
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/api/v1/jobs/"+job.ID, rr.Header().Get("Location"), "location differs")
+	return job.ID
+}
+
+// waitJob polls the status of job until it is finished.
+func waitJob(t *testing.T, router http.Handler, id string) api.JobJSON {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rr := request(t, router, "GET", "/api/v1/jobs/"+id, "")
+		if !assert.Equal(t, http.StatusOK, rr.Code, "status code differs") {
+			t.FailNow()
+		}
+		var job api.JobJSON
+		if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.Finished != nil {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not finish, status %s", id, job.Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// largeBody returns document with n leaves.
+func largeBody(n int) string {
+	leaves := make([]string, n)
+	for i := range leaves {
+		leaves[i] = fmt.Sprintf(`"facet%d": {"count": %d}`, i, i)
+	}
+	return `{"data": {"facet1": {` + strings.Join(leaves, ", ") + `}}}`
+}
+
+func TestJob(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	defer router.Close()
+	id := submitJob(t, router, "", testBody)
+
+	job := waitJob(t, router, id)
+	assert.Equal(t, api.JobDone, job.Status, "job status differs")
+	assert.Equal(t, int64(len(testBody)), job.BytesTotal, "bytes total differ")
+	assert.Equal(t, job.BytesTotal, job.BytesParsed, "bytes parsed differ")
+	assert.Equal(t, int64(7), job.NodesSeen, "nodes seen differ")
+	assert.NotNil(t, job.Expires, "expiration is missing")
+
+	rr := request(t, router, "GET", "/api/v1/jobs/"+id+"/result", "")
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.JSONEq(t, expectedOutput, rr.Body.String(), "response body differs")
+
+	// Options are given with the upload.
+	id = submitJob(t, router, "?select=facet1/facet3/facet4&sort=count_desc", testBody)
+	waitJob(t, router, id)
+	rr = request(t, router, "GET", "/api/v1/jobs/"+id+"/result", "")
+	assert.JSONEq(t, `{"result": [{"facet4": 50}, {"facet7": 30}, {"facet6": 20}]}`, rr.Body.String(), "response body differs")
+
+	// Finished jobs are dropped.
+	rr = request(t, router, "DELETE", "/api/v1/jobs/"+id, "")
+	assert.Equal(t, http.StatusNoContent, rr.Code, "status code differs")
+	rr = request(t, router, "GET", "/api/v1/jobs/"+id, "")
+	assert.Equal(t, http.StatusNotFound, rr.Code, "status code differs")
+}
+
+func TestJobFailed(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	defer router.Close()
+	rr := request(t, router, "POST", "/api/v1/jobs?metrics=unknown", testBody)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+
+	id := submitJob(t, router, "", `{"data": {"facet1": {"count": "1"}}}`)
+	job := waitJob(t, router, id)
+	assert.Equal(t, api.JobFailed, job.Status, "job status differs")
+	assert.Contains(t, job.Error, "count value is invalid type string", "job error differs")
+
+	rr = request(t, router, "GET", "/api/v1/jobs/"+id+"/result", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+}
+
+func TestJobCancel(t *testing.T) {
+	router := api.NewRouter(api.Config{JobWorkers: 1})
+	defer router.Close()
+	running := submitJob(t, router, "", largeBody(200000))
+	queued := submitJob(t, router, "", testBody)
+
+	for _, id := range []string{queued, running} {
+		rr := request(t, router, "DELETE", "/api/v1/jobs/"+id, "")
+		assert.Equal(t, http.StatusAccepted, rr.Code, "status code differs")
+	}
+	for _, id := range []string{queued, running} {
+		job := waitJob(t, router, id)
+		assert.Equal(t, api.JobCanceled, job.Status, "job status differs")
+		rr := request(t, router, "GET", "/api/v1/jobs/"+id+"/result", "")
+		assert.Equal(t, http.StatusConflict, rr.Code, "status code differs")
+	}
+}
+
+func TestJobExpired(t *testing.T) {
+	router := api.NewRouter(api.Config{JobResultTTL: 200 * time.Millisecond})
+	defer router.Close()
+	id := submitJob(t, router, "", testBody)
+	waitJob(t, router, id)
+
+	time.Sleep(300 * time.Millisecond)
+	rr := request(t, router, "GET", "/api/v1/jobs/"+id+"/result", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code, "status code differs")
+}
+
+func TestJobUploadLimit(t *testing.T) {
+	router := api.NewRouter(api.Config{JobMaxUploadSize: 10})
+	defer router.Close()
+	rr := request(t, router, "POST", "/api/v1/jobs", testBody)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, "status code differs")
+	assert.Contains(t, rr.Body.String(), "upload is larger than 10 bytes", "response body differs")
+}
+
+func TestJobSlowUpload(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	defer router.Close()
+	server := httptest.NewUnstartedServer(router)
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// The upload takes longer than the server read timeout.
+	r, w := io.Pipe()
+	go func() {
+		for _, chunk := range []string{testBody[:10], testBody[10:20], testBody[20:]} {
+			io.WriteString(w, chunk)
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Close()
+	}()
+	resp, err := http.Post(server.URL+"/api/v1/jobs", "application/json", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode, "status code differs")
+}
+
+func TestJobClose(t *testing.T) {
+	router := api.NewRouter(api.Config{JobWorkers: 1})
+	running := submitJob(t, router, "", largeBody(200000))
+	queued := submitJob(t, router, "", testBody)
+	assert.NoError(t, router.Close(), "close error differs")
+
+	for _, id := range []string{queued, running} {
+		job := waitJob(t, router, id)
+		assert.Equal(t, api.JobCanceled, job.Status, "job status differs")
+	}
+	rr := request(t, router, "POST", "/api/v1/jobs", testBody)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "status code differs")
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/json-iterator/go"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultLiveIdleTimeout    = time.Minute
+	defaultLiveMaxMessageSize = 1 << 20 // 1 MiB
+	// liveWriteTimeout closes connections of clients which do not read
+	// the updates.
+	liveWriteTimeout = 10 * time.Second
+)
+
+// LiveMessageJSON represents incoming message of live session, either facet
+// document or leaf deltas.
+type LiveMessageJSON struct {
+	Data   *Node   `json:"data"`
+	Deltas []Delta `json:"deltas"`
+}
+
+// LiveUpdateJSON represents outgoing update of live session, the facets whose
+// totals changed by the message, or the error when it was rejected.
+type LiveUpdateJSON struct {
+	Seq     int             `json:"seq"`
+	Changed []LiveFacetJSON `json:"changed,omitempty"`
+	Error   *errJSON        `json:"error,omitempty"`
+}
+
+// LiveFacetJSON is changed facet of live session.
+type LiveFacetJSON struct {
+	Name  string  `json:"name"`
+	Path  string  `json:"path"`
+	Count float64 `json:"count"`
+}
+
+// LiveHandler returns WebSocket handler of live sessions, GET /api/v1/live.
+// Every session keeps its own tree, each text message adds a facet document
+// {"data": {...}} or deltas {"deltas": [...]} (as PATCH of datasets) to it and
+// is answered with the changed facet totals. Messages are processed one at a
+// time, the next one is not read until the update is written, so clients
+// sending faster than they read are slowed down by TCP. Sessions without
+// messages for idleTimeout are closed, messages are limited to maxSize bytes.
+// Browsers are allowed from the origin of the request host or from
+// allowedOrigins. Zero values select the defaults.
+func LiveHandler(idleTimeout time.Duration, maxSize int64, allowedOrigins []string) func(http.ResponseWriter, *http.Request) error {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultLiveIdleTimeout
+	}
+	if maxSize <= 0 {
+		maxSize = defaultLiveMaxMessageSize
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		c, err := upgradeWebSocket(rw, req, allowedOrigins, maxSize, liveWriteTimeout)
+		if err != nil {
+			return err
+		}
+		// The response is hijacked, errors can't be returned from now on.
+		s := &liveSession{ds: newDataset(&Node{}), sent: make(map[string]float64)}
+		code, reason := s.serve(c, idleTimeout)
+		if code == 0 {
+			err = c.conn.Close()
+		} else {
+			err = c.close(code, reason)
+		}
+		if err != nil {
+			log.Warn("Unable to close live session", "err", err)
+		}
+		return nil
+	}
+}
+
+// liveSession is the running tree of one connection, sent are the totals the
+// client was last sent.
+type liveSession struct {
+	ds   *dataset
+	seq  int
+	sent map[string]float64 // path key -> count
+}
+
+// serve processes the messages until the connection ends, it returns the
+// close code and reason, 0 when client closed the connection.
+func (s *liveSession) serve(c *wsConn, idleTimeout time.Duration) (uint16, string) {
+	for {
+		if err := c.conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return wsCloseInternal, "internal error"
+		}
+		opcode, message, err := c.readMessage()
+		if err != nil {
+			if e, ok := err.(*wsError); ok {
+				return e.code, e.reason
+			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return wsCloseGoingAway, "idle timeout"
+			}
+			if err != errWSClosed {
+				log.Debug("Live session ended", "err", err)
+			}
+			return 0, ""
+		}
+		if opcode != wsText {
+			return wsCloseUnsupported, "only text messages are supported"
+		}
+
+		b, err := jsoniter.Marshal(s.update(message))
+		if err != nil {
+			return wsCloseInternal, "internal error"
+		}
+		if err := c.writeFrame(wsText, b); err != nil {
+			return wsCloseGoingAway, "write timeout"
+		}
+	}
+}
+
+// update applies the message and returns the changed totals.
+func (s *liveSession) update(message []byte) LiveUpdateJSON {
+	s.seq++
+	out := LiveUpdateJSON{Seq: s.seq}
+
+	deltas, err := liveDeltas(message)
+	if err == nil {
+		err = s.ds.patch(deltas)
+	}
+	if err != nil {
+		e := newErrJSON(err)
+		out.Error = &e
+		return out
+	}
+
+	for _, f := range s.ds.rollup() {
+		key := pathKey(f.Path)
+		if count, ok := s.sent[key]; ok && count == f.Count {
+			continue
+		}
+		s.sent[key] = f.Count
+		out.Changed = append(out.Changed, LiveFacetJSON{Name: f.Name, Path: key, Count: f.Count})
+	}
+	return out
+}
+
+// liveDeltas returns the deltas of message, leaves of facet document are
+// deltas of their counts.
+func liveDeltas(message []byte) ([]Delta, error) {
+	var msg LiveMessageJSON
+	if err := jsoniter.Unmarshal(message, &msg); err != nil {
+		return nil, errors.Wrap(badRequest(err), "unable to parse message")
+	}
+	if msg.Data == nil {
+		if msg.Deltas == nil {
+			return nil, newStatusError(http.StatusBadRequest, "message has neither data nor deltas")
+		}
+		return msg.Deltas, nil
+	}
+
+	var (
+		deltas  []Delta
+		invalid []InvalidLeaf
+		walk    func(n *Node, path []string)
+	)
+	walk = func(n *Node, path []string) {
+		for _, child := range n.Children {
+			childPath := append(path[:len(path):len(path)], child.Name)
+			switch {
+			case strings.Contains(child.Name, "/"):
+				invalid = append(invalid, InvalidLeaf{Path: pathKey(childPath), Reason: `facet name contains "/"`})
+			case len(child.Children) == 0:
+				deltas = append(deltas, Delta{Path: pathKey(childPath), Delta: child.Count})
+			default:
+				walk(child, childPath)
+			}
+		}
+	}
+	walk(msg.Data, nil)
+	if len(invalid) > 0 {
+		return nil, &ValidationError{Leaves: invalid}
+	}
+	return append(deltas, msg.Deltas...), nil
+}
@@ -0,0 +1,244 @@
+package api_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// wsClient is minimal WebSocket client of the live endpoint.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialLive opens live session of server.
+func dialLive(t *testing.T, server *httptest.Server) *wsClient {
+	return dialLiveOrigin(t, server, "")
+}
+
+// dialLiveOrigin opens live session of server as web page of origin, none
+// when empty.
+func dialLiveOrigin(t *testing.T, server *httptest.Server, origin string) *wsClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if origin != "" {
+		origin = "Origin: " + origin + "\r\n"
+	}
+	io.WriteString(conn, "GET /api/v1/live HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		origin+"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	c := &wsClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode, "status code differs")
+	// The example of RFC 6455.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"), "accept key differs")
+	return c
+}
+
+// send writes masked frame.
+func (c *wsClient) send(opcode byte, fin bool, payload string) {
+	header := []byte{opcode, 0x80}
+	if fin {
+		header[0] |= 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		header[1] |= byte(len(payload))
+	default:
+		header[1] |= 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	masked := []byte(payload)
+	for i := range masked {
+		masked[i] ^= mask[i%4]
+	}
+	if _, err := c.conn.Write(append(append(header, mask...), masked...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read reads unfragmented frame.
+func (c *wsClient) read() (opcode byte, payload []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		c.t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			c.t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(b))
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// update sends text message and returns the update it is answered with.
+func (c *wsClient) update(message string) map[string]interface{} {
+	c.send(0x1, true, message)
+	opcode, payload := c.read()
+	assert.Equal(c.t, byte(0x1), opcode, "opcode differs")
+	var out map[string]interface{}
+	if err := json.Unmarshal(payload, &out); err != nil {
+		c.t.Fatal(err)
+	}
+	return out
+}
+
+// closed reads close frame and returns its code and reason.
+func (c *wsClient) closed() (uint16, string) {
+	opcode, payload := c.read()
+	assert.Equal(c.t, byte(0x8), opcode, "opcode differs")
+	if len(payload) < 2 {
+		return 0, ""
+	}
+	return binary.BigEndian.Uint16(payload), string(payload[2:])
+}
+
+func TestLive(t *testing.T) {
+	server := httptest.NewServer(api.NewRouter(api.Config{}))
+	defer server.Close()
+	c := dialLive(t, server)
+	defer c.conn.Close()
+
+	assert.Equal(t, map[string]interface{}{"seq": 1.0, "changed": []interface{}{
+		map[string]interface{}{"name": "facet1", "path": "facet1", "count": 100.0},
+		map[string]interface{}{"name": "facet3", "path": "facet1/facet3", "count": 100.0},
+		map[string]interface{}{"name": "facet4", "path": "facet1/facet3/facet4", "count": 50.0},
+		map[string]interface{}{"name": "facet6", "path": "facet1/facet3/facet4/facet6", "count": 20.0},
+		map[string]interface{}{"name": "facet7", "path": "facet1/facet3/facet4/facet7", "count": 30.0},
+		map[string]interface{}{"name": "facet5", "path": "facet1/facet3/facet5", "count": 50.0},
+		map[string]interface{}{"name": "facet2", "path": "facet2", "count": 0.0},
+	}}, c.update(testBody), "update differs")
+
+	// Only the changed totals are sent.
+	assert.Equal(t, map[string]interface{}{"seq": 2.0, "changed": []interface{}{
+		map[string]interface{}{"name": "facet1", "path": "facet1", "count": 105.0},
+		map[string]interface{}{"name": "facet3", "path": "facet1/facet3", "count": 105.0},
+		map[string]interface{}{"name": "facet5", "path": "facet1/facet3/facet5", "count": 55.0},
+	}}, c.update(`{"deltas": [{"path": "facet1/facet3/facet5", "delta": 5}]}`), "update differs")
+
+	// Rejected messages do not end the session.
+	update := c.update(`{"deltas": [{"path": "facet1/facet3", "delta": 1}]}`)
+	assert.Equal(t, 3.0, update["seq"], "seq differs")
+	assert.Equal(t, 400.0, update["error"].(map[string]interface{})["status_code"], "error differs")
+	update = c.update(`{"data": {"facet2": {"count": 1}}}`)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "facet2", "path": "facet2", "count": 1.0},
+	}, update["changed"], "update differs")
+
+	// Pings are answered, fragments are joined.
+	c.send(0x9, true, "ping")
+	opcode, payload := c.read()
+	assert.Equal(t, byte(0xa), opcode, "opcode differs")
+	assert.Equal(t, "ping", string(payload), "pong differs")
+	c.send(0x1, false, `{"deltas": [{"path": "facet2", `)
+	c.send(0x9, true, "")
+	c.read()
+	c.send(0x0, true, `"delta": 1}]}`)
+	_, payload = c.read()
+	assert.JSONEq(t, `{"seq": 5, "changed": [{"name": "facet2", "path": "facet2", "count": 2}]}`, string(payload), "update differs")
+
+	c.send(0x8, true, "\x03\xe8")
+	code, _ := c.closed()
+	assert.Equal(t, uint16(1000), code, "close code differs")
+}
+
+func TestLiveClose(t *testing.T) {
+	server := httptest.NewServer(api.NewRouter(api.Config{LiveIdleTimeout: 50 * time.Millisecond, LiveMaxMessageSize: 64}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		send   func(c *wsClient)
+		code   uint16
+		reason string
+	}{
+		{"idle", func(c *wsClient) {}, 1001, "idle timeout"},
+		{"too big", func(c *wsClient) { c.send(0x1, true, strings.Repeat(" ", 65)) }, 1009, "message is too big"},
+		{"binary", func(c *wsClient) { c.send(0x2, true, testBody[:10]) }, 1003, "only text messages are supported"},
+		{"invalid utf-8", func(c *wsClient) { c.send(0x1, true, "\xff") }, 1007, "text message is not valid UTF-8"},
+		{"continuation", func(c *wsClient) { c.send(0x0, true, "{}") }, 1002, "continuation without message"},
+		{"close of 1 byte", func(c *wsClient) { c.send(0x8, true, "\x03") }, 1002, "invalid close frame"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialLive(t, server)
+			defer c.conn.Close()
+			tt.send(c)
+			code, reason := c.closed()
+			assert.Equal(t, tt.code, code, "close code differs")
+			assert.Equal(t, tt.reason, reason, "close reason differs")
+		})
+	}
+}
+
+func TestLiveHandshake(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	tests := []struct {
+		name    string
+		headers map[string]string
+		code    int
+	}{
+		{"not upgrade", map[string]string{}, http.StatusBadRequest},
+		{"version", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+		{"origin", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Origin": "https://evil.example"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/api/v1/live", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code, "status code differs")
+		})
+	}
+}
+
+func TestLiveOrigin(t *testing.T) {
+	server := httptest.NewServer(api.NewRouter(api.Config{LiveAllowedOrigins: []string{"https://example.com"}}))
+	defer server.Close()
+
+	// The origin of the API and the allowed ones are accepted.
+	for _, origin := range []string{"http://localhost", "https://EXAMPLE.com"} {
+		t.Run(origin, func(t *testing.T) {
+			c := dialLiveOrigin(t, server, origin)
+			defer c.conn.Close()
+			assert.Equal(t, 1.0, c.update(`{"deltas": []}`)["seq"], "seq differs")
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// mediaTypeJSON is the default input and output media type.
+	mediaTypeJSON = "application/json"
+)
+
+// Decoder parses request body of one media type, format options are passed
+// in params (request query).
+// Tree builds the whole facet tree and is used by the buffered handler.
+// Sums computes facet sums directly while reading the body and is used by the
+// streaming handler, which falls back to Tree+Facets when Sums is not set.
+// Both pass the leaf counts to v, which records the invalid leaves, they are
+// left out of the result. Exact is true when they read the counts exactly in
+// the exact numbers mode, requests asking for it are rejected otherwise.
+type Decoder struct {
+	Tree  func(r io.Reader, params url.Values, v *Validator) (*Node, error)
+	Sums  func(r io.Reader, params url.Values, v *Validator) ([]Facet, error)
+	Exact bool
+}
+
+// Encoder writes the computed facets in its media type, output options may be
+// read from the request.
+type Encoder func(io.Writer, *http.Request, *Result) error
+
+// MediaTypes is a registry of input and output media types supported by a route.
+// Each route has its own registry, so that formats can be plugged in only where
+// they make sense.
+type MediaTypes struct {
+	decoders map[string]Decoder
+	encoders map[string]Encoder
+	// defaultOutput is used when client accepts anything.
+	defaultOutput string
+}
+
+// NewMediaTypes returns empty registry, defaultOutput is the media type used
+// when client does not send Accept header or accepts anything.
+func NewMediaTypes(defaultOutput string) *MediaTypes {
+	return &MediaTypes{
+		decoders:      make(map[string]Decoder),
+		encoders:      make(map[string]Encoder),
+		defaultOutput: defaultOutput,
+	}
+}
+
+// RegisterInput adds request media type (e.g. "application/json") to the registry.
+func (m *MediaTypes) RegisterInput(mediaType string, dec Decoder) {
+	m.decoders[strings.ToLower(mediaType)] = dec
+}
+
+// RegisterOutput adds response media type to the registry.
+func (m *MediaTypes) RegisterOutput(mediaType string, enc Encoder) {
+	m.encoders[strings.ToLower(mediaType)] = enc
+}
+
+// Inputs returns sorted list of registered request media types.
+func (m *MediaTypes) Inputs() (mediaTypes []string) {
+	for mediaType := range m.decoders {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	return
+}
+
+// Outputs returns sorted list of registered response media types.
+func (m *MediaTypes) Outputs() (mediaTypes []string) {
+	for mediaType := range m.encoders {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	return
+}
+
+// Decoder returns decoder for request Content-Type. Missing Content-Type
+// is treated as JSON, since that is what clients have always sent.
+func (m *MediaTypes) Decoder(req *http.Request) (Decoder, error) {
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = mediaTypeJSON
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return Decoder{}, newStatusError(http.StatusUnsupportedMediaType, "invalid content type %q: %s", contentType, err)
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return Decoder{}, newStatusError(http.StatusUnsupportedMediaType, "unsupported charset %q, only utf-8 is supported", charset)
+	}
+	dec, ok := m.decoders[mediaType]
+	if !ok {
+		return Decoder{}, newStatusError(
+			http.StatusUnsupportedMediaType,
+			"unsupported content type %q, supported: %s", mediaType, strings.Join(m.Inputs(), ", "),
+		)
+	}
+	if !dec.Exact {
+		if err := floatNumbers(req.URL.Query(), fmt.Sprintf("content type %q", mediaType)); err != nil {
+			return Decoder{}, err
+		}
+	}
+	return dec, nil
+}
+
+// Encoder picks the response encoder using the "format" query parameter
+// (e.g. ?format=csv) or the request Accept header and returns it along with
+// the chosen media type.
+func (m *MediaTypes) Encoder(req *http.Request) (Encoder, string, error) {
+	mediaType, err := negotiate(req, m.Outputs(), m.defaultOutput)
+	if err != nil {
+		return nil, "", err
+	}
+	return m.encoders[mediaType], mediaType, nil
+}
+
+// ParseTree parses facet tree of given media type using the registered
+// decoder, it is used outside of HTTP handlers (e.g. command line). Leaves
+// are validated in the ?validation= mode of params, skipped leaves are lost.
+func (m *MediaTypes) ParseTree(r io.Reader, mediaType string, params url.Values) (*Node, error) {
+	dec, ok := m.decoders[strings.ToLower(mediaType)]
+	if !ok || dec.Tree == nil {
+		return nil, errors.Errorf("unsupported media type %q, supported: %s", mediaType, strings.Join(m.Inputs(), ", "))
+	}
+	v, err := NewValidator(params)
+	if err != nil {
+		return nil, err
+	}
+	node, err := dec.Tree(r, params, v)
+	if err != nil {
+		return nil, err
+	}
+	return node, v.Err()
+}
+
+// negotiate picks one of the offered response media types using the "format"
+// query parameter or the request Accept header, defaultType is used when
+// client accepts anything.
+func negotiate(req *http.Request, offered []string, defaultType string) (string, error) {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return formatMediaType(format, offered)
+	}
+
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return defaultType, nil
+	}
+
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := parseQuality(part)
+		if q <= 0 || q <= bestQ {
+			continue
+		}
+		switch {
+		case mediaType == "*/*":
+			mediaType = defaultType
+		case strings.HasSuffix(mediaType, "/*"):
+			mediaType = matchPrefix(strings.TrimSuffix(mediaType, "*"), offered, defaultType)
+		}
+		if contains(offered, mediaType) {
+			best, bestQ = mediaType, q
+		}
+	}
+	if best == "" {
+		return "", newStatusError(
+			http.StatusNotAcceptable,
+			"no acceptable media type in %q, supported: %s", accept, strings.Join(offered, ", "),
+		)
+	}
+	return best, nil
+}
+
+// formatMediaType finds offered media type by its subtype, so that
+// format "csv" selects "text/csv".
+func formatMediaType(format string, offered []string) (string, error) {
+	format = strings.ToLower(format)
+	for _, mediaType := range offered {
+		if mediaType[strings.Index(mediaType, "/")+1:] == format {
+			return mediaType, nil
+		}
+	}
+	return "", newStatusError(
+		http.StatusNotAcceptable,
+		"unsupported format %q, supported: %s", format, strings.Join(offered, ", "),
+	)
+}
+
+// matchPrefix returns the defaultType if it starts with prefix, or the
+// first offered media type that does.
+func matchPrefix(prefix string, offered []string, defaultType string) string {
+	if strings.HasPrefix(defaultType, prefix) {
+		return defaultType
+	}
+	for _, mediaType := range offered {
+		if strings.HasPrefix(mediaType, prefix) {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// contains returns true if s is in list.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// badRequest marks decoding errors as user errors (400), unless the error
+// already carries its own status code.
+func badRequest(err error) error {
+	if _, ok := errors.Cause(err).(Error); ok {
+		return err
+	}
+	return statusError{error: err, code: http.StatusBadRequest}
+}
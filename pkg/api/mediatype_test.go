@@ -0,0 +1,54 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentTypeNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		accept      string
+		body        string
+		status      int
+	}{
+		{"json", "application/json; charset=utf-8", "application/json", testBody, http.StatusOK},
+		{"no content type", "", "", testBody, http.StatusOK},
+		{"accept anything", "application/json", "text/html;q=0.9, */*;q=0.1", testBody, http.StatusOK},
+		{"form post", "application/x-www-form-urlencoded", "", "data=1", http.StatusUnsupportedMediaType},
+		{"plain text", "text/plain", "", testBody, http.StatusUnsupportedMediaType},
+		{"latin1 charset", "application/json; charset=iso-8859-1", "", testBody, http.StatusUnsupportedMediaType},
+		{"not acceptable", "application/json", "text/html", testBody, http.StatusNotAcceptable},
+		{"malformed json", "application/json", "", `{"data": {`, http.StatusBadRequest},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.contentType != "" {
+					req.Header.Set("Content-Type", tt.contentType)
+				}
+				if tt.accept != "" {
+					req.Header.Set("Accept", tt.accept)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, tt.status, rr.Code, "status code differs")
+				assert.Equal(t, "application/json", rr.Header().Get("Content-Type"), "content type differs")
+			})
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+// Conflict is a structural difference found while merging trees, e.g. a facet
+// which is a leaf in one tree and has children in another.
+type Conflict struct {
+	Path     string `json:"path"`
+	Document int    `json:"document"`
+	Message  string `json:"message"`
+}
+
+// MergeOutputJSON represents outgoing merged tree, its computed facets and
+// conflicts found while merging. Data has the input format, so it may be
+// sent to other endpoints again.
+type MergeOutputJSON struct {
+	Data      *Node         `json:"data"`
+	Result    []facetValues `json:"result"`
+	Conflicts []Conflict    `json:"conflicts"`
+}
+
+// MergeHandler merges many facet documents of the same taxonomy into one tree.
+// Documents are sent the same way as to BatchHandler (JSON array or NDJSON of
+// {"data": {...}} objects), names are optional. Both the merged tree and its
+// facets are ordered by ?sort= option.
+func MergeHandler(rw http.ResponseWriter, req *http.Request) error {
+	var (
+		trees []*Node
+	)
+	defer closer(req.Body)
+
+	ndjson, err := batchContentType(req)
+	if err != nil {
+		return err
+	}
+	// Documents are read as floats.
+	if err := floatNumbers(req.URL.Query(), "merge"); err != nil {
+		return err
+	}
+	order, err := parseSort(req.URL.Query().Get("sort"))
+	if err != nil {
+		return err
+	}
+
+	err = decodeBatch(req.Body, ndjson, func(index int, doc batchDocument) error {
+		if doc.err != nil {
+			return doc.err
+		}
+		var root Node
+		if len(doc.Data) > 0 {
+			if err := jsoniter.Unmarshal(doc.Data, &root); err != nil {
+				return errors.Wrapf(err, "error parsing document %d", index)
+			}
+		}
+		trees = append(trees, &root)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(badRequest(err), "unable to parse documents")
+	}
+
+	merged, conflicts := MergeTrees(trees)
+	sortNodes(merged, order)
+	facets := merged.Facets()
+	sortFacets(facets, order)
+	out := MergeOutputJSON{
+		Data:      merged,
+		Result:    facetSlice(facets),
+		Conflicts: conflicts,
+	}
+	if out.Conflicts == nil {
+		out.Conflicts = []Conflict{}
+	}
+
+	rw.Header().Set("Content-Type", mediaTypeJSON)
+	return jsoniter.NewEncoder(rw).Encode(&out)
+}
+
+// MergeTrees merges trees by facet paths into a new tree, leaf counts of the
+// same path are summed (series element-wise). When a facet is a leaf in one tree and has children in
+// another, the children win and the conflict is reported.
+// The input trees are not modified.
+func MergeTrees(trees []*Node) (*Node, []Conflict) {
+	var (
+		root      = &Node{}
+		conflicts []Conflict
+	)
+	for i, tree := range trees {
+		conflicts = mergeNode(root, tree, i, nil, conflicts)
+	}
+	return root, conflicts
+}
+
+// mergeNode merges children of src into dst.
+func mergeNode(dst, src *Node, document int, path []string, conflicts []Conflict) []Conflict {
+	children := make(map[string]int, len(dst.Children))
+	for i, child := range dst.Children {
+		children[child.Name] = i
+	}
+
+	for _, srcChild := range src.Children {
+		childPath := append(path[:len(path):len(path)], srcChild.Name)
+		i, ok := children[srcChild.Name]
+		if !ok {
+			children[srcChild.Name] = len(dst.Children)
+			dst.Children = append(dst.Children, srcChild.clone(dst))
+			continue
+		}
+
+		dstChild := dst.Children[i]
+		dstLeaf, srcLeaf := len(dstChild.Children) == 0, len(srcChild.Children) == 0
+		switch {
+		case dstLeaf && srcLeaf:
+			dstChild.Count += srcChild.Count
+			dstChild.Exact = addExact(dstChild.Exact, srcChild.Exact)
+			dstChild.Series = addSeries(dstChild.Series, srcChild.Series)
+		case dstLeaf:
+			conflicts = append(conflicts, Conflict{
+				Path:     strings.Join(childPath, "/"),
+				Document: document,
+				Message:  fmt.Sprintf("facet has children, but it is a leaf with count %s in previous documents", formatFloat(dstChild.Count)),
+			})
+			dst.Children[i] = srcChild.clone(dst)
+		case srcLeaf:
+			conflicts = append(conflicts, Conflict{
+				Path:     strings.Join(childPath, "/"),
+				Document: document,
+				Message:  fmt.Sprintf("facet is a leaf with count %s, but it has children in previous documents", formatFloat(srcChild.Count)),
+			})
+		default:
+			conflicts = mergeNode(dstChild, srcChild, document, childPath, conflicts)
+		}
+	}
+	return conflicts
+}
+
+// clone returns deep copy of n with given parent.
+func (n *Node) clone(parent *Node) *Node {
+	c := &Node{
+		Name:   n.Name,
+		Count:  n.Count,
+		Exact:  n.Exact,
+		Series: addSeries(nil, n.Series),
+		Parent: parent,
+	}
+	if len(n.Children) > 0 {
+		c.Children = make([]*Node, len(n.Children))
+		for i, child := range n.Children {
+			c.Children[i] = child.clone(c)
+		}
+	}
+	return c
+}
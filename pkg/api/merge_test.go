@@ -0,0 +1,76 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeTrees(t *testing.T) {
+	var first, second api.Node
+	err := json.Unmarshal([]byte(`{"facet1": {"facet3": {"count": 10}}, "facet2": {"count": 5}}`), &first)
+	assert.NoError(t, err, "unmarshal should not return error")
+	err = json.Unmarshal([]byte(`{"facet1": {"facet3": {"count": 20}, "facet4": {"count": 1}}, "facet2": {"facet5": {"count": 3}}}`), &second)
+	assert.NoError(t, err, "unmarshal should not return error")
+
+	merged, conflicts := api.MergeTrees([]*api.Node{&first, &second})
+
+	assert.Equal(t, map[string]float64{
+		"facet1": 31,
+		"facet2": 3,
+		"facet3": 30,
+		"facet4": 1,
+		"facet5": 3,
+	}, merged.ToMap(), "merged counts are incorrect")
+	if assert.Equal(t, 1, len(conflicts), "incorrect number of conflicts") {
+		assert.Equal(t, "facet2", conflicts[0].Path, "conflict path is incorrect")
+		assert.Equal(t, 1, conflicts[0].Document, "conflict document is incorrect")
+	}
+	// Inputs are not modified.
+	assert.Equal(t, map[string]float64{
+		"facet1": 10,
+		"facet2": 5,
+		"facet3": 10,
+	}, first.ToMap(), "input tree was modified")
+}
+
+func TestMergeHandler(t *testing.T) {
+	body := `[
+		{"data": {"facet1": {"facet3": {"count": 10}}, "facet2": {"count": 5}}},
+		{"data": {"facet1": {"facet3": {"count": 20}}, "facet2": {"count": 1}}}
+	]`
+	req, err := http.NewRequest("POST", "/api/v1/merge", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.JSONEq(t, `{
+		"data": {"facet1": {"facet3": {"count": 30}}, "facet2": {"count": 6}},
+		"result": [{"facet1": 30}, {"facet2": 6}, {"facet3": 30}],
+		"conflicts": []
+	}`, rr.Body.String(), "response body differs")
+}
+
+func TestMergeHandlerInvalidDocument(t *testing.T) {
+	body := `[{"data": {"facet1": {"count": 10}}}, {"data": {"facet1": {"count": "abc"}}}]`
+	req, err := http.NewRequest("POST", "/api/v1/merge", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+	assert.Contains(t, rr.Body.String(), "document 1", "error message differs")
+}
@@ -0,0 +1,68 @@
+package api
+
+// Derived metrics of facets.
+const (
+	// MetricShareOfParent is facet count divided by its parent's count,
+	// top level facets are divided by the total.
+	MetricShareOfParent = "share_of_parent"
+	// MetricShareOfTotal is facet count divided by the sum of all top level
+	// facets (or roots of the selected subtrees).
+	MetricShareOfTotal = "share_of_total"
+	// MetricShareOfSiblings is facet count divided by the sum of counts of the
+	// facet and its siblings. For well formed trees it is the same as share of
+	// parent, but it differs when parent has its own count besides its children
+	// (streaming handler sums both).
+	MetricShareOfSiblings = "share_of_siblings"
+)
+
+// metricNames are the supported metrics in the output order.
+var metricNames = []string{MetricShareOfParent, MetricShareOfTotal, MetricShareOfSiblings}
+
+// metricValues return the value of the metric of facet, nil when it is not defined.
+var metricValues = map[string]func(*Facet) *float64{
+	MetricShareOfParent:   func(f *Facet) *float64 { return f.ShareOfParent },
+	MetricShareOfTotal:    func(f *Facet) *float64 { return f.ShareOfTotal },
+	MetricShareOfSiblings: func(f *Facet) *float64 { return f.ShareOfSiblings },
+}
+
+// computeShares computes the share metrics of facets from their paths and
+// counts. Shares of zero are not defined (the result is nil), so dashboards
+// can tell "no data" from "0 %".
+func computeShares(facets []Facet) {
+	var (
+		total    float64
+		counts   = make(map[string]float64, len(facets)) // path key -> count
+		siblings = make(map[string]float64)              // parent path key -> sum of children
+	)
+	for i := range facets {
+		f := &facets[i]
+		counts[pathKey(f.Path)] = f.Count
+		siblings[f.parentKey()] += f.Count
+	}
+	for i := range facets {
+		// Roots of selected subtrees are top level facets as well.
+		if _, ok := counts[facets[i].parentKey()]; !ok {
+			total += facets[i].Count
+		}
+	}
+
+	for i := range facets {
+		f := &facets[i]
+		parent, ok := counts[f.parentKey()]
+		if !ok {
+			parent = total
+		}
+		f.ShareOfParent = share(f.Count, parent)
+		f.ShareOfTotal = share(f.Count, total)
+		f.ShareOfSiblings = share(f.Count, siblings[f.parentKey()])
+	}
+}
+
+// share returns count/of, or nil when of is zero.
+func share(count, of float64) *float64 {
+	if of == 0 {
+		return nil
+	}
+	v := count / of
+	return &v
+}
@@ -0,0 +1,95 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareMetrics(t *testing.T) {
+	body := `{"data": {"facet1": {"facet3": {"count": 30}, "facet4": {"count": 10}}, "facet2": {"facet5": {"count": 0}}, "facet6": {"count": 60}}}`
+	expected := `{"result": [
+		{"name": "facet1", "count": 40, "share_of_parent": 0.4, "share_of_total": 0.4, "share_of_siblings": 0.4},
+		{"name": "facet2", "count": 0, "share_of_parent": 0, "share_of_total": 0, "share_of_siblings": 0},
+		{"name": "facet3", "count": 30, "share_of_parent": 0.75, "share_of_total": 0.3, "share_of_siblings": 0.75},
+		{"name": "facet4", "count": 10, "share_of_parent": 0.25, "share_of_total": 0.1, "share_of_siblings": 0.25},
+		{"name": "facet5", "count": 0, "share_of_parent": null, "share_of_total": 0, "share_of_siblings": null},
+		{"name": "facet6", "count": 60, "share_of_parent": 0.6, "share_of_total": 0.6, "share_of_siblings": 0.6}
+	]}`
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		t.Run(strings.TrimPrefix(path, "/api/v1/"), func(t *testing.T) {
+			req, err := http.NewRequest("POST", path+"?metrics=share_of_parent,share_of_total,share_of_siblings", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+			assert.JSONEq(t, expected, rr.Body.String(), "response body differs")
+		})
+	}
+}
+
+func TestShareMetricsCSV(t *testing.T) {
+	body := `{"data": {"facet1": {"facet3": {"count": 0}}, "facet2": {"count": 10}}}`
+	req, err := http.NewRequest("POST", "/api/v1/buffered?format=csv&metrics=share_of_parent", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, `facet,path,depth,parent,count,share_of_parent
+facet1,facet1,1,,0,0
+facet2,facet2,1,,10,1
+facet3,facet1/facet3,2,facet1,0,
+`, rr.Body.String(), "response body differs")
+}
+
+func TestShareMetricsRepeatedNames(t *testing.T) {
+	body := `{"data": {"a": {"p": {"x": {"count": 10}}}, "b": {"p": {"x": {"count": 30}, "y": {"count": 10}}}}}`
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		t.Run(strings.TrimPrefix(path, "/api/v1/"), func(t *testing.T) {
+			req, err := http.NewRequest("POST", path+"?format=csv&metrics=share_of_parent,share_of_siblings", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+			assert.Equal(t, `facet,path,depth,parent,count,share_of_parent,share_of_siblings
+a,a,1,,10,0.2,0.2
+b,b,1,,40,0.8,0.8
+p,a/p,2,a,10,1,1
+p,b/p,2,b,40,1,1
+x,a/p/x,3,p,10,1,1
+x,b/p/x,3,p,30,0.75,0.75
+y,b/p/y,3,p,10,0.25,0.25
+`, rr.Body.String(), "response body differs")
+		})
+	}
+}
+
+func TestUnknownMetric(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/streaming?metrics=share_of_universe", strings.NewReader(testBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+}
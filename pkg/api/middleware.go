@@ -15,10 +15,48 @@ type Error interface {
 	StatusCode() int
 }
 
+// statusError is an error carrying the http status code it should be reported with.
+type statusError struct {
+	error
+	code int
+}
+
+// StatusCode implements Error interface.
+func (e statusError) StatusCode() int {
+	return e.code
+}
+
+// newStatusError returns formatted error which will be sent to user with given
+// http status code.
+func newStatusError(code int, format string, args ...interface{}) error {
+	return statusError{
+		error: errors.Errorf(format, args...),
+		code:  code,
+	}
+}
+
 // errJSON represents JSON error to be sent to user.
 type errJSON struct {
 	StatusCode int    `json:"status_code"`
 	Message    string `json:"error"`
+	// Invalid lists all the invalid leaves of ValidationError.
+	Invalid []InvalidLeaf `json:"invalid,omitempty"`
+}
+
+// newErrJSON returns the JSON of err, with the status code carried by the
+// original cause.
+func newErrJSON(err error) errJSON {
+	e := errJSON{
+		StatusCode: http.StatusInternalServerError,
+		Message:    err.Error(),
+	}
+	if v, ok := errors.Cause(err).(Error); ok {
+		e.StatusCode = v.StatusCode()
+	}
+	if v, ok := errors.Cause(err).(*ValidationError); ok {
+		e.Invalid = v.Leaves
+	}
+	return e
 }
 
 // handler is regular http.Handler but returns error which is processed using
@@ -55,23 +93,9 @@ func ErrHandler(handler handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := handler(w, r)
 		if err != nil {
-			var e errJSON
-
-			switch v := err.(type) {
-			case Error:
-				w.WriteHeader(v.StatusCode())
-				e = errJSON{
-					StatusCode: v.StatusCode(),
-					Message:    v.Error(),
-				}
-			default:
-				w.WriteHeader(http.StatusInternalServerError)
-				e = errJSON{
-					StatusCode: http.StatusInternalServerError,
-					Message:    v.Error(),
-				}
-			}
+			e := newErrJSON(err)
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(e.StatusCode)
 
 			out, err := json.Marshal(e)
 			if err != nil {
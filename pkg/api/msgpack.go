@@ -0,0 +1,345 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeMsgpack = "application/msgpack"
+	// maxMsgpackDepth limits nesting of msgpack documents, as jsoniter does
+	// for JSON.
+	maxMsgpackDepth = 10000
+)
+
+func init() {
+	dec := Decoder{Tree: unmarshalMsgpack}
+	for _, mediaType := range []string{mediaTypeMsgpack, "application/x-msgpack"} {
+		BufferedMediaTypes.RegisterInput(mediaType, dec)
+		StreamingMediaTypes.RegisterInput(mediaType, dec)
+	}
+	BufferedMediaTypes.RegisterOutput(mediaTypeMsgpack, encodeMsgpack)
+	StreamingMediaTypes.RegisterOutput(mediaTypeMsgpack, encodeMsgpack)
+}
+
+// unmarshalMsgpack parses MessagePack document with the same structure as
+// the JSON input, {"data": {"facet1": {"count": 10}}}. All numbers are read
+// as float64, map keys must be strings.
+func unmarshalMsgpack(r io.Reader, _ url.Values, v *Validator) (*Node, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read msgpack body")
+	}
+	rd := msgpackReader{b: b}
+	doc := rd.value()
+	if rd.err == nil && len(rd.b) > 0 {
+		rd.err = errors.New("there are bytes left after the document")
+	}
+	if rd.err != nil {
+		return nil, errors.Wrap(rd.err, "unable to parse msgpack")
+	}
+	object, ok := doc.(documentObject)
+	if !ok {
+		return nil, errors.Errorf("document is invalid type %s, must be map", typeName(doc))
+	}
+	return documentToTree(object, v)
+}
+
+// msgpackReader reads msgpack values into the types read by valueSource,
+// the first error stops the reading.
+type msgpackReader struct {
+	b     []byte
+	depth int
+	err   error
+}
+
+func (r *msgpackReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = errors.Errorf(format, args...)
+	}
+	r.b = nil
+}
+
+// take returns next n bytes.
+func (r *msgpackReader) take(n uint64) []byte {
+	if n > uint64(len(r.b)) {
+		r.fail("unexpected end of document")
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+// uint reads big-endian unsigned integer of size bytes.
+func (r *msgpackReader) uint(size uint64) uint64 {
+	p := r.take(size)
+	var v uint64
+	for _, c := range p {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// value reads the next value.
+func (r *msgpackReader) value() interface{} {
+	p := r.take(1)
+	if p == nil {
+		return nil
+	}
+	switch c := p[0]; {
+	case c <= 0x7f:
+		return float64(c)
+	case c >= 0xe0:
+		return float64(int8(c))
+	case c >= 0x80 && c <= 0x8f:
+		return r.mapValue(uint64(c & 0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return r.array(uint64(c & 0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		return string(r.take(uint64(c & 0x1f)))
+	}
+
+	switch c := p[0]; c {
+	case 0xc0:
+		return nil
+	case 0xc2:
+		return false
+	case 0xc3:
+		return true
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		return append([]byte(nil), r.take(r.uint(1<<(c-0xc4)))...)
+	case 0xca:
+		return float64(math.Float32frombits(uint32(r.uint(4))))
+	case 0xcb:
+		return math.Float64frombits(r.uint(8))
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		return float64(r.uint(1 << (c - 0xcc)))
+	case 0xd0:
+		return float64(int8(r.uint(1)))
+	case 0xd1:
+		return float64(int16(r.uint(2)))
+	case 0xd2:
+		return float64(int32(r.uint(4)))
+	case 0xd3:
+		return float64(int64(r.uint(8)))
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		return string(r.take(r.uint(1 << (c - 0xd9))))
+	case 0xdc, 0xdd: // array 16, 32
+		return r.array(r.uint(2 << (c - 0xdc)))
+	case 0xde, 0xdf: // map 16, 32
+		return r.mapValue(r.uint(2 << (c - 0xde)))
+	}
+	r.fail("unsupported msgpack type 0x%02x", p[0])
+	return nil
+}
+
+// enter checks the nesting of arrays and maps of n elements, every element
+// takes at least one byte.
+func (r *msgpackReader) enter(n uint64) bool {
+	r.depth++
+	switch {
+	case r.err != nil:
+		return false
+	case r.depth > maxMsgpackDepth:
+		r.fail("document is nested too deep")
+		return false
+	case n > uint64(len(r.b)):
+		r.fail("unexpected end of document")
+		return false
+	}
+	return true
+}
+
+func (r *msgpackReader) array(n uint64) interface{} {
+	defer func() { r.depth-- }()
+	if !r.enter(n) {
+		return nil
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		a[i] = r.value()
+	}
+	return a
+}
+
+func (r *msgpackReader) mapValue(n uint64) interface{} {
+	defer func() { r.depth-- }()
+	if !r.enter(2 * n) {
+		return nil
+	}
+	object := make(documentObject, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		key, ok := r.value().(string)
+		if !ok {
+			r.fail("map key is not string")
+			return nil
+		}
+		object = append(object, documentMember{Key: key, Value: r.value()})
+	}
+	return object
+}
+
+// encodeMsgpack writes the result as msgpack map of the same structure as
+// the JSON output, see outputJSON. Counts are float64, exact counts are
+// written as their nearest float.
+func encodeMsgpack(w io.Writer, _ *http.Request, res *Result) error {
+	_, err := w.Write(appendMsgpackResult(nil, res))
+	return err
+}
+
+func appendMsgpackResult(b []byte, res *Result) []byte {
+	objects := len(res.Metrics) > 0 || res.series()
+	fields := 1
+	if res.NextCursor != "" {
+		fields++
+	}
+	if len(res.Skipped) > 0 {
+		fields++
+	}
+
+	b = appendMsgpackMap(b, fields)
+	b = appendMsgpackString(b, "result")
+	b = appendMsgpackArray(b, len(res.Facets))
+	for i := range res.Facets {
+		f := &res.Facets[i]
+		if !objects {
+			b = appendMsgpackMap(b, 1)
+			b = appendMsgpackString(b, f.Name)
+			b = appendMsgpackFloat(b, f.Count)
+			continue
+		}
+		fields := 2 + len(res.Metrics)
+		if f.Series != nil {
+			fields++
+		}
+		b = appendMsgpackMap(b, fields)
+		b = appendMsgpackString(b, "name")
+		b = appendMsgpackString(b, f.Name)
+		b = appendMsgpackString(b, "count")
+		b = appendMsgpackFloat(b, f.Count)
+		if f.Series != nil {
+			b = appendMsgpackString(b, "series")
+			b = appendMsgpackArray(b, len(f.Series))
+			for _, v := range f.Series {
+				b = appendMsgpackFloat(b, v)
+			}
+		}
+		for _, metric := range res.Metrics {
+			b = appendMsgpackString(b, metric)
+			if v := metricValues[metric](f); v != nil {
+				b = appendMsgpackFloat(b, *v)
+			} else {
+				b = append(b, 0xc0)
+			}
+		}
+	}
+
+	if res.NextCursor != "" {
+		b = appendMsgpackString(b, "next_cursor")
+		b = appendMsgpackString(b, res.NextCursor)
+	}
+	if len(res.Skipped) > 0 {
+		b = appendMsgpackString(b, "skipped")
+		b = appendMsgpackArray(b, len(res.Skipped))
+		for _, leaf := range res.Skipped {
+			b = appendMsgpackMap(b, 3)
+			b = appendMsgpackString(b, "path")
+			b = appendMsgpackString(b, leaf.Path)
+			b = appendMsgpackString(b, "value")
+			b = appendMsgpackValue(b, leaf.Value)
+			b = appendMsgpackString(b, "reason")
+			b = appendMsgpackString(b, leaf.Reason)
+		}
+	}
+	return b
+}
+
+// appendMsgpackHeader appends header of type with fixed variant fix (for
+// n < 16, or < 32 for strings) or variants of 8, 16 and 32 bit length.
+func appendMsgpackHeader(b []byte, n int, fix, fixMax byte, variants [3]byte) []byte {
+	switch {
+	case n < int(fixMax):
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint8 && variants[0] != 0:
+		return append(b, variants[0], byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, variants[1]), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, variants[2]), uint32(n))
+}
+
+func appendMsgpackMap(b []byte, n int) []byte {
+	return appendMsgpackHeader(b, n, 0x80, 16, [3]byte{0, 0xde, 0xdf})
+}
+
+func appendMsgpackArray(b []byte, n int) []byte {
+	return appendMsgpackHeader(b, n, 0x90, 16, [3]byte{0, 0xdc, 0xdd})
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	b = appendMsgpackHeader(b, len(s), 0xa0, 32, [3]byte{0xd9, 0xda, 0xdb})
+	return append(b, s...)
+}
+
+func appendMsgpackFloat(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+}
+
+// appendMsgpackValue appends scalar decoded by any of the parsers, objects
+// and arrays are written as nil (InvalidLeaf reports only scalars).
+func appendMsgpackValue(b []byte, value interface{}) []byte {
+	switch t := value.(type) {
+	case bool:
+		if t {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case float64:
+		return appendMsgpackFloat(b, t)
+	case json.Number:
+		v, _ := strconv.ParseFloat(string(t), 64)
+		return appendMsgpackFloat(b, v)
+	case string:
+		return appendMsgpackString(b, t)
+	}
+	return append(b, 0xc0)
+}
+
+// MarshalMsgpack returns the msgpack input document of the tree rooted at n,
+// {"data": {...}}, leaves are {"count": N} maps, or {"count": [N, M]} when
+// they have series.
+func (n *Node) MarshalMsgpack() []byte {
+	b := appendMsgpackMap(nil, 1)
+	b = appendMsgpackString(b, "data")
+	return n.appendMsgpack(b)
+}
+
+func (n *Node) appendMsgpack(b []byte) []byte {
+	if len(n.Children) == 0 && !n.IsRoot() {
+		b = appendMsgpackMap(b, 1)
+		b = appendMsgpackString(b, "count")
+		if n.Series == nil {
+			return appendMsgpackFloat(b, n.Count)
+		}
+		b = appendMsgpackArray(b, len(n.Series))
+		for _, v := range n.Series {
+			b = appendMsgpackFloat(b, v)
+		}
+		return b
+	}
+	b = appendMsgpackMap(b, len(n.Children))
+	for _, child := range n.Children {
+		b = appendMsgpackString(b, child.Name)
+		b = child.appendMsgpack(b)
+	}
+	return b
+}
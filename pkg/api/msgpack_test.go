@@ -0,0 +1,75 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgpack(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	body := parseTree(t, testBody).MarshalMsgpack()
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		rr := binaryRequest(t, router, path, "application/msgpack", "application/json", body)
+		assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+		assert.JSONEq(t, expectedOutput, rr.Body.String(), "response differs")
+	}
+
+	// {"data": {"a": {"count": 1}}} gives {"result": [{"a": 1.0}]}.
+	rr := binaryRequest(t, router, "/api/v1/buffered", "application/x-msgpack", "application/msgpack",
+		[]byte("\x81\xa4data\x81\xa1a\x81\xa5count\x01"))
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, "application/msgpack", rr.Header().Get("Content-Type"), "content type differs")
+	assert.Equal(t, "\x81\xa6result\x91\x81\xa1a\xcb\x3f\xf0\x00\x00\x00\x00\x00\x00", rr.Body.String(), "response differs")
+
+	// Series and skipped leaves use the objects of JSON output.
+	rr = binaryRequest(t, router, "/api/v1/buffered?validation=skip", "application/msgpack", "application/msgpack",
+		[]byte("\x81\xa4data\x82\xa1a\x81\xa5count\x92\x01\x02\xa1b\x81\xa5count\xff"))
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, "\x82"+
+		"\xa6result\x91\x83\xa4name\xa1a\xa5count\xcb\x40\x08\x00\x00\x00\x00\x00\x00\xa6series\x92\xcb\x3f\xf0\x00\x00\x00\x00\x00\x00\xcb\x40\x00\x00\x00\x00\x00\x00\x00"+
+		"\xa7skipped\x91\x83\xa4path\xa1b\xa5value\xcb\xbf\xf0\x00\x00\x00\x00\x00\x00\xa6reason\xb7count value is negative",
+		rr.Body.String(), "response differs")
+}
+
+func TestMsgpackTypes(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	tests := []struct {
+		name     string
+		count    string // msgpack value of "count" of facet "a"
+		code     int
+		expected string
+	}{
+		{"fixint", "\x05", http.StatusOK, `{"result": [{"a": 5}]}`},
+		{"uint16", "\xcd\x01\x2c", http.StatusOK, `{"result": [{"a": 300}]}`},
+		{"uint64", "\xcf\x00\x00\x00\x01\x00\x00\x00\x00", http.StatusOK, `{"result": [{"a": 4294967296}]}`},
+		{"int32", "\xd2\x00\x00\x00\x07", http.StatusOK, `{"result": [{"a": 7}]}`},
+		{"float32", "\xca\x3f\xc0\x00\x00", http.StatusOK, `{"result": [{"a": 1.5}]}`},
+		{"float64", "\xcb\x3f\xb9\x99\x99\x99\x99\x99\x9a", http.StatusOK, `{"result": [{"a": 0.1}]}`},
+		{"negative", "\xd0\xfe", http.StatusBadRequest, "unable to parse facets: 1 invalid leaves: a: count value is negative"},
+		{"string", "\xa2\x31\x30", http.StatusBadRequest, "unable to parse facets: 1 invalid leaves: a: count value is invalid type string"},
+		{"nil", "\xc0", http.StatusBadRequest, "unable to parse facets: 1 invalid leaves: a: count value is invalid type null"},
+		{"extension", "\xd4\x01\x00", http.StatusBadRequest, "unable to parse facets: unable to parse msgpack: unsupported msgpack type 0xd4"},
+		{"truncated", "\xcd\x01", http.StatusBadRequest, "unable to parse facets: unable to parse msgpack: unexpected end of document"},
+		{"trailing", "\x01\x01", http.StatusBadRequest, "unable to parse facets: unable to parse msgpack: there are bytes left after the document"},
+		{"key", "\x81\x01\x01", http.StatusBadRequest, "unable to parse facets: unable to parse msgpack: map key is not string"},
+		{"length", "\xdd\xff\xff\xff\xff", http.StatusBadRequest, "unable to parse facets: unable to parse msgpack: unexpected end of document"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := "\x81\xa4data\x81\xa1a\x81\xa5count" + tt.count
+			rr := binaryRequest(t, router, "/api/v1/buffered", "application/msgpack", "application/json", []byte(body))
+			assert.Equal(t, tt.code, rr.Code, "status code differs")
+			if tt.code == http.StatusOK {
+				assert.JSONEq(t, tt.expected, rr.Body.String(), "response differs")
+			} else {
+				assert.Equal(t, `"`+tt.expected+`"`, jsonField(t, rr.Body.Bytes(), "error"), "error differs")
+			}
+		})
+	}
+}
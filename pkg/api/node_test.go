@@ -151,3 +151,19 @@ func TestSumChildren(t *testing.T) {
 func TestSumChildrenAll(t *testing.T) {
 	assert.Equal(t, float64(100), testNode(t).SumChildren(), "children sum is incorrect")
 }
+
+func TestFacets(t *testing.T) {
+	facets := testNode(t).Facets()
+	assert.Equal(t, 7, len(facets), "incorrect number of facets")
+
+	for _, facet := range facets {
+		if facet.Name == "facet6" {
+			assert.Equal(t, []string{"facet1", "facet3", "facet4", "facet6"}, facet.Path, "facet path is incorrect")
+			assert.Equal(t, "facet4", facet.Parent(), "facet parent is incorrect")
+			assert.Equal(t, 4, facet.Depth(), "facet depth is incorrect")
+		}
+		if facet.Name == "facet4" {
+			assert.Equal(t, float64(50), facet.Count, "facet count is incorrect")
+		}
+	}
+}
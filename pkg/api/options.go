@@ -0,0 +1,146 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Options are the output options common to the facet endpoints, they are read
+// from the request query.
+type Options struct {
+	// Metrics are the derived metrics added to every facet (?metrics=share_of_parent,share_of_total).
+	Metrics []string
+
+	// Top keeps only N children with the highest count of every facet (?top=N).
+	Top int
+	// MinCount drops facets with lower count (?min_count=X).
+	MinCount *float64
+	// MinShare drops facets with lower share of their parent (?min_share=0.05).
+	MinShare *float64
+	// Other sums the facets dropped by Top, MinCount and MinShare into "other"
+	// facet of their parent, so the totals still add up (?other=true).
+	Other bool
+	// MaxDepth drops facets deeper than N, top level facets have depth 1 (?max_depth=N).
+	MaxDepth int
+
+	// Sort is the order of the facets (?sort=count_desc), SortName by default.
+	Sort string
+
+	// Limit is the page size, all the facets are returned when 0 (?limit=N).
+	Limit int
+	// Cursor points to the next page of previously computed result (?cursor=).
+	Cursor string
+
+	// selector selects subtrees of the tree (?select=facet1/*/facet5).
+	selector *selector
+	// validator validates the leaves in the ?validation= mode, see NewValidator.
+	validator *Validator
+}
+
+// parseOptions reads Options from request query.
+func parseOptions(params url.Values) (Options, error) {
+	var (
+		opts Options
+		err  error
+	)
+
+	if v := params.Get("metrics"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := metricValues[name]; !ok {
+				return opts, newStatusError(http.StatusBadRequest, "unknown metric %q, supported: %s", name, strings.Join(metricNames, ", "))
+			}
+			opts.Metrics = append(opts.Metrics, name)
+		}
+	}
+
+	if opts.Top, err = intParam(params, "top"); err != nil {
+		return opts, err
+	}
+	if opts.MaxDepth, err = intParam(params, "max_depth"); err != nil {
+		return opts, err
+	}
+	if opts.MinCount, err = floatParam(params, "min_count"); err != nil {
+		return opts, err
+	}
+	if opts.MinShare, err = floatParam(params, "min_share"); err != nil {
+		return opts, err
+	}
+	if opts.selector, err = parseSelector(params); err != nil {
+		return opts, err
+	}
+	// Numbers mode is used by decoders, it is validated before reading the body.
+	if _, err = exactNumbers(params); err != nil {
+		return opts, err
+	}
+	if opts.validator, err = NewValidator(params); err != nil {
+		return opts, err
+	}
+	if opts.Limit, err = intParam(params, "limit"); err != nil {
+		return opts, err
+	}
+	opts.Cursor = params.Get("cursor")
+	if opts.Sort, err = parseSort(params.Get("sort")); err != nil {
+		return opts, err
+	}
+	if v := params.Get("other"); v != "" {
+		if opts.Other, err = strconv.ParseBool(v); err != nil {
+			return opts, newStatusError(http.StatusBadRequest, "invalid other option %q", v)
+		}
+	}
+	return opts, nil
+}
+
+// intParam parses non-negative integer query parameter, 0 when not set.
+func intParam(params url.Values, key string) (int, error) {
+	v := params.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, newStatusError(http.StatusBadRequest, "invalid %s option %q, must be non-negative integer", key, v)
+	}
+	return i, nil
+}
+
+// floatParam parses number query parameter, nil when not set.
+func floatParam(params url.Values, key string) (*float64, error) {
+	v := params.Get(key)
+	if v == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) {
+		return nil, newStatusError(http.StatusBadRequest, "invalid %s option %q, must be number", key, v)
+	}
+	return &f, nil
+}
+
+// result computes the output from facets according to the options.
+func (o Options) result(facets []Facet) (Result, error) {
+	// Decoders which did not skip the unselected branches.
+	facets = o.selector.filter(facets)
+	// Shares are computed from the whole tree, so that dropped facets still
+	// count in the totals. With "other" facets totals add up, so they can be
+	// computed after filtering, which gives the shares of "other" facets too.
+	if len(o.Metrics) > 0 && !o.Other {
+		computeShares(facets)
+	}
+	facets, err := o.filter(facets)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(o.Metrics) > 0 && o.Other {
+		computeShares(facets)
+	}
+	sortFacets(facets, o.Sort)
+	return Result{
+		Facets:  facets,
+		Metrics: o.Metrics,
+		Skipped: o.validator.Skipped(),
+	}, nil
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResultCacheSize = 100
+	defaultResultCacheTTL  = 10 * time.Minute
+
+	// cursorVersion prefixes the encoded cursors, so that their format may be
+	// changed without misreading the old ones.
+	cursorVersion = "v1"
+)
+
+// defaultResultCache is used by handlers served without NewRouter.
+var defaultResultCache = newResultCache(0, 0)
+
+// resultCache keeps computed results of paged requests, so that the following
+// pages are served without aggregating the input again.
+type resultCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*cachedResult
+}
+
+// cachedResult is a single cached result and the page size it was requested with.
+type cachedResult struct {
+	res     Result
+	limit   int
+	expires time.Time
+}
+
+// newResultCache returns cache of at most size results, each kept for ttl
+// since its last use. Zero values select the defaults.
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	if size <= 0 {
+		size = defaultResultCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultResultCacheTTL
+	}
+	return &resultCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*cachedResult),
+	}
+}
+
+// put stores the result and returns its id. Expired results are evicted
+// first, then the ones closest to expiration.
+func (c *resultCache) put(res Result, limit int) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for len(c.entries) >= c.size {
+		var oldest string
+		for key, entry := range c.entries {
+			if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[id] = &cachedResult{res: res, limit: limit, expires: now.Add(c.ttl)}
+	return id, nil
+}
+
+// get returns the result of given id and extends its lifetime.
+func (c *resultCache) get(id string) (*cachedResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if now.After(entry.expires) {
+		delete(c.entries, id)
+		return nil, false
+	}
+	entry.expires = now.Add(c.ttl)
+	return entry, true
+}
+
+type resultCacheKey struct{}
+
+// withResultCache makes the cache available to the paging handlers.
+func withResultCache(cache *resultCache, next handler) handler {
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		return next(rw, req.WithContext(context.WithValue(req.Context(), resultCacheKey{}, cache)))
+	}
+}
+
+// resultCacheFrom returns the cache of the request, or the default one.
+func resultCacheFrom(ctx context.Context) *resultCache {
+	if cache, ok := ctx.Value(resultCacheKey{}).(*resultCache); ok {
+		return cache
+	}
+	return defaultResultCache
+}
+
+// encodeCursor returns opaque cursor pointing to offset of cached result id.
+func encodeCursor(id string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorVersion + "." + id + "." + strconv.Itoa(offset)))
+}
+
+// decodeCursor returns cached result id and offset the cursor points to.
+func decodeCursor(cursor string) (id string, offset int, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, newStatusError(http.StatusBadRequest, "invalid cursor %q", cursor)
+	}
+	parts := strings.Split(string(b), ".")
+	if len(parts) != 3 || parts[0] != cursorVersion {
+		return "", 0, newStatusError(http.StatusBadRequest, "invalid cursor %q", cursor)
+	}
+	offset, err = strconv.Atoi(parts[2])
+	if err != nil || offset < 0 {
+		return "", 0, newStatusError(http.StatusBadRequest, "invalid cursor %q", cursor)
+	}
+	return parts[1], offset, nil
+}
+
+// page returns the result, or a page of it when ?limit= is set. The first
+// page is computed from facets returned by compute, the result is cached and
+// the following pages are read from the cache by ?cursor= (the request body
+// and the other options are ignored then). Result.NextCursor is empty on the
+// last page.
+func (o Options) page(req *http.Request, compute func() ([]Facet, error)) (Result, error) {
+	var (
+		res    Result
+		id     string
+		offset int
+		limit  = o.Limit
+		cache  = resultCacheFrom(req.Context())
+	)
+
+	if o.Cursor != "" {
+		var err error
+		if id, offset, err = decodeCursor(o.Cursor); err != nil {
+			return res, err
+		}
+		entry, ok := cache.get(id)
+		if !ok {
+			return res, newStatusError(http.StatusGone, "cursor expired, repeat the request without cursor")
+		}
+		res = entry.res
+		if limit == 0 {
+			limit = entry.limit
+		}
+		if offset > len(res.Facets) {
+			return res, newStatusError(http.StatusBadRequest, "invalid cursor %q", o.Cursor)
+		}
+	} else {
+		facets, err := compute()
+		if err != nil {
+			return res, err
+		}
+		if res, err = o.result(facets); err != nil {
+			return res, err
+		}
+		if limit == 0 {
+			return res, nil
+		}
+		if len(res.Facets) > limit {
+			// Only results with more pages need to be cached.
+			if id, err = cache.put(res, limit); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	end := offset + limit
+	if end >= len(res.Facets) {
+		end = len(res.Facets)
+	} else {
+		res.NextCursor = encodeCursor(id, end)
+	}
+	res.Facets = res.Facets[offset:end]
+	return res, nil
+}
+
+// setNextLink sets Link header pointing to the next page of res, if any.
+func setNextLink(rw http.ResponseWriter, req *http.Request, res *Result) {
+	if res.NextCursor == "" {
+		return
+	}
+	u := *req.URL
+	query := u.Query()
+	query.Set("cursor", res.NextCursor)
+	u.RawQuery = query.Encode()
+	rw.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", u.RequestURI()))
+}
@@ -0,0 +1,120 @@
+package api_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPagination(t *testing.T) {
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		t.Run(strings.TrimPrefix(path, "/api/v1/"), func(t *testing.T) {
+			var (
+				router = api.NewRouter(api.Config{})
+				pages  [][]map[string]float64
+				query  = "?limit=2&sort=count_desc"
+				body   = testBody
+			)
+
+			for i := 0; i < 10; i++ {
+				req, err := http.NewRequest("POST", path+query, strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if !assert.Equal(t, http.StatusOK, rr.Code, "status code differs") {
+					t.Log(rr.Body.String())
+					return
+				}
+
+				var out struct {
+					Result     []map[string]float64 `json:"result"`
+					NextCursor string               `json:"next_cursor"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+					t.Fatal(err)
+				}
+				pages = append(pages, out.Result)
+				if out.NextCursor == "" {
+					assert.Empty(t, rr.Header().Get("Link"), "link header differs")
+					break
+				}
+				query = "?cursor=" + url.QueryEscape(out.NextCursor)
+				assert.Contains(t, rr.Header().Get("Link"), path+query, "link header differs")
+				// The following pages are read from the cache.
+				body = ""
+			}
+
+			assert.Equal(t, [][]map[string]float64{
+				{{"facet1": 100}, {"facet3": 100}},
+				{{"facet4": 50}, {"facet5": 50}},
+				{{"facet7": 30}, {"facet6": 20}},
+				{{"facet2": 0}},
+			}, pages, "pages differ")
+		})
+	}
+}
+
+func TestPaginationCSV(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	req, err := http.NewRequest("POST", "/api/v1/buffered?format=csv&limit=1&header=false", strings.NewReader(testBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, "facet1,facet1,1,,100\n", rr.Body.String(), "response body differs")
+
+	link := rr.Header().Get("Link")
+	next := link[1:strings.Index(link, ">")]
+	req, err = http.NewRequest("POST", next, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, "facet2,facet2,1,,0\n", rr.Body.String(), "response body differs")
+}
+
+func TestPaginationErrors(t *testing.T) {
+	expired := base64.RawURLEncoding.EncodeToString([]byte("v1.0123456789abcdef.2"))
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{"invalid limit", "?limit=-1", http.StatusBadRequest},
+		{"invalid cursor", "?cursor=not-a-cursor", http.StatusBadRequest},
+		{"invalid cursor version", "?cursor=" + base64.RawURLEncoding.EncodeToString([]byte("v0.id.2")), http.StatusBadRequest},
+		{"expired cursor", "?cursor=" + expired, http.StatusGone},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(testBody))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, tt.code, rr.Code, "status code differs")
+			})
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// progress is the progress of parsing a document, it is updated while the
+// document is parsed and may be read concurrently.
+type progress struct {
+	bytes int64 // bytes read from the input
+	nodes int64 // facets seen
+	depth int64 // depth of the currently open facet
+
+	mu     sync.Mutex
+	totals map[string]float64 // top level facet -> counts seen so far
+}
+
+// Bytes returns the number of bytes read from the input.
+func (p *progress) Bytes() int64 {
+	return atomic.LoadInt64(&p.bytes)
+}
+
+// Nodes returns the number of facets seen.
+func (p *progress) Nodes() int64 {
+	return atomic.LoadInt64(&p.nodes)
+}
+
+// Depth returns the depth of the currently open facet, 0 outside of facets.
+func (p *progress) Depth() int64 {
+	return atomic.LoadInt64(&p.depth)
+}
+
+// enter records opened facet at depth, p may be nil.
+func (p *progress) enter(depth int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.nodes, 1)
+	atomic.StoreInt64(&p.depth, int64(depth))
+}
+
+// leave records closed facet, its parent at depth is open again, p may be nil.
+func (p *progress) leave(depth int) {
+	if p != nil {
+		atomic.StoreInt64(&p.depth, int64(depth))
+	}
+}
+
+// count adds count seen in the subtree of top level facet, p may be nil.
+func (p *progress) count(facet string, count float64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.totals == nil {
+		p.totals = make(map[string]float64)
+	}
+	p.totals[facet] += count
+}
+
+// json returns the current progress.
+func (p *progress) json() ProgressJSON {
+	out := ProgressJSON{
+		Bytes:  p.Bytes(),
+		Nodes:  p.Nodes(),
+		Depth:  p.Depth(),
+		Totals: make(map[string]float64),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for facet, count := range p.totals {
+		out.Totals[facet] = count
+	}
+	return out
+}
+
+// progressReader counts the bytes read through it, parsers reading from it
+// report their progress to it as well. Reads fail once ctx is done, so that
+// long parsing can be canceled.
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	progress *progress
+}
+
+func newProgressReader(ctx context.Context, r io.Reader, p *progress) *progressReader {
+	return &progressReader{ctx: ctx, r: r, progress: p}
+}
+
+// Read implements io.Reader.
+func (r *progressReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(b)
+	atomic.AddInt64(&r.progress.bytes, int64(n))
+	return n, err
+}
+
+// progressOf returns the progress reported by reader, nil when it does not
+// report progress.
+func progressOf(reader io.Reader) *progress {
+	if r, ok := reader.(*progressReader); ok {
+		return r.progress
+	}
+	return nil
+}
@@ -0,0 +1,507 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+
+	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+// Protocol Buffers wire types, the messages are defined in facets.proto.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+const (
+	mediaTypeProtobuf = "application/x-protobuf"
+	// maxProtoDepth limits nesting of Node messages, as maxMsgpackDepth does
+	// for msgpack documents.
+	maxProtoDepth = 10000
+)
+
+func init() {
+	dec := Decoder{Tree: unmarshalProto}
+	BufferedMediaTypes.RegisterInput(mediaTypeProtobuf, dec)
+	StreamingMediaTypes.RegisterInput(mediaTypeProtobuf, dec)
+	BufferedMediaTypes.RegisterOutput(mediaTypeProtobuf, encodeProto)
+	StreamingMediaTypes.RegisterOutput(mediaTypeProtobuf, encodeProto)
+}
+
+// unmarshalProto parses Document message of facets.proto.
+func unmarshalProto(r io.Reader, _ url.Values, v *Validator) (*Node, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read protobuf body")
+	}
+	var (
+		rd   = protoReader{b: b}
+		data [][]byte
+	)
+	for rd.next() {
+		if rd.field == 1 {
+			data = append(data, rd.bytes())
+		} else {
+			rd.skip()
+		}
+	}
+	root := &Node{}
+	if rd.err == nil {
+		rd.err = readProtoNodes(data, root, v)
+	}
+	if rd.err != nil {
+		return nil, errors.Wrap(rd.err, "unable to parse protobuf")
+	}
+	return root, nil
+}
+
+// encodeProto writes the result as AggregateResponse message of
+// facets.proto.
+func encodeProto(w io.Writer, _ *http.Request, res *Result) error {
+	out := AggregateResponse{Result: res.Facets, NextCursor: res.NextCursor, Skipped: res.Skipped}
+	_, err := w.Write(out.MarshalProto())
+	return err
+}
+
+// MarshalProto returns the Document message of the tree rooted at n.
+func (n *Node) MarshalProto() []byte {
+	return appendProtoNodes(nil, 1, n.Children)
+}
+
+// appendProtoKey appends the key of field with given wire type.
+func appendProtoKey(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+// appendProtoBytes appends length-delimited field, embedded messages are
+// appended even when empty, so that repeated ones keep their number.
+func appendProtoBytes(b []byte, field int, p []byte) []byte {
+	b = appendProtoKey(b, field, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+// appendProtoString appends string field, empty strings are left out.
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendProtoKey(b, field, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendProtoStrings appends repeated string field.
+func appendProtoStrings(b []byte, field int, ss []string) []byte {
+	for _, s := range ss {
+		b = appendProtoKey(b, field, protoBytes)
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+// appendProtoDouble appends double field, zero is left out.
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendProtoFixed64(b, field, v)
+}
+
+// appendProtoFixed64 appends double field even when it is zero, for
+// optional fields.
+func appendProtoFixed64(b []byte, field int, v float64) []byte {
+	b = appendProtoKey(b, field, protoFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+// appendProtoDoubles appends packed repeated double field.
+func appendProtoDoubles(b []byte, field int, vs []float64) []byte {
+	if len(vs) == 0 {
+		return b
+	}
+	b = appendProtoKey(b, field, protoBytes)
+	b = binary.AppendUvarint(b, uint64(8*len(vs)))
+	for _, v := range vs {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	return b
+}
+
+// appendProtoInt appends int32 or int64 field, zero is left out.
+func appendProtoInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoKey(b, field, protoVarint)
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+// appendProtoBool appends bool field, false is left out.
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = appendProtoKey(b, field, protoVarint)
+	return append(b, 1)
+}
+
+// protoReader reads the fields of one message:
+//
+//	for r.next() {
+//		switch r.field {
+//		case 1:
+//			name = r.string()
+//		default:
+//			r.skip()
+//		}
+//	}
+//	if r.err != nil { ... }
+//
+// The first malformed field stops the reading, err tells why.
+type protoReader struct {
+	b     []byte
+	field int
+	wire  int
+	err   error
+}
+
+// next reads the key of the next field, it returns false at the end of the
+// message or on error.
+func (r *protoReader) next() bool {
+	if r.err != nil || len(r.b) == 0 {
+		return false
+	}
+	key := r.varint()
+	r.field, r.wire = int(key>>3), int(key&7)
+	if r.err == nil && r.field == 0 {
+		r.err = errors.New("invalid protobuf field number 0")
+	}
+	return r.err == nil
+}
+
+// fail records the error of the current field.
+func (r *protoReader) fail(reason string) {
+	if r.err == nil {
+		r.err = errors.Errorf("invalid protobuf field %d: %s", r.field, reason)
+	}
+	r.b = nil
+}
+
+// expect checks the wire type of the current field.
+func (r *protoReader) expect(wire int) bool {
+	if r.wire != wire {
+		r.fail("unexpected wire type")
+		return false
+	}
+	return true
+}
+
+func (r *protoReader) varint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail("truncated varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *protoReader) fixed64() uint64 {
+	if len(r.b) < 8 {
+		r.fail("truncated fixed64")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+// bytes returns length-delimited field, it refers to the input.
+func (r *protoReader) bytes() []byte {
+	if !r.expect(protoBytes) {
+		return nil
+	}
+	n := r.varint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.b)) {
+		r.fail("truncated bytes")
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *protoReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *protoReader) double() float64 {
+	if !r.expect(protoFixed64) {
+		return 0
+	}
+	return math.Float64frombits(r.fixed64())
+}
+
+func (r *protoReader) int() int64 {
+	if !r.expect(protoVarint) {
+		return 0
+	}
+	return int64(r.varint())
+}
+
+func (r *protoReader) bool() bool {
+	if !r.expect(protoVarint) {
+		return false
+	}
+	return r.varint() != 0
+}
+
+// doubles appends repeated double field to vs, packed or not.
+func (r *protoReader) doubles(vs []float64) []float64 {
+	if r.wire == protoFixed64 {
+		return append(vs, r.double())
+	}
+	p := r.bytes()
+	if len(p)%8 != 0 {
+		r.fail("packed doubles are not multiple of 8 bytes")
+		return vs
+	}
+	for ; len(p) > 0; p = p[8:] {
+		vs = append(vs, math.Float64frombits(binary.LittleEndian.Uint64(p)))
+	}
+	return vs
+}
+
+// skip skips unknown field.
+func (r *protoReader) skip() {
+	switch r.wire {
+	case protoVarint:
+		r.varint()
+	case protoFixed64:
+		r.fixed64()
+	case protoBytes:
+		r.bytes()
+	case protoFixed32:
+		if len(r.b) < 4 {
+			r.fail("truncated fixed32")
+			return
+		}
+		r.b = r.b[4:]
+	default:
+		r.fail("unsupported wire type")
+	}
+}
+
+// appendProto appends the Node message of n: leaves have count (or series),
+// exact counts are written as their nearest float.
+func (n *Node) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, n.Name)
+	if len(n.Children) == 0 {
+		if n.Series != nil {
+			return appendProtoDoubles(b, 3, n.Series)
+		}
+		return appendProtoDouble(b, 2, n.Count)
+	}
+	return appendProtoNodes(b, 4, n.Children)
+}
+
+// appendProtoNodes appends repeated Node field.
+func appendProtoNodes(b []byte, field int, nodes []*Node) []byte {
+	for _, child := range nodes {
+		b = appendProtoBytes(b, field, child.appendProto(nil))
+	}
+	return b
+}
+
+// readProtoChild reads Node message as child of parent. The children are
+// read once the name is known (fields may come in any order), so that
+// invalid leaves are reported with their path. Children of the same name
+// replace the earlier one, but keep its position, index maps names to
+// positions. Invalid leaves are recorded by v and left out. depth is the
+// depth of the child.
+func readProtoChild(b []byte, parent *Node, index map[string]int, depth int, v *Validator) error {
+	if depth > maxProtoDepth {
+		return errors.New("document is nested too deep")
+	}
+	var (
+		n        = &Node{Parent: parent}
+		r        = protoReader{b: b}
+		children [][]byte
+	)
+	for r.next() {
+		switch r.field {
+		case 1:
+			n.Name = r.string()
+		case 2:
+			n.Count = r.double()
+		case 3:
+			n.Series = r.doubles(n.Series)
+		case 4:
+			children = append(children, r.bytes())
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if len(children) > 0 {
+		n.Count, n.Series = 0, nil
+		childIndex := make(map[string]int)
+		for _, child := range children {
+			if err := readProtoChild(child, n, childIndex, depth+1, v); err != nil {
+				return err
+			}
+		}
+	} else if !n.checkProtoLeaf(v) {
+		return nil
+	}
+
+	if i, ok := index[n.Name]; ok {
+		parent.Children[i] = n
+	} else {
+		index[n.Name] = len(parent.Children)
+		parent.Children = append(parent.Children, n)
+	}
+	return nil
+}
+
+// checkProtoLeaf validates the count of leaf, the count of series leaf is
+// their sum. It returns false when the leaf is invalid.
+func (n *Node) checkProtoLeaf(v *Validator) bool {
+	if n.Series == nil {
+		_, _, ok := v.check(n.Path(), n.Count, n.Count, nil)
+		return ok
+	}
+	n.Count = 0
+	for _, count := range n.Series {
+		if _, _, ok := v.check(n.Path(), count, count, nil); !ok {
+			return false
+		}
+		n.Count += count
+	}
+	return true
+}
+
+// readProtoNodes reads repeated Node field as children of root.
+func readProtoNodes(fields [][]byte, root *Node, v *Validator) error {
+	index := make(map[string]int)
+	for _, b := range fields {
+		if err := readProtoChild(b, root, index, 1, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendProto appends the Facet message of f, the metrics are appended when
+// they were computed.
+func (f *Facet) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, f.Name)
+	b = appendProtoStrings(b, 2, f.Path)
+	b = appendProtoDouble(b, 3, f.Count)
+	b = appendProtoDoubles(b, 4, f.Series)
+	for i, share := range []*float64{f.ShareOfParent, f.ShareOfTotal, f.ShareOfSiblings} {
+		if share != nil {
+			b = appendProtoFixed64(b, 5+i, *share)
+		}
+	}
+	if f.Exact != nil {
+		b = appendProtoString(b, 8, formatExact(f.Exact))
+	}
+	return b
+}
+
+// appendProtoFacets appends repeated Facet field.
+func appendProtoFacets(b []byte, field int, facets []Facet) []byte {
+	for i := range facets {
+		b = appendProtoBytes(b, field, facets[i].appendProto(nil))
+	}
+	return b
+}
+
+// readProtoFacet reads Facet message.
+func readProtoFacet(b []byte) (Facet, error) {
+	var (
+		f Facet
+		r = protoReader{b: b}
+	)
+	for r.next() {
+		switch r.field {
+		case 1:
+			f.Name = r.string()
+		case 2:
+			f.Path = append(f.Path, r.string())
+		case 3:
+			f.Count = r.double()
+		case 4:
+			f.Series = r.doubles(f.Series)
+		case 5:
+			share := r.double()
+			f.ShareOfParent = &share
+		case 6:
+			share := r.double()
+			f.ShareOfTotal = &share
+		case 7:
+			share := r.double()
+			f.ShareOfSiblings = &share
+		case 8:
+			exact, err := parseExact(json.Number(r.string()))
+			if err != nil {
+				r.fail("invalid exact count")
+			}
+			f.Exact = exact
+		default:
+			r.skip()
+		}
+	}
+	return f, r.err
+}
+
+// appendProto appends the InvalidLeaf message of leaf, the value is JSON.
+func (leaf *InvalidLeaf) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, leaf.Path)
+	value, err := jsoniter.MarshalToString(leaf.Value)
+	if err != nil {
+		value = "null"
+	}
+	b = appendProtoString(b, 2, value)
+	return appendProtoString(b, 3, leaf.Reason)
+}
+
+// readProtoInvalidLeaf reads InvalidLeaf message.
+func readProtoInvalidLeaf(b []byte) (InvalidLeaf, error) {
+	var (
+		leaf InvalidLeaf
+		r    = protoReader{b: b}
+	)
+	for r.next() {
+		switch r.field {
+		case 1:
+			leaf.Path = r.string()
+		case 2:
+			if err := jsoniter.UnmarshalFromString(r.string(), &leaf.Value); err != nil {
+				r.fail("invalid value")
+			}
+		case 3:
+			leaf.Reason = r.string()
+		default:
+			r.skip()
+		}
+	}
+	return leaf, r.err
+}
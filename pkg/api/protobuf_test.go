@@ -0,0 +1,106 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// binaryRequest posts body of contentType to path, accepting accept.
+func binaryRequest(t testing.TB, router http.Handler, path, contentType, accept string, body []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", accept)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// protoResult returns the AggregateResponse of response.
+func protoResult(t *testing.T, rr *httptest.ResponseRecorder) api.AggregateResponse {
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs: %s", rr.Body.String())
+	assert.Equal(t, "application/x-protobuf", rr.Header().Get("Content-Type"), "content type differs")
+	var out api.AggregateResponse
+	if err := out.UnmarshalProto(rr.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestProtobuf(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	body := parseTree(t, testBody).MarshalProto()
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		rr := binaryRequest(t, router, path, "application/x-protobuf", "application/json", body)
+		assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+		assert.JSONEq(t, expectedOutput, rr.Body.String(), "response differs")
+
+		out := protoResult(t, binaryRequest(t, router, path, "application/json", "application/x-protobuf", []byte(testBody)))
+		assert.Equal(t, []string{
+			"facet1: 100", "facet2: 0", "facet1/facet3: 100", "facet1/facet3/facet4: 50",
+			"facet1/facet3/facet5: 50", "facet1/facet3/facet4/facet6: 20", "facet1/facet3/facet4/facet7: 30",
+		}, facetCounts(out.Result), "result differs")
+	}
+
+	out := protoResult(t, binaryRequest(t, router, "/api/v1/buffered?limit=2&metrics=share_of_parent", "application/x-protobuf", "application/x-protobuf", body))
+	assert.Equal(t, []string{"facet1: 100", "facet2: 0"}, facetCounts(out.Result), "page differs")
+	assert.NotEmpty(t, out.NextCursor, "cursor missing")
+	assert.Equal(t, 1.0, *out.Result[0].ShareOfParent, "share differs")
+	assert.Equal(t, 0.0, *out.Result[1].ShareOfParent, "share differs")
+
+	out = protoResult(t, binaryRequest(t, router, "/api/v1/buffered?validation=skip&numbers=exact", "application/json", "application/x-protobuf",
+		[]byte(`{"data": {"a": {"count": -1}, "b": {"count": 0.1}}}`)))
+	assert.Equal(t, []string{"b: 0.1"}, facetCounts(out.Result), "result differs")
+	assert.Equal(t, "1/10", out.Result[0].Exact.String(), "exact count differs")
+	assert.Equal(t, []api.InvalidLeaf{{Path: "a", Value: -1.0, Reason: "count value is negative"}}, out.Skipped, "skipped differ")
+}
+
+func TestProtobufInvalid(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	// Node {name: "a", children: [...]} nested 10001 levels deep.
+	deep := []byte{0x0a, 0x01, 'a'}
+	for i := 0; i < 10000; i++ {
+		deep = append(binary.AppendUvarint([]byte{0x0a, 0x01, 'a', 0x22}, uint64(len(deep))), deep...)
+	}
+	deep = append(binary.AppendUvarint([]byte{0x0a}, uint64(len(deep))), deep...)
+
+	tests := []struct {
+		name    string
+		query   string
+		body    []byte
+		code    int
+		message string
+	}{
+		// Node {name: "a", count: -1}.
+		{"negative", "", []byte{0x0a, 0x0c, 0x0a, 0x01, 'a', 0x11, 0, 0, 0, 0, 0, 0, 0xf0, 0xbf}, http.StatusBadRequest,
+			"unable to parse facets: 1 invalid leaves: a: count value is negative"},
+		{"skipped", "?validation=skip", []byte{0x0a, 0x0c, 0x0a, 0x01, 'a', 0x11, 0, 0, 0, 0, 0, 0, 0xf0, 0xbf}, http.StatusOK, ""},
+		{"truncated", "", []byte{0x0a, 0x05, 0x0a}, http.StatusBadRequest,
+			"unable to parse facets: unable to parse protobuf: invalid protobuf field 1: truncated bytes"},
+		{"wire type", "", []byte{0x08, 0x01}, http.StatusBadRequest,
+			"unable to parse facets: unable to parse protobuf: invalid protobuf field 1: unexpected wire type"},
+		{"unknown field", "", []byte{0x10, 0x01}, http.StatusOK, ""},
+		{"nested", "", deep, http.StatusBadRequest,
+			"unable to parse facets: unable to parse protobuf: document is nested too deep"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := binaryRequest(t, router, "/api/v1/buffered"+tt.query, "application/x-protobuf", "application/json", tt.body)
+			assert.Equal(t, tt.code, rr.Code, "status code differs")
+			if tt.message != "" {
+				assert.Equal(t, `"`+tt.message+`"`, jsonField(t, rr.Body.Bytes(), "error"), "error differs")
+			}
+		})
+	}
+}
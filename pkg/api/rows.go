@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeTSV = "text/tab-separated-values"
+)
+
+func init() {
+	for mediaType, delimiter := range map[string]rune{mediaTypeCSV: ',', mediaTypeTSV: '\t'} {
+		dec := rowsDecoder(delimiter)
+		BufferedMediaTypes.RegisterInput(mediaType, dec)
+		StreamingMediaTypes.RegisterInput(mediaType, dec)
+	}
+}
+
+// rowsDecoder returns decoder of delimited path/count rows like:
+//
+//	facet1/facet3/facet5,50
+//
+// Options:
+//
+//	?path_separator=/ separates facet names in the path.
+//	?path_column=0 and ?count_column=1 select the columns, either by 0-based
+//	index or by name from the header row.
+//
+//	?header_row=true or false tells whether the first row is the header row.
+//
+// The header row is detected automatically unless header_row is set, it is
+// the first row when columns are selected by name or when its count is not a
+// number. Repeated paths replace the earlier count, just like duplicate keys
+// of the JSON input.
+func rowsDecoder(delimiter rune) Decoder {
+	return Decoder{
+		Tree: func(r io.Reader, params url.Values, v *Validator) (*Node, error) {
+			return rowsToTree(r, delimiter, params, v)
+		},
+		Sums: func(r io.Reader, params url.Values, v *Validator) ([]Facet, error) {
+			return rowsToFacets(r, delimiter, params, v)
+		},
+	}
+}
+
+// rowsToTree builds the Node tree from path/count rows.
+func rowsToTree(r io.Reader, delimiter rune, params url.Values, v *Validator) (*Node, error) {
+	b := newTreeBuilder()
+	if err := readRows(r, delimiter, params, v, b.Add); err != nil {
+		return nil, err
+	}
+	return b.Root(), nil
+}
+
+// rowsToFacets computes facet sums directly from path/count rows, without
+// building the tree.
+func rowsToFacets(r io.Reader, delimiter rune, params url.Values, v *Validator) ([]Facet, error) {
+	var (
+		facets []Facet
+		index  = map[string]int{}     // path key -> index in facets
+		leaves = map[string]bool{}    // path -> true for counted paths, false for inner paths
+		counts = map[string]float64{} // path key -> count of counted paths
+	)
+
+	err := readRows(r, delimiter, params, v, func(path []string, count float64) error {
+		// Repeated path replaces its count, the ancestors get the difference.
+		leafKey := strings.Join(path, "\x00")
+		delta := count - counts[leafKey]
+		counts[leafKey] = count
+		for i, name := range path {
+			key := strings.Join(path[:i+1], "\x00")
+			leaf := i == len(path)-1
+			if wasLeaf, ok := leaves[key]; ok && wasLeaf != leaf {
+				return errors.Errorf("facet %q has both count and children", strings.Join(path[:i+1], "/"))
+			}
+			leaves[key] = leaf
+
+			j, ok := index[key]
+			if !ok {
+				j = len(facets)
+				index[key] = j
+				facets = append(facets, Facet{
+					Name: name,
+					Path: append([]string(nil), path[:i+1]...),
+				})
+			}
+			facets[j].Count += delta
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return facets, nil
+}
+
+// readRows reads delimited rows one by one and calls fn with the split path
+// and count of each of them. Rows with invalid counts are recorded by v and
+// left out.
+func readRows(r io.Reader, delimiter rune, params url.Values, v *Validator, fn func(path []string, count float64) error) error {
+	var (
+		separator   = paramOrDefault(params, "path_separator", "/")
+		pathColumn  = paramOrDefault(params, "path_column", "0")
+		countColumn = paramOrDefault(params, "count_column", "1")
+	)
+
+	pathIdx, pathErr := strconv.Atoi(pathColumn)
+	countIdx, countErr := strconv.Atoi(countColumn)
+	// Columns selected by name require header row.
+	named := pathErr != nil || countErr != nil
+	// Header row is detected by its count, unless it is told explicitly.
+	detect, header := true, named
+	if value := params.Get("header_row"); value != "" {
+		var err error
+		if header, err = strconv.ParseBool(value); err != nil {
+			return newStatusError(http.StatusBadRequest, "invalid header_row option %q", value)
+		}
+		if named && !header {
+			return newStatusError(http.StatusBadRequest, "columns selected by name require header row")
+		}
+		detect = false
+	}
+
+	cr := csv.NewReader(r)
+	cr.Comma = delimiter
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+
+	for row := 1; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading rows")
+		}
+
+		if row == 1 && header {
+			if !named {
+				continue
+			}
+			if pathErr != nil {
+				pathIdx = columnIndex(record, pathColumn)
+			}
+			if countErr != nil {
+				countIdx = columnIndex(record, countColumn)
+			}
+			if pathIdx < 0 || countIdx < 0 {
+				return errors.Errorf("columns %q and %q not found in header row", pathColumn, countColumn)
+			}
+			continue
+		}
+		if pathIdx < 0 || pathIdx >= len(record) || countIdx < 0 || countIdx >= len(record) {
+			return errors.Errorf("row %d: missing path or count column", row)
+		}
+
+		count, err := strconv.ParseFloat(strings.TrimSpace(record[countIdx]), 64)
+		if err != nil && row == 1 && detect {
+			// Header row.
+			continue
+		}
+		path := strings.Split(strings.TrimSpace(record[pathIdx]), separator)
+		for _, name := range path {
+			if name == "" {
+				return errors.Errorf("row %d: empty facet name in path %q", row, record[pathIdx])
+			}
+		}
+		if err != nil {
+			v.Invalid(path, record[countIdx], "count value is not a number")
+			continue
+		}
+		if _, _, ok := v.check(path, record[countIdx], count, nil); !ok {
+			continue
+		}
+		if err := fn(path, count); err != nil {
+			return errors.Wrapf(err, "row %d", row)
+		}
+	}
+}
+
+// columnIndex returns index of named column in header, or -1.
+func columnIndex(header []string, name string) int {
+	for i, column := range header {
+		if strings.TrimSpace(column) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// paramOrDefault returns value of params[key] or def when it is not set.
+func paramOrDefault(params url.Values, key, def string) string {
+	if v := params.Get(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,89 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowsInput(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		query       string
+		body        string
+	}{
+		{
+			"csv", "text/csv", "",
+			"facet1/facet3/facet4/facet6,20\nfacet1/facet3/facet4/facet7,30\nfacet1/facet3/facet5,50\nfacet2,0\n",
+		},
+		{
+			"tsv with header", "text/tab-separated-values", "",
+			"path\tcount\nfacet1/facet3/facet4/facet6\t20\nfacet1/facet3/facet4/facet7\t30\nfacet1/facet3/facet5\t50\nfacet2\t0\n",
+		},
+		{
+			"header row", "text/csv", "?header_row=true",
+			"path,2024\nfacet1/facet3/facet4/facet6,20\nfacet1/facet3/facet4/facet7,30\nfacet1/facet3/facet5,50\nfacet2,0\n",
+		},
+		{
+			"named columns and separator", "text/csv", "?path_column=facet&count_column=n&path_separator=.",
+			"n,facet\n20,facet1.facet3.facet4.facet6\n10,facet1.facet3.facet4.facet7\n50,facet1.facet3.facet5\n0,facet2\n30,facet1.facet3.facet4.facet7\n",
+		},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", tt.contentType)
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				assert.JSONEq(t, expectedOutput, rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+func TestRowsInputInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		body  string
+	}{
+		{"invalid count", "", "facet1,10\nfacet2,abc\n"},
+		{"invalid first count", "?header_row=false", "facet1,abc\nfacet2,10\n"},
+		{"invalid header_row", "?header_row=maybe", "facet1,10\n"},
+		{"named columns without header row", "?header_row=false&path_column=path", "path,count\nfacet1,10\n"},
+		{"empty facet name", "", "facet1//facet2,10\n"},
+		{"leaf with children", "", "facet1,10\nfacet1/facet2,10\n"},
+		{"children with count", "", "facet1/facet2,10\nfacet1,10\n"},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", "text/csv")
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+			})
+		}
+	}
+}
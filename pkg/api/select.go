@@ -0,0 +1,187 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maxSelectSegments limits the length of select expressions.
+const maxSelectSegments = 64
+
+// selector selects subtrees of the facet tree by path expressions, see
+// parseSelector. Nil selector selects everything.
+type selector struct {
+	patterns [][]string
+}
+
+// parseSelector reads the ?select= path expressions, the parameter may be
+// repeated to select more subtrees. Expressions are facet names separated by
+// "/", where every name may be a glob (facet*, facet[1-3]), "*" matches any
+// single facet and "**" any number of facets:
+//
+//	facet1/*/facet5 selects facet5 grandchildren of facet1
+//	**/facet6       selects facet6 at any depth
+//
+// Selected facets are returned with all their descendants. Consecutive "**"
+// are merged, expressions may have up to maxSelectSegments names.
+func parseSelector(params url.Values) (*selector, error) {
+	values := params["select"]
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	sel := &selector{}
+	for _, v := range values {
+		var pattern []string
+		for _, segment := range strings.Split(strings.Trim(v, "/"), "/") {
+			if segment == "**" && len(pattern) > 0 && pattern[len(pattern)-1] == "**" {
+				continue
+			}
+			pattern = append(pattern, segment)
+			if segment == "" {
+				return nil, newStatusError(http.StatusBadRequest, "invalid select %q, empty facet name", v)
+			}
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, newStatusError(http.StatusBadRequest, "invalid select %q: %s", v, err)
+			}
+		}
+		if len(pattern) > maxSelectSegments {
+			return nil, newStatusError(http.StatusBadRequest, "invalid select %q, more than %d facet names", v, maxSelectSegments)
+		}
+		sel.patterns = append(sel.patterns, pattern)
+	}
+	return sel, nil
+}
+
+// match returns selected when the facet at path is selected (together with
+// its whole subtree), and descend when only some of its descendants may be.
+// Facets which are neither may be skipped.
+func (s *selector) match(path []string) (selected, descend bool) {
+	if s == nil {
+		return true, false
+	}
+	for _, pattern := range s.patterns {
+		if matchPath(pattern, path) {
+			return true, false
+		}
+		if !descend && matchDescendant(pattern, path) {
+			descend = true
+		}
+	}
+	return false, descend
+}
+
+// filter returns only the selected facets, it is used for decoders which do
+// not skip the unselected branches themselves.
+func (s *selector) filter(facets []Facet) []Facet {
+	if s == nil {
+		return facets
+	}
+	selected := make(map[string]bool)
+	out := facets[:0]
+	for _, f := range facets {
+		if s.selected(f.Path, selected) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// selected returns true when the path or any of its ancestors is selected,
+// cache keeps the results of ancestors' paths.
+func (s *selector) selected(path []string, cache map[string]bool) bool {
+	key := pathKey(path)
+	if v, ok := cache[key]; ok {
+		return v
+	}
+	v, _ := s.match(path)
+	if !v && len(path) > 1 {
+		v = s.selected(path[:len(path)-1], cache)
+	}
+	cache[key] = v
+	return v
+}
+
+// matchPath returns true when pattern matches the whole path.
+func matchPath(pattern, names []string) bool {
+	return matchStates(pattern, names)[len(pattern)]
+}
+
+// matchDescendant returns true when pattern may match some descendant of path.
+func matchDescendant(pattern, names []string) bool {
+	states := matchStates(pattern, names)
+	for _, ok := range states[:len(pattern)] {
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchStates matches names against pattern, states[i] is true when
+// pattern[:i] matches all the names. Every name is matched against every
+// pattern segment at most once, so that "**" costs no backtracking.
+func matchStates(pattern, names []string) []bool {
+	states := make([]bool, len(pattern)+1)
+	states[0] = true
+	closeStates(pattern, states)
+	next := make([]bool, len(states))
+	for _, name := range names {
+		for i := range next {
+			next[i] = false
+		}
+		for i, ok := range states[:len(pattern)] {
+			switch {
+			case !ok:
+			case pattern[i] == "**":
+				next[i] = true
+			case matchName(pattern[i], name):
+				next[i+1] = true
+			}
+		}
+		states, next = next, states
+		closeStates(pattern, states)
+	}
+	return states
+}
+
+// closeStates adds the states reached by "**" matching no facet.
+func closeStates(pattern []string, states []bool) {
+	for i, segment := range pattern {
+		if states[i] && segment == "**" {
+			states[i+1] = true
+		}
+	}
+}
+
+// matchName matches single facet name against glob.
+func matchName(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// selectFacets returns facets of the selected subtrees, unselected branches
+// are not walked at all.
+func (n *Node) selectFacets(sel *selector) []Facet {
+	if sel == nil {
+		return n.Facets()
+	}
+	var out []Facet
+	n.selectChildren(sel, nil, &out, make(map[string]int))
+	return out
+}
+
+// selectChildren adds facets of my selected children (at path) into out.
+func (n *Node) selectChildren(sel *selector, path []string, out *[]Facet, index map[string]int) {
+	for _, child := range n.Children {
+		childPath := append(path[:len(path):len(path)], child.Name)
+		switch selected, descend := sel.match(childPath); {
+		case selected:
+			child.facets(out, index)
+		case descend:
+			child.selectChildren(sel, childPath, out, index)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{"path", "?select=facet1/facet3/facet4", "", testBody, `{"result": [{"facet4": 50}, {"facet6": 20}, {"facet7": 30}]}`},
+		{"leading slash", "?select=/facet2", "", testBody, `{"result": [{"facet2": 0}]}`},
+		{"star", "?select=facet1/*/facet5", "", testBody, `{"result": [{"facet5": 50}]}`},
+		{"double star", "?select=**/facet6", "", testBody, `{"result": [{"facet6": 20}]}`},
+		{"double star in the middle", "?select=facet1/**/facet7", "", testBody, `{"result": [{"facet7": 30}]}`},
+		{"glob", "?select=facet1/facet3/facet[45]", "", testBody, `{"result": [{"facet4": 50}, {"facet5": 50}, {"facet6": 20}, {"facet7": 30}]}`},
+		{"repeated double star", "?select=" + strings.Repeat("**/", 100) + "facet6", "", testBody, `{"result": [{"facet6": 20}]}`},
+		{"many double stars", "?select=" + strings.Repeat("**/facet*/", 30) + "x", "", testBody, `{"result": []}`},
+		{"many", "?select=facet2&select=**/facet5", "", testBody, `{"result": [{"facet2": 0}, {"facet5": 50}]}`},
+		{"nothing", "?select=facet9", "", testBody, `{"result": []}`},
+		{"metrics", "?select=facet1/facet3/*&metrics=share_of_total", "", testBody, `{"result": [
+			{"name": "facet4", "count": 50, "share_of_total": 0.5},
+			{"name": "facet5", "count": 50, "share_of_total": 0.5},
+			{"name": "facet6", "count": 20, "share_of_total": 0.2},
+			{"name": "facet7", "count": 30, "share_of_total": 0.3}
+		]}`},
+		{"flat", "?layout=flat&select=a/b", "", `{"a.b.c": 1, "a.b.d": 2, "a.e": 3}`, `{"result": [{"b": 3}, {"c": 1}, {"d": 2}]}`},
+		{"csv", "?select=**/b", "text/csv", "path,count\na/b/c,1\na/d,2\n", `{"result": [{"b": 1}, {"c": 1}]}`},
+		{"skipped invalid", "?select=facet2", "", `{"data": {"facet1": {"facet3": {"count": "x"}}, "facet2": {"count": 1}}}`, `{"result": [{"facet2": 1}]}`},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.contentType != "" {
+					req.Header.Set("Content-Type", tt.contentType)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				assert.JSONEq(t, tt.expected, rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+func TestSelectInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		body  string
+	}{
+		{"empty name", "?select=facet1//facet2", testBody},
+		{"bad glob", "?select=facet[", testBody},
+		{"empty", "?select=", testBody},
+		{"too long", "?select=" + strings.Repeat("facet1/", 65), testBody},
+		{"truncated", "?select=facet2", testBody[:len(testBody)-10]},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+			})
+		}
+	}
+}
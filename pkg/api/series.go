@@ -0,0 +1,83 @@
+package api
+
+import (
+	"strings"
+)
+
+// Count arrays are series of per-wave (or per-period) counts of a leaf:
+//
+//	{"facet1": {"count": [10, 12, 9]}}
+//
+// Count of the leaf is the sum of the series. Series of a facet is the
+// element-wise sum of the series in its subtree, shorter series are padded
+// with zeros. Scalar counts are part of the counts, but not of the series.
+
+// addSeries adds src to dst element-wise and returns dst, which is extended
+// when src is longer. dst must not be shared, src is not modified.
+func addSeries(dst, src []float64) []float64 {
+	if len(src) > len(dst) {
+		dst = append(dst, make([]float64, len(src)-len(dst))...)
+	}
+	for i, v := range src {
+		dst[i] += v
+	}
+	return dst
+}
+
+// addSeriesAt adds v to i-th element of series and returns the series, which
+// is extended when it is shorter.
+func addSeriesAt(series []float64, i int, v float64) []float64 {
+	if i >= len(series) {
+		series = append(series, make([]float64, i+1-len(series))...)
+	}
+	series[i] += v
+	return series
+}
+
+// formatSeries formats series for text outputs, values are separated by
+// spaces.
+func formatSeries(series []float64) string {
+	values := make([]string, len(series))
+	for i, v := range series {
+		values[i] = formatFloat(v)
+	}
+	return strings.Join(values, " ")
+}
+
+// series validates count array of the leaf at path and returns its values
+// and their sum, it returns false when any of the values is invalid.
+func (v *Validator) series(path []string, values []interface{}) (series []float64, sum float64, ok bool) {
+	ok = true
+	series = make([]float64, len(values))
+	for i, value := range values {
+		count, valid := v.Count(path, value)
+		ok = ok && valid
+		series[i] = count
+		sum += count
+	}
+	return series, sum, ok
+}
+
+// mergeElement merges one object of facet list into n, leaf is true when the
+// object has count. Leaf counts and series are summed, children are merged
+// by name just like MergeTrees does. Facet with any leaf object in the list
+// is a leaf, the caller removes the children then.
+func (n *Node) mergeElement(element *Node, leaf bool) {
+	if !leaf {
+		mergeNode(n, element, 0, nil, nil)
+		return
+	}
+	n.Count += element.Count
+	n.Exact = addExact(n.Exact, element.Exact)
+	n.Series = addSeries(n.Series, element.Series)
+}
+
+// series returns true when any of the facets has series.
+func (r *Result) series() bool {
+	for i := range r.Facets {
+		if r.Facets[i].Series != nil {
+			return true
+		}
+	}
+	return false
+}
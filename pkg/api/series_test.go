@@ -0,0 +1,135 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const seriesBody = `{"data": {
+	"facet1": {"facet3": {"count": [10, 12, 9]}, "facet4": {"count": [1, 2]}},
+	"facet2": {"count": 5}
+}}`
+
+func TestSeries(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			"series", "", "application/json", seriesBody,
+			`{"result": [
+				{"name": "facet1", "count": 34, "series": [11, 14, 9]},
+				{"name": "facet2", "count": 5},
+				{"name": "facet3", "count": 31, "series": [10, 12, 9]},
+				{"name": "facet4", "count": 3, "series": [1, 2]}
+			]}`,
+		},
+		{
+			"other", "?top=1&other=true", "application/json", seriesBody,
+			`{"result": [
+				{"name": "facet1", "count": 34, "series": [11, 14, 9]},
+				{"name": "facet1/other", "count": 3, "series": [1, 2]},
+				{"name": "facet3", "count": 31, "series": [10, 12, 9]},
+				{"name": "other", "count": 5}
+			]}`,
+		},
+		{
+			"metrics", "?metrics=share_of_parent&select=facet1", "application/json", seriesBody,
+			`{"result": [
+				{"name": "facet1", "count": 34, "series": [11, 14, 9], "share_of_parent": 1},
+				{"name": "facet3", "count": 31, "series": [10, 12, 9], "share_of_parent": 0.9117647058823529},
+				{"name": "facet4", "count": 3, "series": [1, 2], "share_of_parent": 0.08823529411764706}
+			]}`,
+		},
+		{
+			"list of children", "", "application/json",
+			`{"data": {"facet1": [{"facet3": {"count": 10}}, {"facet4": {"count": 20}}, {"facet3": {"count": 5}}]}}`,
+			`{"result": [{"facet1": 35}, {"facet3": 15}, {"facet4": 20}]}`,
+		},
+		{
+			"list of leaves", "", "application/json",
+			`{"data": {"facet1": [{"count": 10}, {"count": [1, 2]}]}}`,
+			`{"result": [{"name": "facet1", "count": 13, "series": [1, 2]}]}`,
+		},
+		{
+			"skip invalid", "?validation=skip", "application/json",
+			`{"data": {"facet1": {"count": [1, "x"]}, "facet2": {"count": [2]}}}`,
+			`{"result": [{"name": "facet2", "count": 2, "series": [2]}],
+			  "skipped": [{"path": "facet1", "value": "x", "reason": "count value is invalid type string"}]}`,
+		},
+		{
+			"flat", "?layout=flat", "application/json", `{"facet1.facet3": [1, 2], "facet1.facet4": [3]}`,
+			`{"result": [
+				{"name": "facet1", "count": 6, "series": [4, 2]},
+				{"name": "facet3", "count": 3, "series": [1, 2]},
+				{"name": "facet4", "count": 3, "series": [3]}
+			]}`,
+		},
+		{
+			"yaml", "", "application/yaml", "data:\n  facet1:\n    - count: [1, 2]\n    - count: 3\n",
+			`{"result": [{"name": "facet1", "count": 6, "series": [1, 2]}]}`,
+		},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", tt.contentType)
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				assert.JSONEq(t, tt.expected, rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+func TestSeriesCSV(t *testing.T) {
+	req, err := http.NewRequest("POST", "/api/v1/streaming?format=csv&select=facet1", strings.NewReader(seriesBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, `facet,path,depth,parent,count,series
+facet1,facet1,1,,34,11 14 9
+facet3,facet1/facet3,2,facet1,31,10 12 9
+facet4,facet1/facet4,2,facet1,3,1 2
+`, rr.Body.String(), "response body differs")
+}
+
+func TestSeriesMerge(t *testing.T) {
+	body := `[{"data": {"facet1": {"count": [1, 2]}}}, {"data": {"facet1": {"count": [3]}}}]`
+	req, err := http.NewRequest("POST", "/api/v1/merge", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.JSONEq(t, `{
+		"data": {"facet1": {"count": [4, 2]}},
+		"result": [{"facet1": 6}],
+		"conflicts": []
+	}`, rr.Body.String(), "response body differs")
+}
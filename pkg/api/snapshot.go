@@ -0,0 +1,355 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/json-iterator/go"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// snapshotMagic starts the first line of snapshot files, followed by the
+	// format version.
+	snapshotMagic   = "facets-snapshot"
+	snapshotVersion = 1
+
+	defaultMaxTrees = 1000
+)
+
+// defaultTreeStore is used by handlers served without NewRouter.
+var defaultTreeStore = newTreeStore(0)
+
+// treeStore keeps the last tree posted with ?key= per key, up to max keys.
+// Stored trees are never modified, so that they can be read without locking.
+type treeStore struct {
+	mu    sync.RWMutex
+	trees map[string]*Node
+	max   int
+}
+
+func newTreeStore(max int) *treeStore {
+	if max <= 0 {
+		max = defaultMaxTrees
+	}
+	return &treeStore{trees: make(map[string]*Node), max: max}
+}
+
+func (s *treeStore) get(key string) (*Node, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	root, ok := s.trees[key]
+	return root, ok
+}
+
+// put stores the tree of key, new keys are rejected when the store is full.
+func (s *treeStore) put(key string, root *Node) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.trees[key]; !ok && len(s.trees) >= s.max {
+		return newStatusError(http.StatusInsufficientStorage, "unable to store tree %q, there are %d trees already", key, len(s.trees))
+	}
+	s.trees[key] = root
+	return nil
+}
+
+// snapshot returns the snapshot file of all the trees at this point in time.
+func (s *treeStore) snapshot() ([]byte, error) {
+	s.mu.RLock()
+	trees := make(map[string]*Node, len(s.trees))
+	for key, root := range s.trees {
+		trees[key] = root
+	}
+	s.mu.RUnlock()
+	return encodeSnapshot(trees, time.Now())
+}
+
+type treeStoreKey struct{}
+
+// withTreeStore makes the store available to the handlers reading and storing
+// the keyed trees.
+func withTreeStore(store *treeStore, next handler) handler {
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		return next(rw, req.WithContext(context.WithValue(req.Context(), treeStoreKey{}, store)))
+	}
+}
+
+// treeStoreFrom returns the store of the request, or the default one.
+func treeStoreFrom(ctx context.Context) *treeStore {
+	if store, ok := ctx.Value(treeStoreKey{}).(*treeStore); ok {
+		return store
+	}
+	return defaultTreeStore
+}
+
+// treeKey returns the ?key= option, empty when it is not set.
+func treeKey(req *http.Request) (string, error) {
+	key := req.URL.Query().Get("key")
+	if key != "" && !datasetName.MatchString(key) {
+		return "", newStatusError(http.StatusBadRequest, "invalid key %q, must be letters, digits, '_', '-' or '.'", key)
+	}
+	return key, nil
+}
+
+// TreeHandler returns the rollup of the tree last posted to /buffered with
+// ?key=, GET /api/v1/trees/{key}. The output options are the same as of /buffered.
+func TreeHandler(rw http.ResponseWriter, req *http.Request) error {
+	defer closer(req.Body)
+
+	enc, mediaType, err := BufferedMediaTypes.Encoder(req)
+	if err != nil {
+		return err
+	}
+	opts, err := parseOptions(req.URL.Query())
+	if err != nil {
+		return err
+	}
+	key := mux.Vars(req)["key"]
+	root, ok := treeStoreFrom(req.Context()).get(key)
+	if !ok {
+		return newStatusError(http.StatusNotFound, "tree %q not found", key)
+	}
+
+	res, err := opts.page(req, func() ([]Facet, error) {
+		return root.selectFacets(opts.selector), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	setNextLink(rw, req, &res)
+	rw.Header().Set("Content-Type", mediaType)
+	return enc(rw, req, &res)
+}
+
+// SnapshotHandler returns handler of the keyed trees snapshots:
+//
+//	GET /api/v1/admin/snapshot  downloads the snapshot
+//	POST /api/v1/admin/snapshot writes the snapshot to path
+//
+// Requests must be authorized by "Authorization: Bearer <token>", the
+// endpoint is disabled when token is empty.
+func SnapshotHandler(path, token string) func(http.ResponseWriter, *http.Request) error {
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		defer closer(req.Body)
+
+		if token == "" {
+			return newStatusError(http.StatusForbidden, "admin token is not configured")
+		}
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			return newStatusError(http.StatusUnauthorized, "invalid admin token")
+		}
+		if req.Method == http.MethodPost && path == "" {
+			return newStatusError(http.StatusConflict, "snapshot path is not configured")
+		}
+		b, err := treeStoreFrom(req.Context()).snapshot()
+		if err != nil {
+			return err
+		}
+		if req.Method == http.MethodGet {
+			rw.Header().Set("Content-Type", "application/octet-stream")
+			rw.Header().Set("Content-Disposition", `attachment; filename="snapshot.facets"`)
+			_, err = rw.Write(b)
+			return err
+		}
+
+		if err := SaveSnapshot(path, b); err != nil {
+			return err
+		}
+		rw.Header().Set("Content-Type", mediaTypeJSON)
+		return jsoniter.NewEncoder(rw).Encode(map[string]interface{}{"path": path, "size": len(b)})
+	}
+}
+
+// snapshotFileJSON is the payload of snapshot file.
+type snapshotFileJSON struct {
+	Created time.Time         `json:"created"`
+	Trees   []json.RawMessage `json:"trees"`
+}
+
+// snapshotTreeJSON is one tree of snapshot file, exact is true when its
+// counts are exact numbers.
+type snapshotTreeJSON struct {
+	Key   string `json:"key"`
+	Exact bool   `json:"exact"`
+	Data  *Node  `json:"data"`
+}
+
+// encodeSnapshot returns the snapshot file of trees. The file starts with
+// "facets-snapshot <version>" line, followed by "sha256:<hex>" line with the
+// checksum of the rest of the file, the JSON payload.
+func encodeSnapshot(trees map[string]*Node, created time.Time) ([]byte, error) {
+	keys := make([]string, 0, len(trees))
+	for key := range trees {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	payload := snapshotFileJSON{Created: created.UTC(), Trees: make([]json.RawMessage, len(keys))}
+	for i, key := range keys {
+		b, err := json.Marshal(snapshotTreeJSON{Key: key, Exact: trees[key].hasExact(), Data: trees[key]})
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to write tree %q", key)
+		}
+		payload.Trees[i] = b
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to write snapshot")
+	}
+	sum := sha256.Sum256(b)
+	header := fmt.Sprintf("%s %d\nsha256:%s\n", snapshotMagic, snapshotVersion, hex.EncodeToString(sum[:]))
+	return append([]byte(header), b...), nil
+}
+
+// ReadSnapshot returns the trees of snapshot file b by their keys. Files of
+// unknown version, with checksum mismatch or invalid trees are rejected.
+func ReadSnapshot(b []byte) (map[string]*Node, error) {
+	var (
+		version  int
+		checksum string
+	)
+	lines := bytes.SplitN(b, []byte("\n"), 3)
+	if len(lines) < 3 {
+		return nil, errors.New("invalid snapshot, missing header")
+	}
+	if n, err := fmt.Sscanf(string(lines[0]), snapshotMagic+" %d", &version); err != nil || n != 1 {
+		return nil, errors.New("invalid snapshot, not a facets snapshot")
+	}
+	if version != snapshotVersion {
+		return nil, errors.Errorf("unsupported snapshot version %d, supported: %d", version, snapshotVersion)
+	}
+	if n, err := fmt.Sscanf(string(lines[1]), "sha256:%s", &checksum); err != nil || n != 1 {
+		return nil, errors.New("invalid snapshot, missing checksum")
+	}
+	sum := sha256.Sum256(lines[2])
+	if checksum != hex.EncodeToString(sum[:]) {
+		return nil, errors.New("invalid snapshot, checksum mismatch")
+	}
+
+	var payload snapshotFileJSON
+	if err := json.Unmarshal(lines[2], &payload); err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot")
+	}
+	trees := make(map[string]*Node, len(payload.Trees))
+	for _, raw := range payload.Trees {
+		var tree struct {
+			Key   string `json:"key"`
+			Exact bool   `json:"exact"`
+		}
+		if err := json.Unmarshal(raw, &tree); err != nil {
+			return nil, errors.Wrap(err, "invalid snapshot")
+		}
+		if _, ok := trees[tree.Key]; ok || !datasetName.MatchString(tree.Key) {
+			return nil, errors.Errorf("invalid snapshot, invalid or duplicate key %q", tree.Key)
+		}
+		v := &Validator{mode: ValidationStrict}
+		root, err := treeReader{exact: tree.Exact, v: v}.data(raw)
+		if err == nil {
+			err = v.Err()
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid snapshot tree %q", tree.Key)
+		}
+		trees[tree.Key] = root
+	}
+	return trees, nil
+}
+
+// SaveSnapshot verifies the snapshot file b and writes it to path, the
+// previous file is replaced atomically.
+func SaveSnapshot(path string, b []byte) error {
+	if _, err := ReadSnapshot(b); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// restoreTrees returns store of the trees of snapshot at path, empty store
+// when path is empty or the file does not exist. The restored trees are kept
+// even when there are more than max of them.
+func restoreTrees(path string, max int) (*treeStore, error) {
+	store := newTreeStore(max)
+	if path == "" {
+		return store, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read snapshot")
+	}
+	if store.trees, err = ReadSnapshot(b); err != nil {
+		return nil, errors.Wrapf(err, "unable to restore snapshot %s", path)
+	}
+	return store, nil
+}
+
+// writeFileAtomic writes b to a temporary file, syncs it and renames it to
+// path, so that path contains either the previous or the new content. The
+// directory is synced too, so that the rename survives a crash.
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "unable to write %s", path)
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tmp.Name()); removeErr != nil {
+			log.Warn("Unable to remove temporary file", "path", tmp.Name(), "err", removeErr)
+		}
+		return errors.Wrapf(err, "unable to write %s", path)
+	}
+	return errors.Wrapf(syncDir(dir), "unable to write %s", path)
+}
+
+// syncDir syncs the directory entries of dir.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// hasExact returns true when any leaf of the tree has exact count.
+func (n *Node) hasExact() bool {
+	if n.Exact != nil {
+		return true
+	}
+	for _, child := range n.Children {
+		if child.hasExact() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package api_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// adminRequest sends admin request with token to router.
+func adminRequest(t *testing.T, router http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTrees(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	rr := request(t, router, "POST", "/api/v1/buffered?key=segment1", testBody)
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+
+	tests := []struct {
+		name     string
+		path     string
+		code     int
+		expected string
+	}{
+		{"stored", "/api/v1/trees/segment1", http.StatusOK, expectedOutput},
+		{"select", "/api/v1/trees/segment1?select=facet1/facet3/facet4", http.StatusOK, `{"result": [{"facet4": 50}, {"facet6": 20}, {"facet7": 30}]}`},
+		{"missing", "/api/v1/trees/segment2", http.StatusNotFound, ""},
+		{"invalid key", "/api/v1/buffered?key=.segment1", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "GET"
+			if strings.HasPrefix(tt.path, "/api/v1/buffered") {
+				method = "POST"
+			}
+			rr := request(t, router, method, tt.path, testBody)
+			assert.Equal(t, tt.code, rr.Code, "status code differs")
+			if tt.expected != "" {
+				assert.JSONEq(t, tt.expected, rr.Body.String(), "response body differs")
+			}
+		})
+	}
+
+	// The last posted tree is kept.
+	request(t, router, "POST", "/api/v1/buffered?key=segment1", `{"data": {"facet2": {"count": 3}}}`)
+	rr = request(t, router, "GET", "/api/v1/trees/segment1", "")
+	assert.JSONEq(t, `{"result": [{"facet2": 3}]}`, rr.Body.String(), "response body differs")
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.facets")
+
+	router := api.NewRouter(api.Config{SnapshotPath: path, AdminToken: "secret"})
+	request(t, router, "POST", "/api/v1/buffered?key=segment1", testBody)
+	request(t, router, "POST", "/api/v1/buffered?key=exact&numbers=exact", exactBody)
+
+	rr := adminRequest(t, router, "POST", "/api/v1/admin/snapshot", "secret")
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = adminRequest(t, router, "GET", "/api/v1/admin/snapshot", "secret")
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	b := rr.Body.Bytes()
+
+	for _, snapshot := range [][]byte{written, b} {
+		trees, err := api.ReadSnapshot(snapshot)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Len(t, trees, 2, "trees differ")
+		facets := trees["segment1"].Facets()
+		assert.Equal(t, "facet1", facets[0].Name, "facet differs")
+		assert.Equal(t, float64(100), facets[0].Count, "count differs")
+		for _, facet := range trees["exact"].Facets() {
+			if facet.Name == "a" {
+				assert.Equal(t, "9007199254740993", facet.Exact.RatString(), "exact count differs")
+			}
+		}
+	}
+
+	corrupt := []struct {
+		name     string
+		snapshot []byte
+		err      string
+	}{
+		{"empty", nil, "invalid snapshot, missing header"},
+		{"not snapshot", []byte(testBody), "invalid snapshot, not a facets snapshot"},
+		{"version", bytes.Replace(b, []byte("facets-snapshot 1"), []byte("facets-snapshot 2"), 1), "unsupported snapshot version 2, supported: 1"},
+		{"checksum", bytes.Replace(b, []byte(`"count":20`), []byte(`"count":21`), 1), "invalid snapshot, checksum mismatch"},
+		{"truncated", b[:len(b)-10], "invalid snapshot, checksum mismatch"},
+	}
+	for _, tt := range corrupt {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := api.ReadSnapshot(tt.snapshot)
+			assert.EqualError(t, err, tt.err, "error differs")
+			assert.Error(t, api.SaveSnapshot(path, tt.snapshot), "corrupt snapshot saved")
+		})
+	}
+
+	// Rejected snapshots do not replace the file.
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, written, after, "snapshot file differs")
+}
+
+func TestSnapshotNotConfigured(t *testing.T) {
+	rr := adminRequest(t, api.NewRouter(api.Config{AdminToken: "secret"}), "POST", "/api/v1/admin/snapshot", "secret")
+	assert.Equal(t, http.StatusConflict, rr.Code, "status code differs")
+}
+
+func TestSnapshotAuthorization(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  string
+		token string
+		code  int
+	}{
+		{"disabled", "", "", http.StatusForbidden},
+		{"missing", "secret", "", http.StatusUnauthorized},
+		{"invalid", "secret", "secrets", http.StatusUnauthorized},
+		{"valid", "secret", "secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := api.NewRouter(api.Config{AdminToken: tt.conf})
+			rr := adminRequest(t, router, "GET", "/api/v1/admin/snapshot", tt.token)
+			assert.Equal(t, tt.code, rr.Code, "status code differs")
+		})
+	}
+}
+
+func TestTreesLimit(t *testing.T) {
+	router := api.NewRouter(api.Config{MaxTrees: 1})
+	rr := request(t, router, "POST", "/api/v1/buffered?key=segment1", testBody)
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	rr = request(t, router, "POST", "/api/v1/buffered?key=segment2", testBody)
+	assert.Equal(t, http.StatusInsufficientStorage, rr.Code, "status code differs")
+	rr = request(t, router, "GET", "/api/v1/trees/segment2", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code, "status code differs")
+
+	// Existing key may be replaced.
+	rr = request(t, router, "POST", "/api/v1/buffered?key=segment1", `{"data": {"facet2": {"count": 3}}}`)
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Result orders, selected by ?sort= option.
+const (
+	// SortName orders facets by name (the default).
+	SortName = "name"
+	// SortNatural orders facets by name, numbers in names are compared by
+	// their value, so facet9 comes before facet10.
+	SortNatural = "natural"
+	// SortCountDesc orders facets by count from the highest, ties by name.
+	SortCountDesc = "count_desc"
+	// SortCountAsc orders facets by count from the lowest, ties by name.
+	SortCountAsc = "count_asc"
+	// SortDocument orders facets depth-first in the order they appear in the
+	// input document, parents before their children.
+	SortDocument = "document"
+	// SortTree orders facets by their position in the tree, parents followed by
+	// their children, siblings by natural name.
+	SortTree = "tree"
+)
+
+// sortOrders are the supported orders, in the order of documentation.
+var sortOrders = []string{SortName, SortNatural, SortCountDesc, SortCountAsc, SortDocument, SortTree}
+
+// parseSort validates the ?sort= option, empty value is SortName.
+func parseSort(v string) (string, error) {
+	if v == "" {
+		return SortName, nil
+	}
+	if !contains(sortOrders, v) {
+		return "", newStatusError(http.StatusBadRequest, "unknown sort %q, supported: %s", v, strings.Join(sortOrders, ", "))
+	}
+	return v, nil
+}
+
+// sortFacets sorts facets in given order. Facets are expected in document
+// order (as returned from Node.Facets or the streaming parser), facets
+// appended by filters come after them.
+func sortFacets(facets []Facet, order string) {
+	switch order {
+	case SortCountDesc, SortCountAsc:
+		sort.SliceStable(facets, func(i, j int) bool {
+			if c := compareCounts(&facets[i], &facets[j]); c != 0 {
+				return (c > 0) == (order == SortCountDesc)
+			}
+			return naturalLess(facets[i].Name, facets[j].Name)
+		})
+	case SortNatural:
+		sort.SliceStable(facets, func(i, j int) bool {
+			return naturalLess(facets[i].Name, facets[j].Name)
+		})
+	case SortDocument:
+		// Facets of the same parent are in document order already, "other"
+		// facets added by filters have to be moved into their parent.
+		position := make(map[string]int, len(facets))
+		for i := range facets {
+			position[pathKey(facets[i].Path)] = i
+		}
+		sortByTree(facets, func(a, b []string) bool {
+			return position[pathKey(a)] < position[pathKey(b)]
+		})
+	case SortTree:
+		sortByTree(facets, func(a, b []string) bool {
+			return naturalLess(a[len(a)-1], b[len(b)-1])
+		})
+	default:
+		sort.SliceStable(facets, func(i, j int) bool {
+			if facets[i].Name != facets[j].Name {
+				return facets[i].Name < facets[j].Name
+			}
+			// Facets of the same name in different branches.
+			return pathKey(facets[i].Path) < pathKey(facets[j].Path)
+		})
+	}
+}
+
+// sortByTree sorts facets depth-first, every facet is followed by its
+// descendants, siblingLess compares paths of two siblings.
+func sortByTree(facets []Facet, siblingLess func(a, b []string) bool) {
+	sort.SliceStable(facets, func(i, j int) bool {
+		a, b := facets[i].Path, facets[j].Path
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return siblingLess(a[:k+1], b[:k+1])
+			}
+		}
+		// Ancestor comes before its descendants.
+		return len(a) < len(b)
+	})
+}
+
+// sortNodes sorts children of n and all its descendants in given order, so
+// that tree outputs follow the same order as the facets. Children are in
+// document order already.
+func sortNodes(n *Node, order string) {
+	if order == SortDocument || len(n.Children) == 0 {
+		return
+	}
+
+	var counts map[*Node]float64
+	if order == SortCountDesc || order == SortCountAsc {
+		counts = make(map[*Node]float64, len(n.Children))
+		for _, child := range n.Children {
+			counts[child] = child.SumChildren()
+		}
+	}
+	sort.SliceStable(n.Children, func(i, j int) bool {
+		a, b := n.Children[i], n.Children[j]
+		switch order {
+		case SortCountDesc, SortCountAsc:
+			if counts[a] != counts[b] {
+				return (counts[a] > counts[b]) == (order == SortCountDesc)
+			}
+			return naturalLess(a.Name, b.Name)
+		case SortNatural, SortTree:
+			return naturalLess(a.Name, b.Name)
+		}
+		return a.Name < b.Name
+	})
+	for _, child := range n.Children {
+		sortNodes(child, order)
+	}
+}
+
+// compareCounts returns -1, 0 or 1 when count of a is lower, equal or higher
+// than count of b, exact counts are compared exactly.
+func compareCounts(a, b *Facet) int {
+	if a.Exact != nil && b.Exact != nil {
+		return a.Exact.Cmp(b.Exact)
+	}
+	switch {
+	case a.Count < b.Count:
+		return -1
+	case a.Count > b.Count:
+		return 1
+	}
+	return 0
+}
+
+// naturalLess compares names so that runs of digits are compared by their
+// numeric value: "facet9" < "facet10". Numbers with the same value but
+// different leading zeros, and otherwise equal names, are compared as
+// strings.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return a[i] < b[j]
+			}
+			i++
+			j++
+			continue
+		}
+
+		// Compare the numbers without leading zeros, longer is bigger.
+		ai, bj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		x, y := strings.TrimLeft(a[ai:i], "0"), strings.TrimLeft(b[bj:j], "0")
+		if len(x) != len(y) {
+			return len(x) < len(y)
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,201 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSort(t *testing.T) {
+	body := `{"data": {
+		"facet10": {"facet2": {"count": 5}, "facet11": {"count": 1}},
+		"facet9": {"count": 20},
+		"facet1": {"facet3": {"count": 7}}
+	}}`
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{"default", "", `{"result": [{"facet1": 7}, {"facet10": 6}, {"facet11": 1}, {"facet2": 5}, {"facet3": 7}, {"facet9": 20}]}`},
+		{"name", "?sort=name", `{"result": [{"facet1": 7}, {"facet10": 6}, {"facet11": 1}, {"facet2": 5}, {"facet3": 7}, {"facet9": 20}]}`},
+		{"natural", "?sort=natural", `{"result": [{"facet1": 7}, {"facet2": 5}, {"facet3": 7}, {"facet9": 20}, {"facet10": 6}, {"facet11": 1}]}`},
+		{"count desc", "?sort=count_desc", `{"result": [{"facet9": 20}, {"facet1": 7}, {"facet3": 7}, {"facet10": 6}, {"facet2": 5}, {"facet11": 1}]}`},
+		{"count asc", "?sort=count_asc", `{"result": [{"facet11": 1}, {"facet2": 5}, {"facet10": 6}, {"facet1": 7}, {"facet3": 7}, {"facet9": 20}]}`},
+		{"document", "?sort=document", `{"result": [{"facet10": 6}, {"facet2": 5}, {"facet11": 1}, {"facet9": 20}, {"facet1": 7}, {"facet3": 7}]}`},
+		{"tree", "?sort=tree", `{"result": [{"facet1": 7}, {"facet3": 7}, {"facet9": 20}, {"facet10": 6}, {"facet2": 5}, {"facet11": 1}]}`},
+		{"document with other", "?sort=document&top=1&other=true", `{"result": [{"facet9": 20}, {"other": 13}]}`},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				// JSONEq compares arrays in order.
+				assert.JSONEq(t, tt.expected, rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+func TestSortDocumentFormats(t *testing.T) {
+	tree := `{"data": {
+		"facet10": {"facet2": {"count": 5}, "facet11": {"count": 1}},
+		"facet9": {"count": 20},
+		"facet1": {"facet3": {"count": 7}}
+	}}`
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        []byte
+	}{
+		{
+			"yaml", "", "application/yaml",
+			[]byte("data:\n  facet10:\n    facet2: {count: 5}\n    facet11: {count: 1}\n  facet9: {count: 20}\n  facet1:\n    facet3: {count: 7}\n"),
+		},
+		{
+			"toml", "", "application/toml",
+			[]byte("[data.facet10.facet2]\ncount = 5\n[data.facet10.facet11]\ncount = 1\n[data.facet9]\ncount = 20\n[data.facet1.facet3]\ncount = 7\n"),
+		},
+		{"msgpack", "", "application/msgpack", parseTree(t, tree).MarshalMsgpack()},
+		{
+			"flat", "&layout=flat", "application/json",
+			[]byte(`{"facet10.facet2": 5, "facet10.facet11": 1, "facet9": 20, "facet1.facet3": 7}`),
+		},
+	}
+
+	router := api.NewRouter(api.Config{})
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				rr := binaryRequest(t, router, path+"?sort=document"+tt.query, tt.contentType, "application/json", tt.body)
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				assert.JSONEq(t, `{"result": [{"facet10": 6}, {"facet2": 5}, {"facet11": 1}, {"facet9": 20}, {"facet1": 7}, {"facet3": 7}]}`,
+					rr.Body.String(), "response body differs")
+			})
+		}
+	}
+}
+
+func TestSortCSV(t *testing.T) {
+	body := `{"data": {"facet10": {"count": 1}, "facet9": {"facet2": {"count": 2}}}}`
+	req, err := http.NewRequest("POST", "/api/v1/streaming?format=csv&sort=tree", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.Equal(t, `facet,path,depth,parent,count
+facet9,facet9,1,,2
+facet2,facet9/facet2,2,facet9,2
+facet10,facet10,1,,1
+`, rr.Body.String(), "response body differs")
+}
+
+func TestSortTrees(t *testing.T) {
+	body := `[{"data": {"facet10": {"count": 1}, "facet9": {"facet2": {"count": 2}, "facet1": {"count": 3}}}},
+		{"data": {"facet10": {"count": 9}}}]`
+	tests := []struct {
+		path     string
+		query    string
+		expected string
+	}{
+		{"/api/v1/merge", "?sort=count_desc", `{
+			"data": {"facet10": {"count": 10}, "facet9": {"facet1": {"count": 3}, "facet2": {"count": 2}}},
+			"result": [{"facet10": 10}, {"facet9": 5}, {"facet1": 3}, {"facet2": 2}],
+			"conflicts": []
+		}`},
+		{"/api/v1/merge", "?sort=document", `{
+			"data": {"facet10": {"count": 10}, "facet9": {"facet2": {"count": 2}, "facet1": {"count": 3}}},
+			"result": [{"facet10": 10}, {"facet9": 5}, {"facet2": 2}, {"facet1": 3}],
+			"conflicts": []
+		}`},
+		{"/api/v1/batch", "?sort=natural", `{"results": [
+			{"name": "", "result": [{"facet1": 3}, {"facet2": 2}, {"facet9": 5}, {"facet10": 1}]},
+			{"name": "", "result": [{"facet10": 9}]}
+		]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.TrimPrefix(tt.path, "/api/v1/")+" "+tt.query, func(t *testing.T) {
+			req, err := http.NewRequest("POST", tt.path+tt.query, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+			assert.JSONEq(t, tt.expected, rr.Body.String(), "response body differs")
+			if strings.HasSuffix(tt.path, "merge") {
+				// JSONEq does not compare the order of object keys.
+				data := rr.Body.String()[:strings.Index(rr.Body.String(), `"result"`)]
+				assert.Equal(t, strings.Index(data, "facet10") < strings.Index(data, "facet9"), true, "tree order differs")
+				assert.Equal(t, strings.Index(data, "facet1\"") < strings.Index(data, "facet2"), tt.query == "?sort=count_desc", "tree order differs")
+			}
+		})
+	}
+}
+
+func TestSortDiff(t *testing.T) {
+	body := `[{"data": {"facet10": {"count": 1}, "facet9": {"count": 2}}}, {"data": {"facet9": {"count": 1}, "facet1": {"count": 5}}}]`
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"", "+ facet1: 0 -> 5 (+5)\n- facet10: 1 -> 0 (-1, -100.0%)\n  facet9: 2 -> 1 (-1, -50.0%)\n"},
+		{"?sort=natural", "+ facet1: 0 -> 5 (+5)\n  facet9: 2 -> 1 (-1, -50.0%)\n- facet10: 1 -> 0 (-1, -100.0%)\n"},
+		{"?sort=count_desc", "+ facet1: 0 -> 5 (+5)\n  facet9: 2 -> 1 (-1, -50.0%)\n- facet10: 1 -> 0 (-1, -100.0%)\n"},
+		{"?sort=document", "- facet10: 1 -> 0 (-1, -100.0%)\n  facet9: 2 -> 1 (-1, -50.0%)\n+ facet1: 0 -> 5 (+5)\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run("diff "+tt.query, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/v1/diff"+tt.query, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept", "text/plain")
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+			assert.Equal(t, tt.expected, rr.Body.String(), "response body differs")
+		})
+	}
+}
+
+func TestUnknownSort(t *testing.T) {
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming", "/api/v1/batch", "/api/v1/merge", "/api/v1/diff"} {
+		t.Run(strings.TrimPrefix(path, "/api/v1/"), func(t *testing.T) {
+			req, err := http.NewRequest("POST", path+"?sort=random", strings.NewReader(`[]`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+		})
+	}
+}
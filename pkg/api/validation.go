@@ -0,0 +1,234 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Validation modes, selected by ?validation= option. Leaf is invalid when its
+// count is not a number, is negative or not finite, or when facet value is
+// not an object (e.g. "facet2": 5 or "facet2": null).
+const (
+	// ValidationLenient reads facet values which are not objects as leaves
+	// with count 0 (the default), as the earlier versions did, other invalid
+	// leaves fail the request just like in strict mode.
+	ValidationLenient = "lenient"
+	// ValidationStrict fails the request when any leaf is invalid, all the
+	// invalid leaves are reported.
+	ValidationStrict = "strict"
+	// ValidationCoerce accepts numeric strings as counts ("count": "10"),
+	// other invalid leaves fail the request just like in strict mode.
+	ValidationCoerce = "coerce"
+	// ValidationSkip leaves out the invalid leaves, they are reported along
+	// with the result.
+	ValidationSkip = "skip"
+)
+
+// maxReportedLeaves limits the number of invalid leaves in error message,
+// all of them are listed in the error response.
+const maxReportedLeaves = 10
+
+// numberLiteral matches numeric strings accepted in coerce mode.
+var numberLiteral = regexp.MustCompile(`^-?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+
+// InvalidLeaf is a leaf of the input with invalid value.
+type InvalidLeaf struct {
+	Path   string      `json:"path"`
+	Value  interface{} `json:"value"`
+	Reason string      `json:"reason"`
+}
+
+// ValidationError lists all the invalid leaves of the input.
+type ValidationError struct {
+	Leaves []InvalidLeaf
+}
+
+// Error implements error interface.
+func (e *ValidationError) Error() string {
+	var parts []string
+	for i, leaf := range e.Leaves {
+		if i == maxReportedLeaves {
+			parts = append(parts, "...")
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", leaf.Path, leaf.Reason))
+	}
+	return fmt.Sprintf("%d invalid leaves: %s", len(e.Leaves), strings.Join(parts, "; "))
+}
+
+// StatusCode implements Error interface.
+func (e *ValidationError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// Validator validates the leaves of one input according to the validation
+// mode, decoders pass it every count they read.
+type Validator struct {
+	mode    string
+	invalid []InvalidLeaf
+}
+
+// NewValidator returns validator of the ?validation= mode of params, lenient
+// by default.
+func NewValidator(params url.Values) (*Validator, error) {
+	switch mode := params.Get("validation"); mode {
+	case "":
+		return &Validator{mode: ValidationLenient}, nil
+	case ValidationLenient, ValidationStrict, ValidationCoerce, ValidationSkip:
+		return &Validator{mode: mode}, nil
+	default:
+		return nil, newStatusError(
+			http.StatusBadRequest, "unknown validation %q, supported: %s, %s, %s, %s",
+			mode, ValidationLenient, ValidationStrict, ValidationCoerce, ValidationSkip,
+		)
+	}
+}
+
+// Count validates count value of the leaf at path, value is the decoded
+// value (float64, json.Number, string, nil, ...). It returns false when the
+// leaf is invalid, the leaf is recorded then.
+func (v *Validator) Count(path []string, value interface{}) (float64, bool) {
+	count, _, ok := v.number(path, value, false)
+	return count, ok
+}
+
+// Invalid records invalid leaf at path.
+func (v *Validator) Invalid(path []string, value interface{}, reason string) {
+	switch value.(type) {
+	case documentObject, []interface{}:
+		// Only scalars are reported, the reason tells the type.
+		value = nil
+	}
+	v.invalid = append(v.invalid, InvalidLeaf{
+		Path:   strings.Join(path, "/"),
+		Value:  value,
+		Reason: reason,
+	})
+}
+
+// Err returns ValidationError listing the invalid leaves, nil when there are
+// none or they are skipped.
+func (v *Validator) Err() error {
+	if len(v.invalid) == 0 || v.mode == ValidationSkip {
+		return nil
+	}
+	return &ValidationError{Leaves: v.invalid}
+}
+
+// Skipped returns the invalid leaves left out in skip mode.
+func (v *Validator) Skipped() []InvalidLeaf {
+	if v == nil || v.mode != ValidationSkip {
+		return nil
+	}
+	return v.invalid
+}
+
+// setSkipped sets X-Skipped-Leaves header to the number of leaves skipped in
+// res, so that outputs without the "skipped" list (CSV) tell about them too.
+func setSkipped(rw http.ResponseWriter, res *Result) {
+	if len(res.Skipped) > 0 {
+		rw.Header().Set("X-Skipped-Leaves", strconv.Itoa(len(res.Skipped)))
+	}
+}
+
+// nonObject records facet value which is not an object.
+func (v *Validator) nonObject(path []string, value interface{}) {
+	v.Invalid(path, value, fmt.Sprintf("facet value is invalid type %s, must be object", typeName(value)))
+}
+
+// emptyLeaf returns true when facet value which is not an object is read as
+// leaf with count 0 in lenient mode, otherwise the value is recorded.
+func (v *Validator) emptyLeaf(path []string, value interface{}) bool {
+	if v.mode == ValidationLenient {
+		return true
+	}
+	v.nonObject(path, value)
+	return false
+}
+
+// number validates count value, the exact count is returned in exact mode.
+func (v *Validator) number(path []string, value interface{}, exact bool) (float64, *big.Rat, bool) {
+	var literal string
+	switch t := value.(type) {
+	case float64:
+		if !exact {
+			return v.check(path, value, t, nil)
+		}
+		literal = strconv.FormatFloat(t, 'g', -1, 64)
+	case json.Number:
+		literal = string(t)
+	case string:
+		literal = strings.TrimSpace(t)
+		if v.mode != ValidationCoerce || !numberLiteral.MatchString(literal) {
+			v.Invalid(path, value, fmt.Sprintf("count value is invalid type %s", typeName(value)))
+			return 0, nil, false
+		}
+	default:
+		v.Invalid(path, value, fmt.Sprintf("count value is invalid type %s", typeName(value)))
+		return 0, nil, false
+	}
+
+	if exact {
+		r, err := parseExact(json.Number(literal))
+		if err != nil {
+			v.Invalid(path, value, "count value is out of range")
+			return 0, nil, false
+		}
+		count, _ := r.Float64()
+		return v.check(path, value, count, r)
+	}
+	// Out of range numbers are infinite.
+	count, _ := strconv.ParseFloat(literal, 64)
+	return v.check(path, value, count, nil)
+}
+
+// check validates the count, counts are occurrences, so they must be finite
+// and non-negative.
+func (v *Validator) check(path []string, value interface{}, count float64, exact *big.Rat) (float64, *big.Rat, bool) {
+	switch {
+	case math.IsNaN(count) || math.IsInf(count, 0):
+		v.Invalid(path, value, "count value is not finite")
+		return 0, nil, false
+	case count < 0 || (exact != nil && exact.Sign() < 0):
+		v.Invalid(path, value, "count value is negative")
+		return 0, nil, false
+	}
+	return count, exact, true
+}
+
+// mark returns the position to rewind to, when the leaves recorded since
+// then turn out to be ignored.
+func (v *Validator) mark() int {
+	return len(v.invalid)
+}
+
+// rewind forgets the leaves recorded since mark.
+func (v *Validator) rewind(mark int) {
+	v.invalid = v.invalid[:mark]
+}
+
+// typeName returns JSON type name of decoded value.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case float64, json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	case documentObject, map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,199 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const invalidBody = `{"data": {
+	"facet1": {"facet3": {"count": 10}, "facet4": {"count": "20"}},
+	"facet2": {"count": -1},
+	"facet5": null,
+	"facet6": {"facet7": {"count": 5}, "count": true}
+}}`
+
+func TestValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		body     string
+		expected string
+		skipped  string
+	}{
+		{
+			"coerce", "?validation=coerce",
+			`{"data": {"facet1": {"facet3": {"count": 10}, "facet4": {"count": " 2.5e1 "}}}}`,
+			`[{"facet1": 35}, {"facet3": 10}, {"facet4": 25}]`, "",
+		},
+		{
+			"skip", "?validation=skip", invalidBody,
+			`[{"facet1": 10}, {"facet3": 10}]`, "4",
+		},
+		{
+			"skip facet of the same name", "?validation=skip",
+			`{"data": {"facet1": {"x": {"count": 1}}, "facet2": {"y": {"count": 2}, "x": {"count": [3, "a"]}, "z": {"count": 4}}}}`,
+			`[{"facet1": 1}, {"facet2": 6}, {"x": 1}, {"y": 2}, {"z": 4}]`, "1",
+		},
+		{
+			"lenient", "", `{"data": {"facet1": {"facet3": {"count": 1}, "facet4": 5}, "facet2": null}}`,
+			`[{"facet1": 1}, {"facet2": 0}, {"facet3": 1}, {"facet4": 0}]`, "",
+		},
+		{
+			"empty object", "", `{"data": {"facet1": {}, "facet2": {"count": 0}}}`,
+			`[{"facet1": 0}, {"facet2": 0}]`, "",
+		},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+				var out struct {
+					Result json.RawMessage `json:"result"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+					t.Fatal(err)
+				}
+				assert.JSONEq(t, tt.expected, string(out.Result), "result differs")
+				assert.Equal(t, tt.skipped, rr.Header().Get("X-Skipped-Leaves"), "skipped leaves header differs")
+			})
+		}
+	}
+}
+
+func TestValidationReported(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		code        int
+		field       string
+		expected    string
+	}{
+		{
+			"lenient", "", "application/json", invalidBody, http.StatusBadRequest, "invalid",
+			`[
+				{"path": "facet1/facet4", "value": "20", "reason": "count value is invalid type string"},
+				{"path": "facet2", "value": -1, "reason": "count value is negative"},
+				{"path": "facet6", "value": true, "reason": "count value is invalid type bool"}
+			]`,
+		},
+		{
+			"strict", "?validation=strict", "application/json", invalidBody, http.StatusBadRequest, "invalid",
+			`[
+				{"path": "facet1/facet4", "value": "20", "reason": "count value is invalid type string"},
+				{"path": "facet2", "value": -1, "reason": "count value is negative"},
+				{"path": "facet5", "value": null, "reason": "facet value is invalid type null, must be object"},
+				{"path": "facet6", "value": true, "reason": "count value is invalid type bool"}
+			]`,
+		},
+		{
+			"coerce", "?validation=coerce", "application/json", invalidBody, http.StatusBadRequest, "invalid",
+			`[
+				{"path": "facet2", "value": -1, "reason": "count value is negative"},
+				{"path": "facet5", "value": null, "reason": "facet value is invalid type null, must be object"},
+				{"path": "facet6", "value": true, "reason": "count value is invalid type bool"}
+			]`,
+		},
+		{
+			"skip", "?validation=skip", "application/json", invalidBody, http.StatusOK, "skipped",
+			`[
+				{"path": "facet1/facet4", "value": "20", "reason": "count value is invalid type string"},
+				{"path": "facet2", "value": -1, "reason": "count value is negative"},
+				{"path": "facet5", "value": null, "reason": "facet value is invalid type null, must be object"},
+				{"path": "facet6", "value": true, "reason": "count value is invalid type bool"}
+			]`,
+		},
+		{
+			"non-numeric string", "?validation=coerce", "application/json",
+			`{"data": {"facet1": {"count": "NaN"}, "facet2": {"count": "10 items"}, "facet3": [1]}}`,
+			http.StatusBadRequest, "invalid",
+			`[
+				{"path": "facet1", "value": "NaN", "reason": "count value is invalid type string"},
+				{"path": "facet2", "value": "10 items", "reason": "count value is invalid type string"},
+				{"path": "facet3", "value": 1, "reason": "facet value is invalid type number, must be object"}
+			]`,
+		},
+		{
+			"exact", "?numbers=exact&validation=coerce", "application/json",
+			`{"data": {"facet1": {"count": "-0.1"}, "facet2": {"count": "0.1"}}}`,
+			http.StatusBadRequest, "invalid",
+			`[{"path": "facet1", "value": "-0.1", "reason": "count value is negative"}]`,
+		},
+		{
+			"rows", "?validation=skip", "text/csv", "facet1,10\nfacet2,-5\nfacet3,NaN\nfacet4,abc\n", http.StatusOK, "skipped",
+			`[
+				{"path": "facet2", "value": "-5", "reason": "count value is negative"},
+				{"path": "facet3", "value": "NaN", "reason": "count value is not finite"},
+				{"path": "facet4", "value": "abc", "reason": "count value is not a number"}
+			]`,
+		},
+		{
+			"yaml", "?validation=strict", "application/yaml", "data:\n  facet1:\n    count: abc\n  facet2: 5\n", http.StatusBadRequest, "invalid",
+			`[
+				{"path": "facet1", "value": "abc", "reason": "count value is invalid type string"},
+				{"path": "facet2", "value": 5, "reason": "facet value is invalid type number, must be object"}
+			]`,
+		},
+		{
+			"flat", "?layout=flat&validation=coerce", "application/json",
+			`{"facet1.facet3": "5", "facet2": null}`, http.StatusBadRequest, "invalid",
+			`[{"path": "facet2", "value": null, "reason": "count value is invalid type null"}]`,
+		},
+	}
+
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(path, "/api/v1/")+" "+tt.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", tt.contentType)
+
+				rr := httptest.NewRecorder()
+				api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+				assert.Equal(t, tt.code, rr.Code, "status code differs")
+				var out map[string]json.RawMessage
+				if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+					t.Fatal(err)
+				}
+				assert.JSONEq(t, tt.expected, string(out[tt.field]), "%s leaves differ", tt.field)
+			})
+		}
+	}
+}
+
+func TestValidationInvalidMode(t *testing.T) {
+	for _, path := range []string{"/api/v1/buffered", "/api/v1/streaming"} {
+		t.Run(strings.TrimPrefix(path, "/api/v1/"), func(t *testing.T) {
+			req, err := http.NewRequest("POST", path+"?validation=loose", strings.NewReader(testBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			api.NewRouter(api.Config{}).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+			assert.Contains(t, rr.Body.String(), "unknown validation", "error message differs")
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/pkg/errors"
+)
+
+// walCompactSize is the number of log records after which the snapshot is
+// rewritten and the log truncated.
+const walCompactSize = 1000
+
+// datasetLog persists one dataset as snapshot file <name>.json and write-ahead
+// log <name>.wal. Every change is numbered, deltas are appended (and synced)
+// to the log before they are applied, PUT rewrites the snapshot. Records
+// older than the snapshot are skipped, so a crash between rewriting the
+// snapshot and truncating the log loses nothing.
+type datasetLog struct {
+	snapshotPath string
+	walPath      string
+	wal          *os.File
+	// seq is the number of the last change, records is the number of records
+	// in the log.
+	seq     uint64
+	records int
+}
+
+// walRecord is one line of the log.
+type walRecord struct {
+	Seq    uint64  `json:"seq"`
+	Deltas []Delta `json:"deltas"`
+}
+
+// snapshotJSON is the content of snapshot file.
+type snapshotJSON struct {
+	Seq  uint64 `json:"seq"`
+	Data *Node  `json:"data"`
+}
+
+// createDatasetLog creates empty log of new dataset.
+func createDatasetLog(dir, name string) (*datasetLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "unable to create datasets directory")
+	}
+	l := &datasetLog{
+		snapshotPath: filepath.Join(dir, name+".json"),
+		walPath:      filepath.Join(dir, name+".wal"),
+	}
+	var err error
+	l.wal, err = os.OpenFile(l.walPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create dataset log")
+	}
+	return l, nil
+}
+
+// loadDataset reads dataset from its snapshot and replays its log, nil when
+// there are neither. Incomplete last record of the log (interrupted write)
+// is dropped.
+func loadDataset(dir, name string) (*dataset, error) {
+	l := &datasetLog{
+		snapshotPath: filepath.Join(dir, name+".json"),
+		walPath:      filepath.Join(dir, name+".wal"),
+	}
+
+	root := &Node{}
+	b, err := ioutil.ReadFile(l.snapshotPath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, errors.Wrap(err, "unable to read dataset snapshot")
+	default:
+		snapshot := snapshotJSON{Data: root}
+		if err := json.Unmarshal(b, &snapshot); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse dataset snapshot %s", l.snapshotPath)
+		}
+		l.seq = snapshot.Seq
+	}
+
+	l.wal, err = os.OpenFile(l.walPath, os.O_RDWR|os.O_APPEND, 0644)
+	switch {
+	case os.IsNotExist(err) && l.seq == 0:
+		return nil, nil
+	case os.IsNotExist(err):
+		l.wal, err = os.OpenFile(l.walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create dataset log")
+		}
+		ds := newDataset(root)
+		ds.log = l
+		return ds, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "unable to open dataset log")
+	}
+
+	ds := newDataset(root)
+	ds.log = l
+	if err := l.replay(ds); err != nil {
+		if closeErr := l.wal.Close(); closeErr != nil {
+			log.Warn("Unable to close dataset log", "path", l.walPath, "err", closeErr)
+		}
+		return nil, err
+	}
+	return ds, nil
+}
+
+// replay applies the records of the log newer than the snapshot to ds.
+func (l *datasetLog) replay(ds *dataset) error {
+	var (
+		r      = bufio.NewReader(l.wal)
+		offset int64
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				// Interrupted write, the change was never acknowledged.
+				if err := l.wal.Truncate(offset); err != nil {
+					return errors.Wrap(err, "unable to truncate dataset log")
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to read dataset log")
+		}
+		offset += int64(len(line))
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return errors.Wrapf(err, "unable to parse dataset log %s at offset %d", l.walPath, offset-int64(len(line)))
+		}
+		l.records++
+		if record.Seq <= l.seq {
+			continue
+		}
+		l.seq = record.Seq
+		if err := ds.check(record.Deltas); err != nil {
+			return errors.Wrapf(err, "invalid record %d of dataset log %s", record.Seq, l.walPath)
+		}
+		ds.apply(record.Deltas)
+	}
+}
+
+// append writes the deltas to the log and syncs it.
+func (l *datasetLog) append(deltas []Delta) error {
+	b, err := json.Marshal(walRecord{Seq: l.seq + 1, Deltas: deltas})
+	if err != nil {
+		return errors.Wrap(err, "unable to write dataset log")
+	}
+	if _, err := l.wal.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "unable to write dataset log")
+	}
+	if err := l.wal.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync dataset log")
+	}
+	l.seq++
+	l.records++
+	return nil
+}
+
+// full returns true when the log should be compacted into the snapshot.
+func (l *datasetLog) full() bool {
+	return l.records >= walCompactSize
+}
+
+// snapshot replaces the snapshot with root as the next change and truncates
+// the log. The snapshot is replaced atomically.
+func (l *datasetLog) snapshot(root *Node) error {
+	b, err := json.Marshal(snapshotJSON{Seq: l.seq + 1, Data: root})
+	if err != nil {
+		return errors.Wrap(err, "unable to write dataset snapshot")
+	}
+	if err := writeFileAtomic(l.snapshotPath, b); err != nil {
+		return errors.Wrap(err, "unable to write dataset snapshot")
+	}
+	l.seq++
+
+	if err := l.wal.Truncate(0); err != nil {
+		return errors.Wrap(err, "unable to truncate dataset log")
+	}
+	l.records = 0
+	return nil
+}
+
+// remove closes and removes the log of dataset which has no snapshot.
+func (l *datasetLog) remove() error {
+	err := l.wal.Close()
+	if removeErr := os.Remove(l.walPath); err == nil {
+		err = removeErr
+	}
+	return errors.Wrap(err, "unable to remove dataset log")
+}
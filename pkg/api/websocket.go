@@ -0,0 +1,290 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// websocketGUID is appended to the client key to compute the accept key, RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocket close codes.
+const (
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseInvalidData = 1007
+	wsCloseTooBig      = 1009
+	wsCloseInternal    = 1011
+)
+
+// wsError is a protocol violation, the connection is closed with its code.
+type wsError struct {
+	code   uint16
+	reason string
+}
+
+func (e *wsError) Error() string {
+	return e.reason
+}
+
+// errWSClosed is returned when client closed the connection.
+var errWSClosed = errors.New("websocket closed by client")
+
+// wsConn is the server side of WebSocket connection.
+type wsConn struct {
+	conn         net.Conn
+	rw           *bufio.ReadWriter
+	maxSize      int64
+	writeTimeout time.Duration
+}
+
+// wsMaxCloseReason is the longest close reason fitting the control frame
+// payload of 125 bytes with the close code.
+const wsMaxCloseReason = 123
+
+// upgradeWebSocket validates the opening handshake, hijacks the connection
+// and completes the handshake. Browsers are only allowed from the origin of
+// the request host or from allowedOrigins. Messages are limited to maxSize
+// bytes, writes fail after writeTimeout.
+func upgradeWebSocket(rw http.ResponseWriter, req *http.Request, allowedOrigins []string, maxSize int64, writeTimeout time.Duration) (*wsConn, error) {
+	if !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket") {
+		return nil, newStatusError(http.StatusBadRequest, "websocket upgrade expected")
+	}
+	if origin := req.Header.Get("Origin"); origin != "" && !originAllowed(origin, req.Host, allowedOrigins) {
+		return nil, newStatusError(http.StatusForbidden, "websocket origin %q is not allowed", origin)
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, newStatusError(http.StatusUpgradeRequired, "unsupported websocket version %q, supported: 13", req.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return nil, newStatusError(http.StatusBadRequest, "invalid websocket key %q", key)
+	}
+
+	conn, brw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to upgrade connection")
+	}
+	// Deadlines of the server do not apply to the upgraded connection.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "unable to upgrade connection")
+	}
+	c := &wsConn{conn: conn, rw: brw, maxSize: maxSize, writeTimeout: writeTimeout}
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "unable to upgrade connection")
+	}
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "unable to upgrade connection")
+	}
+	return c, nil
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value of client key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// originAllowed returns true when origin (scheme://host[:port]) has the
+// request host or is one of allowed, ignoring case. Clients other than
+// browsers do not send Origin, so they are not checked.
+func originAllowed(origin, host string, allowed []string) bool {
+	for _, o := range allowed {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, host)
+}
+
+// headerContains returns true when comma separated header contains token,
+// ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, fragmented messages
+// are joined. Pings are answered and pongs ignored, errWSClosed is returned
+// when client closes the connection (the close is answered), wsError when
+// it violates the protocol.
+func (c *wsConn) readMessage() (opcode byte, message []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// The payload is empty or starts with 2 bytes of close code.
+			if len(payload) == 1 {
+				return 0, nil, &wsError{wsCloseProtocol, "invalid close frame"}
+			}
+			code := []byte{byte(wsCloseNormal >> 8), byte(wsCloseNormal & 0xff)}
+			if len(payload) >= 2 {
+				code = payload[:2]
+			}
+			c.writeFrame(wsClose, code)
+			return 0, nil, errWSClosed
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return 0, nil, &wsError{wsCloseProtocol, "new message before the previous one ended"}
+			}
+			opcode = op
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, &wsError{wsCloseProtocol, "continuation without message"}
+			}
+		default:
+			return 0, nil, &wsError{wsCloseProtocol, "unknown opcode"}
+		}
+
+		if int64(len(message)+len(payload)) > c.maxSize {
+			return 0, nil, &wsError{wsCloseTooBig, "message is too big"}
+		}
+		message = append(message, payload...)
+		if fin {
+			if opcode == wsText && !utf8.Valid(message) {
+				return 0, nil, &wsError{wsCloseInvalidData, "text message is not valid UTF-8"}
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.rw, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &wsError{wsCloseProtocol, "reserved bits are set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &wsError{wsCloseProtocol, "client frames must be masked"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if opcode >= wsClose && (!fin || length > 125) {
+		return false, 0, nil, &wsError{wsCloseProtocol, "invalid control frame"}
+	}
+	if length > uint64(c.maxSize) {
+		return false, 0, nil, &wsError{wsCloseTooBig, "message is too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes single unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return err
+	}
+	header := []byte{0x80 | opcode, 0}
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// close sends close frame with code and reason and closes the connection.
+// Reasons longer than wsMaxCloseReason bytes are truncated at a character
+// boundary.
+func (c *wsConn) close(code uint16, reason string) error {
+	if len(reason) > wsMaxCloseReason {
+		n := wsMaxCloseReason
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	c.writeFrame(wsClose, append(payload, reason...))
+	return c.conn.Close()
+}
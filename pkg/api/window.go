@@ -0,0 +1,385 @@
+package api
+
+import (
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWindowBucket    = 10 * time.Second
+	defaultWindowRetention = 24 * time.Hour
+
+	windowSliding  = "sliding"
+	windowTumbling = "tumbling"
+)
+
+// Event is a timestamped increment of a leaf count, facet names of the path
+// are separated by "/". Events without time happened now.
+type Event struct {
+	Time  *time.Time `json:"time,omitempty"`
+	Path  string     `json:"path"`
+	Delta float64    `json:"delta"`
+}
+
+// EventsJSON represents incoming events of time-windowed counter.
+type EventsJSON struct {
+	Events []Event `json:"events"`
+}
+
+// WindowHandler returns handler of time-windowed counters. Events are summed
+// into buckets of given size, buckets older than retention are dropped, so
+// the memory is bounded by the number of distinct leaves per bucket:
+//
+//	POST /api/v1/windows/{name} adds events: {"events": [{"time": "2018-06-01T10:00:00Z", "path": "facet1/facet3", "delta": 5}]}
+//	GET /api/v1/windows/{name}  returns the rollup of the events in window (?window=5m&mode=sliding)
+//
+// The output options of GET are the same as of /buffered.
+func WindowHandler(bucket, retention time.Duration) func(http.ResponseWriter, *http.Request) error {
+	store := newWindowStore(bucket, retention)
+
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		defer closer(req.Body)
+
+		name := mux.Vars(req)["name"]
+		if !datasetName.MatchString(name) {
+			return newStatusError(http.StatusBadRequest, "invalid counter name %q, must be letters, digits, '_', '-' or '.'", name)
+		}
+		// Deltas of events are floats.
+		if err := floatNumbers(req.URL.Query(), "windows"); err != nil {
+			return err
+		}
+
+		if req.Method == http.MethodPost {
+			events, err := decodeEvents(req)
+			if err != nil {
+				return err
+			}
+			if err := store.add(name, events.Events); err != nil {
+				return err
+			}
+			rw.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		enc, mediaType, err := BufferedMediaTypes.Encoder(req)
+		if err != nil {
+			return err
+		}
+		params := req.URL.Query()
+		opts, err := parseOptions(params)
+		if err != nil {
+			return err
+		}
+		start, end, err := store.window(params)
+		if err != nil {
+			return err
+		}
+		res, err := opts.page(req, func() ([]Facet, error) {
+			root, err := store.rollup(name, start, end)
+			if err != nil {
+				return nil, err
+			}
+			return root.Facets(), nil
+		})
+		if err != nil {
+			return err
+		}
+
+		setNextLink(rw, req, &res)
+		rw.Header().Set("X-Window-Start", start.UTC().Format(time.RFC3339))
+		rw.Header().Set("X-Window-End", end.UTC().Format(time.RFC3339))
+		rw.Header().Set("Content-Type", mediaType)
+		return enc(rw, req, &res)
+	}
+}
+
+// decodeEvents parses the events of POST request, only JSON is accepted.
+func decodeEvents(req *http.Request) (*EventsJSON, error) {
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != mediaTypeJSON {
+			return nil, newStatusError(http.StatusUnsupportedMediaType, "unsupported content type %q, supported: %s", contentType, mediaTypeJSON)
+		}
+	}
+	var events EventsJSON
+	if err := jsoniter.NewDecoder(req.Body).Decode(&events); err != nil {
+		return nil, errors.Wrap(badRequest(err), "unable to parse events")
+	}
+	return &events, nil
+}
+
+// windowStore keeps the time-windowed counters in memory, counters whose
+// buckets all expired are dropped.
+type windowStore struct {
+	bucket    time.Duration
+	retention time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	counters map[string]*windowCounter
+}
+
+// newWindowStore returns store of counters with buckets of given size kept
+// for retention. Zero values select the defaults.
+func newWindowStore(bucket, retention time.Duration) *windowStore {
+	if bucket <= 0 {
+		bucket = defaultWindowBucket
+	}
+	if retention <= 0 {
+		retention = defaultWindowRetention
+	}
+	return &windowStore{
+		bucket:    bucket,
+		retention: retention,
+		now:       time.Now,
+		counters:  make(map[string]*windowCounter),
+	}
+}
+
+// window returns the time range selected by the ?window=, ?mode= and ?at=
+// options. Sliding window (default) ends at the given time (now by default),
+// tumbling window is the one containing it, windows are aligned to multiples
+// of their length. The whole retention is selected when window is not set.
+func (s *windowStore) window(params url.Values) (start, end time.Time, err error) {
+	end = s.now()
+	if v := params.Get("at"); v != "" {
+		if end, err = time.Parse(time.RFC3339, v); err != nil {
+			return start, end, newStatusError(http.StatusBadRequest, "invalid at option %q, must be RFC 3339 time", v)
+		}
+	}
+
+	length := s.retention
+	if v := params.Get("window"); v != "" {
+		length, err = time.ParseDuration(v)
+		if err != nil || length < s.bucket || length%s.bucket != 0 {
+			return start, end, newStatusError(http.StatusBadRequest, "invalid window option %q, must be a multiple of the bucket size %s", v, s.bucket)
+		}
+		if length > s.retention {
+			return start, end, newStatusError(http.StatusBadRequest, "invalid window option %q, must not be longer than the retention %s", v, s.retention)
+		}
+	}
+
+	switch mode := params.Get("mode"); mode {
+	case "", windowSliding:
+		// The bucket containing end is the last one.
+		end = end.Truncate(s.bucket).Add(s.bucket)
+		return end.Add(-length), end, nil
+	case windowTumbling:
+		start = end.Truncate(length)
+		return start, start.Add(length), nil
+	default:
+		return start, end, newStatusError(http.StatusBadRequest, "unknown window mode %q, supported: %s, %s", mode, windowSliding, windowTumbling)
+	}
+}
+
+// add validates and adds the events to counter of given name, either all of
+// them or none. The counter is created when it does not exist.
+func (s *windowStore) add(name string, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.expire(now)
+	c, ok := s.counters[name]
+	if !ok {
+		c = newWindowCounter()
+	}
+	if err := c.check(events, now, s.bucket, s.retention); err != nil {
+		return err
+	}
+	for _, event := range events {
+		t := now
+		if event.Time != nil {
+			t = *event.Time
+		}
+		c.add(t.Truncate(s.bucket).UnixNano(), strings.Split(event.Path, "/"), event.Delta)
+	}
+	s.counters[name] = c
+	return nil
+}
+
+// rollup returns the tree of counter summed over the buckets between start
+// (inclusive) and end (exclusive), 404 error when the counter does not exist.
+func (s *windowStore) rollup(name string, start, end time.Time) (*Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(s.now())
+	c, ok := s.counters[name]
+	if !ok {
+		return nil, newStatusError(http.StatusNotFound, "counter %q not found", name)
+	}
+	return c.rollup(start.UnixNano(), end.UnixNano())
+}
+
+// expire drops the buckets older than retention and the emptied counters.
+func (s *windowStore) expire(now time.Time) {
+	oldest := now.Add(-s.retention).Truncate(s.bucket).UnixNano()
+	for name, c := range s.counters {
+		c.expire(oldest)
+		if len(c.buckets) == 0 {
+			delete(s.counters, name)
+		}
+	}
+}
+
+// windowCounter is a facet tree split into time buckets.
+type windowCounter struct {
+	buckets map[int64]*windowBucket // bucket start (Unix nanoseconds) -> bucket
+	// facets are all the facets of the live buckets, so that the paths of new
+	// events are validated against them.
+	facets map[string]*windowFacet // path key -> facet
+}
+
+// windowBucket is the sum of the events of one bucket.
+type windowBucket struct {
+	leaves map[string]*windowLeaf // path key -> leaf
+}
+
+type windowLeaf struct {
+	path  []string
+	count float64
+}
+
+// windowFacet is a facet of the live buckets, refs is the number of bucket
+// leaves in its subtree, it is dropped when the last of them expires.
+type windowFacet struct {
+	leaf bool
+	refs int
+}
+
+func newWindowCounter() *windowCounter {
+	return &windowCounter{
+		buckets: make(map[int64]*windowBucket),
+		facets:  make(map[string]*windowFacet),
+	}
+}
+
+// check returns ValidationError listing all the invalid events: events out of
+// the retention, negative deltas, deltas of facets with children and paths
+// through leaves.
+func (c *windowCounter) check(events []Event, now time.Time, bucket, retention time.Duration) error {
+	var (
+		invalid []InvalidLeaf
+		created = make(map[string]bool) // path key of facets created by the events -> leaf
+		oldest  = now.Add(-retention).Truncate(bucket)
+		latest  = now.Truncate(bucket).Add(bucket)
+	)
+	for _, event := range events {
+		var (
+			path   = strings.Split(event.Path, "/")
+			reason string
+		)
+		switch {
+		case contains(path, ""):
+			reason = "path contains empty facet name"
+		case math.IsNaN(event.Delta) || math.IsInf(event.Delta, 0):
+			reason = "delta is not finite"
+		case event.Delta < 0:
+			reason = "delta is negative"
+		case event.Time != nil && event.Time.Before(oldest):
+			reason = "event is older than the retention"
+		case event.Time != nil && !event.Time.Before(latest):
+			reason = "event is in the future"
+		default:
+			reason = pathConflict(path, created, func(key string) (leaf, exists bool) {
+				facet, ok := c.facets[key]
+				return ok && facet.leaf, ok
+			})
+		}
+		if reason != "" {
+			invalid = append(invalid, InvalidLeaf{Path: event.Path, Value: event.Delta, Reason: reason})
+		}
+	}
+	if len(invalid) > 0 {
+		return &ValidationError{Leaves: invalid}
+	}
+	return nil
+}
+
+// add adds the checked delta to the leaf at path in bucket.
+func (c *windowCounter) add(bucket int64, path []string, delta float64) {
+	b, ok := c.buckets[bucket]
+	if !ok {
+		b = &windowBucket{leaves: make(map[string]*windowLeaf)}
+		c.buckets[bucket] = b
+	}
+	key := pathKey(path)
+	leaf, ok := b.leaves[key]
+	if !ok {
+		leaf = &windowLeaf{path: path}
+		b.leaves[key] = leaf
+		for i := range path {
+			prefix := pathKey(path[:i+1])
+			facet, ok := c.facets[prefix]
+			if !ok {
+				facet = &windowFacet{leaf: i == len(path)-1}
+				c.facets[prefix] = facet
+			}
+			facet.refs++
+		}
+	}
+	leaf.count += delta
+}
+
+// expire drops the buckets starting before oldest.
+func (c *windowCounter) expire(oldest int64) {
+	for start, b := range c.buckets {
+		if start >= oldest {
+			continue
+		}
+		for _, leaf := range b.leaves {
+			for i := range leaf.path {
+				prefix := pathKey(leaf.path[:i+1])
+				facet := c.facets[prefix]
+				if facet.refs--; facet.refs == 0 {
+					delete(c.facets, prefix)
+				}
+			}
+		}
+		delete(c.buckets, start)
+	}
+}
+
+// rollup sums the buckets starting between start (inclusive) and end
+// (exclusive) into a tree. Leaves are added in path order, so the document
+// order of the tree does not depend on the buckets.
+func (c *windowCounter) rollup(start, end int64) (*Node, error) {
+	leaves := make(map[string]*windowLeaf)
+	for t, b := range c.buckets {
+		if t < start || t >= end {
+			continue
+		}
+		for key, leaf := range b.leaves {
+			sum, ok := leaves[key]
+			if !ok {
+				sum = &windowLeaf{path: leaf.path}
+				leaves[key] = sum
+			}
+			sum.count += leaf.count
+		}
+	}
+
+	keys := make([]string, 0, len(leaves))
+	for key := range leaves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	builder := newTreeBuilder()
+	for _, key := range keys {
+		if err := builder.Add(leaves[key].path, leaves[key].count); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Root(), nil
+}
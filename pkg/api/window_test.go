@@ -0,0 +1,107 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"refactored-octo-giggle/pkg/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// event returns JSON event which happened ago before now.
+func event(ago time.Duration, path string, delta float64) string {
+	return fmt.Sprintf(`{"time": %q, "path": %q, "delta": %v}`, time.Now().Add(-ago).Format(time.RFC3339Nano), path, delta)
+}
+
+func TestWindow(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	rr := request(t, router, "POST", "/api/v1/windows/segment1", `{"events": [`+strings.Join([]string{
+		event(10*time.Minute, "facet1/facet3", 5),
+		event(2*time.Minute, "facet1/facet3", 1),
+		event(2*time.Minute, "facet2", 2),
+		`{"path": "facet1/facet4", "delta": 1}`,
+	}, ", ")+`]}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code, "status code differs")
+
+	tests := []struct {
+		name     string
+		query    string
+		code     int
+		expected string
+	}{
+		{"retention", "", http.StatusOK, `{"result": [{"facet1": 7}, {"facet2": 2}, {"facet3": 6}, {"facet4": 1}]}`},
+		{"sliding", "?window=5m", http.StatusOK, `{"result": [{"facet1": 2}, {"facet2": 2}, {"facet3": 1}, {"facet4": 1}]}`},
+		{"sliding select", "?window=5m&mode=sliding&select=facet1", http.StatusOK, `{"result": [{"facet1": 2}, {"facet3": 1}, {"facet4": 1}]}`},
+		{"past", "?window=5m&at=" + url.QueryEscape(time.Now().Add(-8*time.Minute).Format(time.RFC3339)), http.StatusOK, `{"result": [{"facet1": 5}, {"facet3": 5}]}`},
+		{"not bucket multiple", "?window=15s", http.StatusBadRequest, ""},
+		{"longer than retention", "?window=48h", http.StatusBadRequest, ""},
+		{"unknown mode", "?mode=hopping", http.StatusBadRequest, ""},
+		{"invalid at", "?at=yesterday", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := request(t, router, "GET", "/api/v1/windows/segment1"+tt.query, "")
+			assert.Equal(t, tt.code, rr.Code, "status code differs")
+			if tt.expected != "" {
+				assert.JSONEq(t, tt.expected, rr.Body.String(), "response body differs")
+			}
+		})
+	}
+
+	rr = request(t, router, "GET", "/api/v1/windows/segment2", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code, "status code differs")
+}
+
+func TestWindowTumbling(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	hour := time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+	since := time.Since(hour)
+	rr := request(t, router, "POST", "/api/v1/windows/segment1", `{"events": [`+strings.Join([]string{
+		event(since-10*time.Minute, "facet1/facet3", 1),
+		event(since-50*time.Minute, "facet1/facet3", 2),
+		event(since-70*time.Minute, "facet1/facet3", 4),
+	}, ", ")+`]}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code, "status code differs")
+
+	at := url.QueryEscape(hour.Add(30 * time.Minute).Format(time.RFC3339))
+	rr = request(t, router, "GET", "/api/v1/windows/segment1?mode=tumbling&window=1h&at="+at, "")
+	assert.Equal(t, http.StatusOK, rr.Code, "status code differs")
+	assert.JSONEq(t, `{"result": [{"facet1": 3}, {"facet3": 3}]}`, rr.Body.String(), "response body differs")
+	assert.Equal(t, hour.UTC().Format(time.RFC3339), rr.Header().Get("X-Window-Start"), "window start differs")
+	assert.Equal(t, hour.Add(time.Hour).UTC().Format(time.RFC3339), rr.Header().Get("X-Window-End"), "window end differs")
+}
+
+func TestWindowInvalidEvents(t *testing.T) {
+	router := api.NewRouter(api.Config{})
+	rr := request(t, router, "POST", "/api/v1/windows/segment1", `{"events": [{"path": "facet1/facet3", "delta": 1}]}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code, "status code differs")
+
+	rr = request(t, router, "POST", "/api/v1/windows/segment1", `{"events": [`+strings.Join([]string{
+		`{"path": "facet1/facet4", "delta": 1}`,
+		event(25*time.Hour, "facet2", 1),
+		event(-time.Hour, "facet2", 1),
+		`{"path": "facet2", "delta": -1}`,
+		`{"path": "facet1", "delta": 1}`,
+		`{"path": "facet1/facet3/facet5", "delta": 1}`,
+		`{"path": "facet1//facet5", "delta": 1}`,
+	}, ", ")+`]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "status code differs")
+	assert.JSONEq(t, `[
+		{"path": "facet2", "value": 1, "reason": "event is older than the retention"},
+		{"path": "facet2", "value": 1, "reason": "event is in the future"},
+		{"path": "facet2", "value": -1, "reason": "delta is negative"},
+		{"path": "facet1", "value": 1, "reason": "facet has children"},
+		{"path": "facet1/facet3/facet5", "value": 1, "reason": "facet \"facet1/facet3\" is a leaf"},
+		{"path": "facet1//facet5", "value": 1, "reason": "path contains empty facet name"}
+	]`, jsonField(t, rr.Body.Bytes(), "invalid"), "invalid events differ")
+
+	// Nothing was added.
+	rr = request(t, router, "GET", "/api/v1/windows/segment1", "")
+	assert.JSONEq(t, `{"result": [{"facet1": 1}, {"facet3": 1}]}`, rr.Body.String(), "response body differs")
+}